@@ -20,6 +20,7 @@ import (
 	"flag"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"runtime"
 	"strings"
@@ -39,10 +40,12 @@ var (
 	logFileName, metadataFileName string
 	messageFileName               string
 	interfaceName                 string
+	localAddr                     string
 	ehlo                          string
 	portFlag                      uint
 	inputFile, metadataFile       *os.File
 	timeout                       uint
+	bannerTimeout                 uint
 	tlsVersion                    string
 	rootCAFileName                string
 )
@@ -67,14 +70,19 @@ func init() {
 	flag.StringVar(&logFileName, "log-file", "-", "File to log to, use - for stderr")
 	flag.BoolVar(&config.LookupDomain, "lookup-domain", false, "Input contains only domain names")
 	flag.StringVar(&interfaceName, "interface", "", "Network interface to send on")
+	flag.StringVar(&localAddr, "local-addr", "", "Local IP address, with optional :port, to send from")
 	flag.UintVar(&portFlag, "port", 80, "Port to grab on")
+	flag.IntVar(&config.ProxyHeader, "proxy-header", 0, "Send a PROXY protocol header of this version (1 or 2) before anything else")
 	flag.UintVar(&timeout, "timeout", 10, "Set connection timeout in seconds")
+	flag.UintVar(&bannerTimeout, "banner-timeout", 0, "Set timeout in seconds for the SMTP, POP3 and IMAP greeting, 0 to use the connection timeout")
 	flag.BoolVar(&config.TLS, "tls", false, "Grab over TLS")
 	flag.StringVar(&tlsVersion, "tls-version", "", "Max TLS version to use (implies --tls)")
 	flag.UintVar(&config.Senders, "senders", 1000, "Number of send coroutines to use")
 	flag.UintVar(&config.ConnectionsPerHost, "connections-per-host", 1, "Number of times to connect to each host (results in more output)")
 	flag.BoolVar(&config.Banners, "banners", false, "Read banner upon connection creation")
 	flag.StringVar(&messageFileName, "data", "", "Send a message and read response (%s will be replaced with destination IP)")
+	flag.IntVar(&config.MaxRecordedBytes, "max-recorded-bytes", 0, "Max bytes of sent and received data to record in output, 0 for unlimited")
+	flag.IntVar(&config.MaxReadCalls, "max-read-calls", 0, "Max reads to wait for a complete SMTP, POP3 or IMAP response, 0 for unlimited")
 	flag.StringVar(&config.HTTP.Endpoint, "http", "", "Send an HTTP request to an endpoint")
 	flag.StringVar(&config.HTTP.Method, "http-method", "GET", "Set HTTP request method type")
 	flag.StringVar(&config.HTTP.UserAgent, "http-user-agent", "Mozilla/5.0 zgrab/0.x", "Set a custom HTTP user agent")
@@ -86,10 +94,17 @@ func init() {
 	flag.StringVar(&config.EHLODomain, "ehlo", "", "Send an EHLO with the specified domain (implies --smtp)")
 	flag.BoolVar(&config.SMTPHelp, "smtp-help", false, "Send a SMTP help (implies --smtp)")
 	flag.BoolVar(&config.StartTLS, "starttls", false, "Send STARTTLS before negotiating")
+	flag.BoolVar(&config.SMTPRecheckEHLO, "smtp-recheck-ehlo", false, "Send EHLO again after STARTTLS and record how the extensions changed (requires --ehlo and --starttls)")
 	flag.BoolVar(&config.SMTP, "smtp", false, "Conform to SMTP when reading responses and sending STARTTLS")
 	flag.BoolVar(&config.IMAP, "imap", false, "Conform to IMAP rules when sending STARTTLS")
 	flag.BoolVar(&config.POP3, "pop3", false, "Conform to POP3 rules when sending STARTTLS")
 	flag.BoolVar(&config.Modbus, "modbus", false, "Send some modbus data")
+	flag.StringVar(&config.WHOISQuery, "whois", "", "Send a WHOIS query and read the response")
+	flag.StringVar(&config.DNSChaosQuery, "dns-chaos", "", "Send a CHAOS class TXT query for this name over TCP, e.g. version.bind")
+	flag.BoolVar(&config.MQTT, "mqtt", false, "Send an MQTT CONNECT and read the CONNACK")
+	flag.StringVar(&config.MQTTClientID, "mqtt-client-id", "zgrab", "Client identifier to send in the MQTT CONNECT")
+	flag.BoolVar(&config.MySQL, "mysql", false, "Read and parse the MySQL server handshake")
+	flag.BoolVar(&config.RDP, "rdp", false, "Send an RDP negotiation request, then a TLS handshake if the server selects TLS")
 	flag.BoolVar(&config.BACNet, "bacnet", false, "Send some BACNet data")
 	flag.BoolVar(&config.Fox, "fox", false, "Send some Niagara Fox Tunneling data")
 	flag.BoolVar(&config.S7, "s7", false, "Send some Siemens S7 data")
@@ -111,13 +126,18 @@ func init() {
 	flag.BoolVar(&config.Heartbleed, "heartbleed", false, "Check if server is vulnerable to Heartbleed (implies --tls)")
 
 	flag.BoolVar(&config.GatherSessionTicket, "tls-session-ticket", false, "Send support for TLS Session Tickets and output ticket if presented")
-	flag.BoolVar(&config.ExtendedMasterSecret, "tls-extended-master-secret", false, "Offer RFC 7627 Extended Master Secret extension")
+	flag.BoolVar(&config.ExtendedMasterSecret, "tls-extended-master-secret", false, "Deprecated: the RFC 7627 Extended Master Secret extension is always offered")
+	flag.BoolVar(&config.TLSDisableSSLv3, "tls-disable-sslv3", false, "Never negotiate SSL 3.0, even when it is below the max TLS version")
+	flag.BoolVar(&config.TLSCheckCloseNotify, "tls-check-close-notify", false, "Wait for the server to close the TLS connection and record whether it sent close_notify")
+	flag.BoolVar(&config.TLSRecordHandshakeBytes, "tls-record-handshake-bytes", false, "Record the raw bytes sent and received during the TLS handshake, limited by --max-recorded-bytes")
+	flag.BoolVar(&config.TLSOfferCompression, "tls-offer-compression", false, "Offer DEFLATE compression to detect servers exposed to CRIME")
 	flag.BoolVar(&config.TLSVerbose, "tls-verbose", false, "Add extra TLS information to JSON output (client hello, client KEX, key material, etc)")
 
 	flag.StringVar(&rootCAFileName, "ca-file", "", "List of trusted root certificate authorities in PEM format")
 	flag.IntVar(&config.GOMAXPROCS, "gomaxprocs", 3, "Set GOMAXPROCS (default 3)")
 	flag.BoolVar(&config.FTP, "ftp", false, "Read FTP banners")
 	flag.BoolVar(&config.FTPAuthTLS, "ftp-authtls", false, "Collect FTPS certificates in addition to FTP banners")
+	flag.BoolVar(&config.FTPFeat, "ftp-feat", false, "Send FEAT to list FTP server features after the banner")
 	flag.BoolVar(&config.DNP3, "dnp3", false, "Read DNP3 banners")
 	flag.BoolVar(&config.SSH.SSH, "ssh", false, "SSH scan")
 	flag.StringVar(&config.SSH.Client, "ssh-client", "", "Mimic behavior of a specific SSH client")
@@ -172,12 +192,25 @@ func init() {
 	if config.FTPAuthTLS && !config.FTP {
 		zlog.Fatal("--ftp-authtls requires usage of --ftp")
 	}
+	if config.FTPFeat && !config.FTP {
+		zlog.Fatal("--ftp-feat requires usage of --ftp")
+	}
 
 	// Validate Telnet
 	if config.Telnet && config.Banners {
 		zlog.Fatal("--telnet and --banners are mutually exclusive")
 	}
 
+	// Validate MySQL
+	if config.MySQL && config.Banners {
+		zlog.Fatal("--mysql and --banners are mutually exclusive")
+	}
+
+	// Validate RDP
+	if config.RDP && (config.Banners || config.TLS) {
+		zlog.Fatal("--rdp cannot be used with --banners or --tls")
+	}
+
 	// Validate TLS Versions
 	tv := strings.ToUpper(tlsVersion)
 	if tv != "" {
@@ -229,6 +262,10 @@ func init() {
 		zlog.Fatal("Cannot send an EHLO when conforming to IMAP or POP3")
 	}
 
+	if config.SMTPRecheckEHLO && !(config.EHLO && config.StartTLS) {
+		zlog.Fatal("--smtp-recheck-ehlo requires --ehlo and --starttls")
+	}
+
 	if config.SMTP {
 		mailType = "SMTP"
 	} else if config.POP3 {
@@ -261,6 +298,31 @@ func init() {
 
 	// Validate timeout
 	config.Timeout = time.Duration(timeout) * time.Second
+	config.BannerTimeout = time.Duration(bannerTimeout) * time.Second
+
+	if config.MaxRecordedBytes < 0 {
+		zlog.Fatal("--max-recorded-bytes must be non-negative")
+	}
+
+	if config.MaxReadCalls < 0 {
+		zlog.Fatal("--max-read-calls must be non-negative")
+	}
+
+	if config.ProxyHeader < 0 || config.ProxyHeader > 2 {
+		zlog.Fatal("--proxy-header must be 1 or 2")
+	}
+
+	// Validate local address
+	if localAddr != "" {
+		if _, _, err := net.SplitHostPort(localAddr); err != nil {
+			localAddr = net.JoinHostPort(localAddr, "0")
+		}
+		addr, err := net.ResolveTCPAddr("tcp", localAddr)
+		if err != nil {
+			zlog.Fatalf("Invalid local address '%s': %s", localAddr, err)
+		}
+		config.LocalAddr = addr
+	}
 
 	// Validate senders
 	if config.Senders == 0 {
@@ -18,6 +18,7 @@ import (
 	"encoding/csv"
 	"errors"
 	"io"
+	"net"
 	"strings"
 	"time"
 
@@ -96,8 +97,11 @@ type Config struct {
 	// Connection
 	Port               uint16
 	Timeout            time.Duration
+	BannerTimeout      time.Duration
 	Senders            uint
 	ConnectionsPerHost uint
+	LocalAddr          net.Addr
+	ProxyHeader        int
 
 	// DNS
 	LookupDomain bool
@@ -106,25 +110,29 @@ type Config struct {
 	Encoding string
 
 	// TLS
-	TLS                  bool
-	TLSVersion           uint16
-	Heartbleed           bool
-	RootCAPool           *x509.CertPool
-	DHEOnly              bool
-	ECDHEOnly            bool
-	ExportsOnly          bool
-	ExportsDHOnly        bool
-	FirefoxOnly          bool
-	FirefoxNoDHE         bool
-	ChromeOnly           bool
-	ChromeNoDHE          bool
-	SafariOnly           bool
-	SafariNoDHE          bool
-	NoSNI                bool
-	TLSExtendedRandom    bool
-	GatherSessionTicket  bool
-	ExtendedMasterSecret bool
-	TLSVerbose           bool
+	TLS                     bool
+	TLSVersion              uint16
+	Heartbleed              bool
+	RootCAPool              *x509.CertPool
+	DHEOnly                 bool
+	ECDHEOnly               bool
+	ExportsOnly             bool
+	ExportsDHOnly           bool
+	FirefoxOnly             bool
+	FirefoxNoDHE            bool
+	ChromeOnly              bool
+	ChromeNoDHE             bool
+	SafariOnly              bool
+	SafariNoDHE             bool
+	NoSNI                   bool
+	TLSExtendedRandom       bool
+	GatherSessionTicket     bool
+	ExtendedMasterSecret    bool
+	TLSOfferCompression     bool
+	TLSDisableSSLv3         bool
+	TLSCheckCloseNotify     bool
+	TLSRecordHandshakeBytes bool
+	TLSVerbose              bool
 
 	// SSH
 	SSH SSHScanConfig
@@ -135,6 +143,12 @@ type Config struct {
 	Data     []byte
 	Raw      bool
 
+	// Max bytes of sent and received data to record, 0 for unlimited
+	MaxRecordedBytes int
+
+	// Max reads for one mail protocol response, 0 for unlimited
+	MaxReadCalls int
+
 	// Mail
 	SMTP       bool
 	IMAP       bool
@@ -144,9 +158,13 @@ type Config struct {
 	EHLO       bool
 	StartTLS   bool
 
+	// Send EHLO again after STARTTLS and compare the extensions
+	SMTPRecheckEHLO bool
+
 	// FTP
 	FTP        bool
 	FTPAuthTLS bool
+	FTPFeat    bool
 
 	// Telnet
 	Telnet        bool
@@ -155,6 +173,22 @@ type Config struct {
 	// Modbus
 	Modbus bool
 
+	// WHOIS
+	WHOISQuery string
+
+	// DNS CHAOS TXT query, e.g. version.bind
+	DNSChaosQuery string
+
+	// MQTT
+	MQTT         bool
+	MQTTClientID string
+
+	// MySQL
+	MySQL bool
+
+	// RDP
+	RDP bool
+
 	// BACNet
 	BACNet bool
 
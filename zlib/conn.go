@@ -16,9 +16,18 @@ package zlib
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -26,23 +35,39 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/zmap/zgrab/ztools/ftp"
+	"github.com/zmap/zgrab/ztools/keys"
 	"github.com/zmap/zgrab/ztools/scada/bacnet"
 	"github.com/zmap/zgrab/ztools/ssh"
 	"github.com/zmap/zgrab/ztools/util"
 	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/x509/pkix"
+	"github.com/zmap/zgrab/ztools/zct"
 	"github.com/zmap/zgrab/ztools/ztls"
 )
 
-var smtpEndRegex = regexp.MustCompile(`(?:^\d\d\d\s.*\r\n$)|(?:^\d\d\d-[\s\S]*\r\n\d\d\d\s.*\r\n$)`)
-var pop3EndRegex = regexp.MustCompile(`(?:\r\n\.\r\n$)|(?:\r\n$)`)
-var imapStatusEndRegex = regexp.MustCompile(`\r\n$`)
+// An SMTP response is complete once a line with a space (or nothing) after
+// the reply code is read. Every line before it is a "NNN-" continuation.
+// The mail regexes accept a bare LF as well as CRLF, since some embedded
+// servers end their lines with LF alone.
+var smtpEndRegex = regexp.MustCompile(`(?:^\d\d\d(?: .*)?\r?\n$)|(?:^\d\d\d-[\s\S]*\n\d\d\d(?: .*)?\r?\n$)`)
+var pop3EndRegex = regexp.MustCompile(`(?:\r?\n\.\r?\n$)|(?:\r?\n$)`)
+var pop3MultiLineEndRegex = regexp.MustCompile(`(?:^-ERR.*\r?\n$)|(?:\n\.\r?\n$)`)
+var imapStatusEndRegex = regexp.MustCompile(`\r?\n$`)
+var imapCapabilityRegex = regexp.MustCompile(`(?i)\[CAPABILITY ([^\]]*)\]`)
 
 const (
+	// Deprecated: SMTPStartTLSHandshake ends the command with the line
+	// ending set by SetLineEnding.
 	SMTP_COMMAND = "STARTTLS\r\n"
+	// Deprecated: POP3StartTLSHandshake ends the command with the line
+	// ending set by SetLineEnding.
 	POP3_COMMAND = "STLS\r\n"
+	// Deprecated: IMAPStartTLSHandshake tags the command itself and ends it
+	// with the line ending set by SetLineEnding.
 	IMAP_COMMAND = "a001 STARTTLS\r\n"
 )
 
@@ -55,31 +80,79 @@ type Conn struct {
 
 	grabData GrabData
 
+	// Opens another connection to the same target, for probes that need
+	// more than one handshake
+	dial func() (net.Conn, error)
+
 	// Max TLS version
 	maxTlsVersion uint16
 
+	// Refuse to negotiate SSL 3.0, regardless of the max version
+	disableSSLv3 bool
+
 	// Cache the deadlines so we can reapply after TLS handshake
 	readDeadline  time.Time
 	writeDeadline time.Time
 
+	// Bound on the initial banner read, zero to use readDeadline
+	bannerTimeout time.Duration
+
 	caPool *x509.CertPool
 
-	CipherSuites              []uint16
-	ForceSuites               bool
-	noSNI                     bool
-	extendedRandom            bool
-	gatherSessionTicket       bool
-	offerExtendedMasterSecret bool
-	tlsVerbose                bool
+	CipherSuites         []uint16
+	ForceSuites          bool
+	noSNI                bool
+	extendedRandom       bool
+	gatherSessionTicket  bool
+	offerCompression     bool
+	tlsVerbose           bool
+	keyLogWriter         io.Writer
+	checkCloseNotify     bool
+	recordHandshakeBytes bool
+	maxFragmentLength    uint8
+	verifyCallback       func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 
 	domain string
 
 	// Encoding type
 	ReadEncoding string
 
+	// Cap on the number of bytes of Read and Write data kept in grabData,
+	// zero means unlimited
+	maxRecordedBytes int
+
+	// Cap on the number of reads for one mail protocol response, zero means
+	// unlimited
+	maxReadCalls int
+
+	// Line ending for text protocol commands, "\r\n" if empty
+	lineEnding string
+
+	// PROXY protocol header version used by SendProxyHeader
+	proxyHeaderVersion int
+
+	// Number of IMAP commands tagged so far
+	imapTagCount int
+
+	// Name sent in EHLO when no domain is given
+	ehloName string
+
+	// SMTP recipient probing
+	smtpMailSent      bool
+	allowMultipleRCPT bool
+
+	// Lets SMTPProbeCommands send commands that change the session state
+	allowUnsafeSMTP bool
+
 	// SSH
 	sshScan *SSHScanConfig
 
+	// Set when the TLS handshake after STARTTLS failed
+	starttlsFailed bool
+
+	// Let WriteRaw bypass an established TLS session
+	allowRawWriteAfterTLS bool
+
 	// Errored component
 	erroredComponent string
 }
@@ -91,10 +164,80 @@ func (c *Conn) getUnderlyingConn() net.Conn {
 	return c.conn
 }
 
+// SetDial sets the function used to open new connections to the same target
+// when a probe needs more than one handshake. Conns from Dialer have one set
+// already.
+func (c *Conn) SetDial(dial func() (net.Conn, error)) {
+	c.dial = dial
+}
+
+// ErrInvalidLineEnding is returned by SetLineEnding for anything other than
+// "\r\n", "\n" or "\r".
+var ErrInvalidLineEnding = errors.New("line ending must be \\r\\n, \\n or \\r")
+
+// SetMaxReadCalls limits how many reads an SMTP, POP3 or IMAP response may
+// take before it is abandoned with util.ErrTooManyReads, so a server that
+// trickles data without ever completing a response cannot hold the
+// connection until the buffer fills. Zero means no limit.
+func (c *Conn) SetMaxReadCalls(n int) {
+	c.maxReadCalls = n
+}
+
+// SetLineEnding sets the line ending used to terminate text protocol
+// commands, for servers that expect a bare "\n" or "\r" instead of "\r\n".
+func (c *Conn) SetLineEnding(le string) error {
+	switch le {
+	case "\r\n", "\n", "\r":
+		c.lineEnding = le
+		return nil
+	default:
+		return ErrInvalidLineEnding
+	}
+}
+
+// newline returns the line ending for text protocol commands
+func (c *Conn) newline() string {
+	if c.lineEnding == "" {
+		return "\r\n"
+	}
+	return c.lineEnding
+}
+
+// SetBannerTimeout bounds how long SMTPBanner, POP3Banner and IMAPBanner wait
+// for the server's greeting, independently of the read deadline. The read
+// deadline is restored once the banner has been read.
+func (c *Conn) SetBannerTimeout(d time.Duration) {
+	c.bannerTimeout = d
+}
+
+// applyBannerTimeout sets the read deadline for a banner read, never past
+// the connection's own read deadline, and returns a function that restores
+// the previous deadline.
+func (c *Conn) applyBannerTimeout() func() {
+	if c.bannerTimeout <= 0 {
+		return func() {}
+	}
+	conn := c.getUnderlyingConn()
+	deadline := time.Now().Add(c.bannerTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	return func() {
+		conn.SetReadDeadline(c.readDeadline)
+	}
+}
+
 func (c *Conn) SetExtendedRandom() {
 	c.extendedRandom = true
 }
 
+// DisableSSLv3 removes SSL 3.0 from the versions accepted in TLSHandshake, so
+// that only TLS 1.0 and later is negotiated.
+func (c *Conn) DisableSSLv3() {
+	c.disableSSLv3 = true
+}
+
 func (c *Conn) SetCAPool(pool *x509.CertPool) {
 	c.caPool = pool
 }
@@ -111,14 +254,51 @@ func (c *Conn) SetGatherSessionTicket() {
 	c.gatherSessionTicket = true
 }
 
+// SetOfferExtendedMasterSecret is kept for compatibility.
+//
+// Deprecated: TLSHandshake always offers the extended master secret.
 func (c *Conn) SetOfferExtendedMasterSecret() {
-	c.offerExtendedMasterSecret = true
+}
+
+// SetOfferCompression controls whether the ClientHello offers DEFLATE
+// compression ahead of null compression. It is off by default; turn it on
+// to check servers for CRIME.
+func (c *Conn) SetOfferCompression(offer bool) {
+	c.offerCompression = offer
+}
+
+// SetCheckCloseNotify makes Close wait briefly for the server to shut down
+// the TLS connection, and record whether it sent a close_notify alert.
+func (c *Conn) SetCheckCloseNotify() {
+	c.checkCloseNotify = true
 }
 
 func (c *Conn) SetTLSVerbose() {
 	c.tlsVerbose = true
 }
 
+func (c *Conn) SetMaxRecordedBytes(n int) {
+	c.maxRecordedBytes = n
+}
+
+// recordBytes returns the portion of b that should be kept in grabData, and
+// whether it had to be truncated to get there
+func (c *Conn) recordBytes(b []byte) (string, bool) {
+	if c.maxRecordedBytes > 0 && len(b) > c.maxRecordedBytes {
+		return string(b[0:c.maxRecordedBytes]), true
+	}
+	return string(b), false
+}
+
+// recordRaw returns b for attaching to an event, cut to maxRecordedBytes if
+// that is set.
+func (c *Conn) recordRaw(b []byte) []byte {
+	if c.maxRecordedBytes > 0 && len(b) > c.maxRecordedBytes {
+		return b[0:c.maxRecordedBytes]
+	}
+	return b
+}
+
 // Layer in the regular conn methods
 func (c *Conn) LocalAddr() net.Addr {
 	return c.getUnderlyingConn().LocalAddr()
@@ -146,11 +326,57 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 
 // Delegate here, but record all the things
 func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.checkUsable(); err != nil {
+		return 0, err
+	}
 	n, err := c.getUnderlyingConn().Write(b)
-	c.grabData.Write = string(b[0:n])
+	var truncated bool
+	c.grabData.Write, truncated = c.recordBytes(b[0:n])
+	c.grabData.WriteLength = 0
+	if truncated {
+		c.grabData.WriteLength = n
+	}
 	return n, err
 }
 
+// ErrRawWriteAfterTLS is returned by WriteRaw once TLS is established,
+// unless SetAllowRawWriteAfterTLS was called.
+var ErrRawWriteAfterTLS = errors.New("refusing to write plaintext after the TLS handshake")
+
+// A WriteEvent represents bytes written with WriteRaw
+type WriteEvent struct {
+	Data     []byte `json:"data"`
+	Length   int    `json:"length,omitempty"`
+	AfterTLS bool   `json:"after_tls,omitempty"`
+}
+
+// SetAllowRawWriteAfterTLS lets WriteRaw write plaintext beneath an
+// established TLS session, which will usually break it.
+func (c *Conn) SetAllowRawWriteAfterTLS(allow bool) {
+	c.allowRawWriteAfterTLS = allow
+}
+
+// WriteRaw writes b directly to the plaintext connection and records it in a
+// WriteEvent. It is meant for protocol preambles ahead of TLS that no other
+// method sends.
+func (c *Conn) WriteRaw(b []byte) error {
+	if err := c.checkUsable(); err != nil {
+		return err
+	}
+	if c.isTls && !c.allowRawWriteAfterTLS {
+		return ErrRawWriteAfterTLS
+	}
+	n, err := c.conn.Write(b)
+	event := WriteEvent{AfterTLS: c.isTls}
+	recorded, truncated := c.recordBytes(b[0:n])
+	event.Data = []byte(recorded)
+	if truncated {
+		event.Length = n
+	}
+	c.grabData.RawWrites = append(c.grabData.RawWrites, event)
+	return err
+}
+
 func (c *Conn) BasicBanner() (string, error) {
 	b := make([]byte, 1024)
 	n, err := c.getUnderlyingConn().Read(b)
@@ -159,12 +385,112 @@ func (c *Conn) BasicBanner() (string, error) {
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.checkUsable(); err != nil {
+		return 0, err
+	}
 	n, err := c.getUnderlyingConn().Read(b)
-	c.grabData.Read = string(b[0:n])
+	var truncated bool
+	c.grabData.Read, truncated = c.recordBytes(b[0:n])
+	c.grabData.ReadLength = 0
+	if truncated {
+		c.grabData.ReadLength = n
+	}
+	return n, err
+}
+
+// ReadUntilFunc reads into buf until done returns true for everything read
+// so far, for responses whose end cannot be matched with a regular
+// expression. It stops after the number of reads set with SetMaxReadCalls
+// and returns util.ErrBufferFull if buf fills up first. The data is recorded
+// as a single read.
+func (c *Conn) ReadUntilFunc(buf []byte, done func([]byte) bool) (int, error) {
+	if err := c.checkUsable(); err != nil {
+		return 0, err
+	}
+	n, err := util.ReadUntilFuncLimit(c.getUnderlyingConn(), buf, done, c.maxReadCalls)
+	var truncated bool
+	c.grabData.Read, truncated = c.recordBytes(buf[0:n])
+	c.grabData.ReadLength = 0
+	if truncated {
+		c.grabData.ReadLength = n
+	}
 	return n, err
 }
 
+// ReadLines reads from the connection in the background and sends each
+// complete CRLF terminated line, without the CRLF, on the returned channel.
+// It stops after max lines if max is positive, at EOF or on a read error, or
+// when ctx is cancelled, and closes the channel. Everything read is recorded
+// as a single read before the channel is closed. Any bytes read past the
+// last line sent are only in that record; they are not returned by later
+// reads.
+func (c *Conn) ReadLines(ctx context.Context, max int) (<-chan string, error) {
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	conn := c.getUnderlyingConn()
+	lines := make(chan string)
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		// A blocked Read only returns once its deadline has passed
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	go func() {
+		var read []byte
+		defer func() {
+			close(done)
+			// Restore the deadline only once the watcher can no longer
+			// expire it
+			<-watched
+			conn.SetReadDeadline(c.readDeadline)
+			var truncated bool
+			c.grabData.Read, truncated = c.recordBytes(read)
+			c.grabData.ReadLength = 0
+			if truncated {
+				c.grabData.ReadLength = len(read)
+			}
+			close(lines)
+		}()
+		buf := make([]byte, 1024)
+		start, count := 0, 0
+		var err error
+		for {
+			for {
+				i := bytes.Index(read[start:], []byte("\r\n"))
+				if i < 0 {
+					break
+				}
+				select {
+				case lines <- string(read[start : start+i]):
+				case <-ctx.Done():
+					return
+				}
+				start += i + 2
+				if count++; max > 0 && count >= max {
+					return
+				}
+			}
+			if err != nil || ctx.Err() != nil {
+				return
+			}
+			var n int
+			n, err = conn.Read(buf)
+			read = append(read, buf[0:n]...)
+		}
+	}()
+	return lines, nil
+}
+
 func (c *Conn) Close() error {
+	if c.isTls && c.checkCloseNotify && c.grabData.TLSShutdown == nil {
+		c.recordTLSShutdown()
+	}
 	return c.getUnderlyingConn().Close()
 }
 
@@ -238,6 +564,10 @@ func (c *Conn) sendHTTPRequestReadHTTPResponse(req *http.Request, config *HTTPCo
 	encRes.VersionMajor = res.ProtoMajor
 	encRes.VersionMinor = res.ProtoMinor
 	//	encRes.Headers = HeadersFromGolangHeaders(res.Header)
+	if decoded, ok := decodeHTTPBody(body, res.Header.Get("Content-Encoding"), 1024*config.MaxSize); ok {
+		body = decoded
+		encRes.Encoded = true
+	}
 	var bodyOutput []byte
 	if len(body) > 1024*config.MaxSize {
 		bodyOutput = body[0 : 1024*config.MaxSize]
@@ -277,16 +607,15 @@ func (c *Conn) doProxy(config *HTTPConfig) error {
 	return nil
 }
 
-// Extra method - Do a TLS Handshake and record progress
-func (c *Conn) TLSHandshake() error {
-	if c.isTls {
-		return fmt.Errorf(
-			"Attempted repeat handshake with remote host %s",
-			c.RemoteAddr().String())
-	}
+// clientTLSConfig builds the configuration TLSHandshake and the TLS probes
+// use, from the options set on c.
+func (c *Conn) clientTLSConfig() *ztls.Config {
 	tlsConfig := new(ztls.Config)
 	tlsConfig.InsecureSkipVerify = true
 	tlsConfig.MinVersion = ztls.VersionSSL30
+	if c.disableSSLv3 {
+		tlsConfig.MinVersion = ztls.VersionTLS10
+	}
 	tlsConfig.MaxVersion = c.maxTlsVersion
 	tlsConfig.RootCAs = c.caPool
 	tlsConfig.HeartbeatEnabled = true
@@ -302,11 +631,31 @@ func (c *Conn) TLSHandshake() error {
 	if c.gatherSessionTicket {
 		tlsConfig.ForceSessionTicketExt = true
 	}
-	if c.offerExtendedMasterSecret {
-		tlsConfig.ExtendedMasterSecret = true
-	}
+	// Always offered, so ExtendedMasterSecret can tell whether the server
+	// supports it
+	tlsConfig.ExtendedMasterSecret = true
+	tlsConfig.OfferCompression = c.offerCompression
+	tlsConfig.KeyLogWriter = c.keyLogWriter
+	tlsConfig.MaxFragmentLength = c.maxFragmentLength
+	tlsConfig.VerifyPeerCertificate = c.verifyCallback
+	return tlsConfig
+}
 
-	c.tlsConn = ztls.Client(c.conn, tlsConfig)
+// Extra method - Do a TLS Handshake and record progress
+func (c *Conn) TLSHandshake() error {
+	if c.isTls {
+		return fmt.Errorf(
+			"Attempted repeat handshake with remote host %s",
+			c.RemoteAddr().String())
+	}
+	tlsConfig := c.clientTLSConfig()
+	var recorder *recordingConn
+	if c.recordHandshakeBytes {
+		recorder = &recordingConn{Conn: c.conn, recording: true}
+		c.tlsConn = ztls.Client(recorder, tlsConfig)
+	} else {
+		c.tlsConn = ztls.Client(c.conn, tlsConfig)
+	}
 	c.tlsConn.SetReadDeadline(c.readDeadline)
 	c.tlsConn.SetWriteDeadline(c.writeDeadline)
 	c.isTls = true
@@ -315,6 +664,13 @@ func (c *Conn) TLSHandshake() error {
 		err = nil
 	}
 	hl := c.tlsConn.GetHandshakeLog()
+	if recorder != nil {
+		recorder.recording = false
+		raw, _ := c.recordBytes(recorder.written)
+		hl.RawClientBytes = []byte(raw)
+		raw, _ = c.recordBytes(recorder.read)
+		hl.RawServerBytes = []byte(raw)
+	}
 
 	if !c.tlsVerbose {
 		hl.KeyMaterial = nil
@@ -327,7 +683,596 @@ func (c *Conn) TLSHandshake() error {
 	return err
 }
 
+// recordingConn keeps a copy of the bytes written and read while recording
+// is set
+type recordingConn struct {
+	net.Conn
+	recording bool
+	written   []byte
+	read      []byte
+}
+
+func (r *recordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if r.recording {
+		r.read = append(r.read, b[0:n]...)
+	}
+	return n, err
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	if r.recording {
+		r.written = append(r.written, b[0:n]...)
+	}
+	return n, err
+}
+
+// ErrInvalidMaxFragmentLength is returned by SetMaxFragmentLength for codes
+// outside 1 to 4.
+var ErrInvalidMaxFragmentLength = errors.New("max_fragment_length code must be 1 to 4 (2^9 to 2^12 bytes)")
+
+// SetMaxFragmentLength makes TLSHandshake send the max_fragment_length
+// extension, asking for records of at most 2^(8+code) bytes. Whether the
+// server agreed is recorded in the ServerHello of the handshake log.
+func (c *Conn) SetMaxFragmentLength(code uint8) error {
+	if code < 1 || code > 4 {
+		return ErrInvalidMaxFragmentLength
+	}
+	c.maxFragmentLength = code
+	return nil
+}
+
+// MaxFragmentLengthHonored returns true if the server echoed the
+// max_fragment_length extension set with SetMaxFragmentLength.
+func (c *Conn) MaxFragmentLengthHonored() bool {
+	hl := c.grabData.TLSHandshake
+	return c.maxFragmentLength != 0 && hl != nil && hl.ServerHello != nil &&
+		hl.ServerHello.MaxFragmentLength == c.maxFragmentLength
+}
+
+// SetRecordHandshakeBytes makes TLSHandshake record every byte it writes and
+// reads in the handshake log, subject to SetMaxRecordedBytes.
+func (c *Conn) SetRecordHandshakeBytes() {
+	c.recordHandshakeBytes = true
+}
+
+// KeyLogWriter makes TLSHandshake write the master secret of the session to
+// w in NSS key log format, so that captures of the scan can be decrypted.
+// This is for debugging only and is never enabled by default.
+func (c *Conn) KeyLogWriter(w io.Writer) {
+	c.keyLogWriter = w
+}
+
+// SetVerifyCallback has TLS handshakes call f with the server's raw
+// certificates and any chains that verified, for checks such as pinning.
+// It runs even though zgrab does not otherwise enforce verification, and
+// an error from f fails the handshake. What f returned is recorded in the
+// handshake log.
+func (c *Conn) SetVerifyCallback(f func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) {
+	c.verifyCallback = f
+}
+
+// TLSCompressionEnabled returns true if the server selected a compression
+// method other than null in the last handshake, which exposes it to CRIME.
+// The server can only do so if compression was offered.
+func (c *Conn) TLSCompressionEnabled() bool {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerHello == nil {
+		return false
+	}
+	return hl.ServerHello.CompressionMethod != 0
+}
+
+// ExtendedMasterSecret returns true if the server agreed to the RFC 7627
+// extended master secret in the last handshake. Servers that do not are
+// exposed to the triple handshake attack.
+func (c *Conn) ExtendedMasterSecret() bool {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerHello == nil {
+		return false
+	}
+	return hl.ServerHello.ExtendedMasterSecret
+}
+
+// Servers that support a higher version than they negotiate end their
+// ServerHello random with one of these (RFC 8446, section 4.1.3)
+var (
+	downgradeSentinelTLS12 = []byte("DOWNGRD\x01")
+	downgradeSentinelTLS11 = []byte("DOWNGRD\x00")
+)
+
+// A DowngradeEvent records a downgrade sentinel found in the ServerHello
+// random, and what it says about the negotiated version
+type DowngradeEvent struct {
+	Version    ztls.TLSVersion `json:"version"`
+	Sentinel   string          `json:"sentinel"`
+	Indicators []string        `json:"indicators,omitempty"`
+}
+
+// DowngradeIndicators checks the last eight bytes of the server random from
+// the last handshake for the RFC 8446 downgrade sentinels. A server sets
+// them when it supports a higher version than the one it negotiated: TLS
+// 1.3 for the first, TLS 1.2 for the second. Since ztls offers at most TLS
+// 1.2, every server that supports 1.3 sends the first, so a sentinel for a
+// version above the one offered is only recorded in the event. Indicators
+// are returned for a sentinel for a version that was offered, meaning the
+// server or something in the path lowered the version, or a sentinel on a
+// ServerHello that cannot carry it. It returns nil, and records nothing, if
+// there is no sentinel.
+func (c *Conn) DowngradeIndicators() []string {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerHello == nil || len(hl.ServerHello.Random) != 32 {
+		return nil
+	}
+	event := &DowngradeEvent{Version: hl.ServerHello.Version}
+	var supported string
+	switch tail := hl.ServerHello.Random[24:]; {
+	case bytes.Equal(tail, downgradeSentinelTLS12):
+		event.Sentinel, supported = "tls13", "TLSv1.3"
+	case bytes.Equal(tail, downgradeSentinelTLS11):
+		event.Sentinel, supported = "tls12", "TLSv1.2"
+	default:
+		return nil
+	}
+	offered := event.Version
+	for _, v := range hl.OfferedVersions {
+		if v > offered {
+			offered = v
+		}
+	}
+
+	v := event.Version
+	switch {
+	case event.Sentinel == "tls13" && v != ztls.VersionTLS12,
+		event.Sentinel == "tls12" && v >= ztls.VersionTLS12:
+		event.Indicators = append(event.Indicators, supported+" sentinel in a ServerHello for "+v.String())
+	case event.Sentinel == "tls12" && offered >= ztls.VersionTLS12:
+		event.Indicators = append(event.Indicators, "downgraded to "+v.String()+" although TLSv1.2 was offered and is supported")
+	}
+	c.grabData.Downgrade = event
+	return event.Indicators
+}
+
+// leafCertificate returns the parsed end-entity certificate presented by the
+// server in the last handshake, or nil if there was none or it cannot be
+// parsed.
+func (c *Conn) leafCertificate() *x509.Certificate {
+	return handshakeLeaf(c.grabData.TLSHandshake)
+}
+
+// handshakeLeaf returns the parsed end-entity certificate from a handshake
+// log, or nil if there is none or it cannot be parsed.
+func handshakeLeaf(hl *ztls.ServerHandshake) *x509.Certificate {
+	if hl == nil || hl.ServerCertificates == nil {
+		return nil
+	}
+	leaf := hl.ServerCertificates.Certificate.Parsed
+	if leaf == nil && hl.ServerCertificates.Certificate.Raw != nil {
+		leaf, _ = x509.ParseCertificate(hl.ServerCertificates.Certificate.Raw)
+	}
+	return leaf
+}
+
+// HostnameMatches returns true if the server's leaf certificate is valid for
+// name. Only the names in the certificate are checked, not the chain, so this
+// is meaningful even when the handshake skipped verification.
+func (c *Conn) HostnameMatches(name string) bool {
+	leaf := c.leafCertificate()
+	if leaf == nil {
+		return false
+	}
+	return leaf.VerifyHostname(name) == nil
+}
+
+// AllPresentedCertificates returns every certificate the server sent in its
+// Certificate message, in the order they were sent and including any
+// duplicates or certificates not used in the verified chain. Certificates
+// that fail to parse are left out.
+func (c *Conn) AllPresentedCertificates() []*x509.Certificate {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerCertificates == nil {
+		return nil
+	}
+	presented := make([]ztls.SimpleCertificate, 0, 1+len(hl.ServerCertificates.Chain))
+	if hl.ServerCertificates.Certificate.Raw != nil {
+		presented = append(presented, hl.ServerCertificates.Certificate)
+	}
+	presented = append(presented, hl.ServerCertificates.Chain...)
+
+	certs := make([]*x509.Certificate, 0, len(presented))
+	for _, sc := range presented {
+		cert := sc.Parsed
+		if cert == nil {
+			var err error
+			if cert, err = x509.ParseCertificate(sc.Raw); err != nil {
+				continue
+			}
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                        "any",
+	x509.ExtKeyUsageServerAuth:                 "server_auth",
+	x509.ExtKeyUsageClientAuth:                 "client_auth",
+	x509.ExtKeyUsageCodeSigning:                "code_signing",
+	x509.ExtKeyUsageEmailProtection:            "email_protection",
+	x509.ExtKeyUsageIPSECEndSystem:             "ipsec_end_system",
+	x509.ExtKeyUsageIPSECTunnel:                "ipsec_tunnel",
+	x509.ExtKeyUsageIPSECUser:                  "ipsec_user",
+	x509.ExtKeyUsageTimeStamping:               "time_stamping",
+	x509.ExtKeyUsageOCSPSigning:                "ocsp_signing",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto: "microsoft_server_gated_crypto",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:  "netscape_server_gated_crypto",
+}
+
+// A CertificateUsage holds the basic constraints and key usages of one
+// presented certificate. MaxPathLen is only set when the certificate limits
+// its path length. ServerAuth is true if the extended key usages allow TLS
+// server authentication, which they do when the extension is absent.
+type CertificateUsage struct {
+	Subject          string        `json:"subject"`
+	BasicConstraints bool          `json:"basic_constraints"`
+	IsCA             bool          `json:"is_ca"`
+	MaxPathLen       *int          `json:"max_path_len,omitempty"`
+	KeyUsage         x509.KeyUsage `json:"key_usage"`
+	ExtKeyUsage      []string      `json:"ext_key_usage,omitempty"`
+	ServerAuth       bool          `json:"server_auth"`
+}
+
+func certificateUsage(cert *x509.Certificate) CertificateUsage {
+	u := CertificateUsage{
+		Subject:          certName(cert),
+		BasicConstraints: cert.BasicConstraintsValid,
+		IsCA:             cert.BasicConstraintsValid && cert.IsCA,
+		KeyUsage:         cert.KeyUsage,
+		ServerAuth:       len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0,
+	}
+	if cert.BasicConstraintsValid && (cert.MaxPathLen > 0 || cert.MaxPathLenZero) {
+		pathLen := cert.MaxPathLen
+		u.MaxPathLen = &pathLen
+	}
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageServerAuth || eku == x509.ExtKeyUsageAny {
+			u.ServerAuth = true
+		}
+		if name, ok := extKeyUsageNames[eku]; ok {
+			u.ExtKeyUsage = append(u.ExtKeyUsage, name)
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		u.ExtKeyUsage = append(u.ExtKeyUsage, oid.String())
+	}
+	return u
+}
+
+// CertificateUsages returns the basic constraints and key usages of the
+// leaf and each other certificate the server presented, in the order they
+// were sent. A leaf with IsCA set, or without ServerAuth, is misissued.
+func (c *Conn) CertificateUsages() []CertificateUsage {
+	certs := c.AllPresentedCertificates()
+	if len(certs) == 0 {
+		return nil
+	}
+	usages := make([]CertificateUsage, 0, len(certs))
+	for _, cert := range certs {
+		usages = append(usages, certificateUsage(cert))
+	}
+	return usages
+}
+
+// certName names a certificate in ChainIssues findings
+func certName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return "serial " + cert.SerialNumber.String()
+}
+
+// issuedBy returns true if parent's subject and key match child's issuer
+func issuedBy(child, parent *x509.Certificate) bool {
+	return bytes.Equal(child.RawIssuer, parent.RawSubject) && child.CheckSignatureFrom(parent) == nil
+}
+
+// ChainIssues checks the certificates from AllPresentedCertificates for
+// common misconfigurations: certificates not in issuing order, certificates
+// that are not part of the chain from the leaf, expired or not yet valid
+// intermediates, and a chain that does not reach a root in the CA pool set
+// with SetCAPool, or the system roots. It returns a description of each
+// problem, or nil if there are none or no certificates were presented.
+func (c *Conn) ChainIssues() []string {
+	certs := c.AllPresentedCertificates()
+	if len(certs) == 0 {
+		return nil
+	}
+	var issues []string
+
+	// Follow issuers from the leaf through the presented certificates
+	path := []int{0}
+	used := make([]bool, len(certs))
+	used[0] = true
+	for {
+		cur := certs[path[len(path)-1]]
+		if issuedBy(cur, cur) {
+			break
+		}
+		next := -1
+		for j, cert := range certs {
+			if !used[j] && issuedBy(cur, cert) {
+				next = j
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		used[next] = true
+		path = append(path, next)
+	}
+	for i, j := range path {
+		if i != j {
+			issues = append(issues, "certificates are out of order")
+			break
+		}
+	}
+	for j, cert := range certs {
+		if used[j] {
+			continue
+		}
+		duplicate := false
+		for _, i := range path {
+			if bytes.Equal(certs[i].Raw, cert.Raw) {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			issues = append(issues, "duplicate certificate: "+certName(cert))
+		} else {
+			issues = append(issues, "unrelated certificate: "+certName(cert))
+		}
+	}
+
+	now := time.Now()
+	for _, i := range path[1:] {
+		if now.After(certs[i].NotAfter) {
+			issues = append(issues, "expired intermediate: "+certName(certs[i]))
+		} else if now.Before(certs[i].NotBefore) {
+			issues = append(issues, "intermediate not yet valid: "+certName(certs[i]))
+		}
+	}
+
+	// Check the top of the chain against the roots while it was valid, so
+	// that expiry is not reported twice
+	top := certs[path[len(path)-1]]
+	_, err := top.Verify(x509.VerifyOptions{
+		Roots:       c.caPool,
+		CurrentTime: top.NotBefore.Add(time.Second),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if _, ok := err.(x509.UnknownAuthorityError); ok {
+		if issuedBy(top, top) {
+			issues = append(issues, "untrusted root: "+certName(top))
+		} else {
+			issues = append(issues, "missing intermediate: no trusted issuer for "+certName(top))
+		}
+	}
+	return issues
+}
+
+// HandshakeDuration returns how long the last TLS handshake took, from the
+// ClientHello until it finished or failed, excluding the TCP connect.
+func (c *Conn) HandshakeDuration() time.Duration {
+	if c.grabData.TLSHandshake == nil {
+		return 0
+	}
+	return c.grabData.TLSHandshake.Duration
+}
+
+// NegotiatedGroup returns the named curve used for the ECDHE key exchange in
+// the last TLS handshake, or zero if the key exchange was not ECDHE. ztls
+// does not negotiate TLS 1.3, so there is no key share group to report.
+func (c *Conn) NegotiatedGroup() ztls.CurveID {
+	if c.grabData.TLSHandshake == nil {
+		return 0
+	}
+	return c.grabData.TLSHandshake.NegotiatedGroup
+}
+
+// SessionTicketLifetime returns the lifetime hint in seconds of the session
+// ticket the server issued in the last TLS handshake, or zero if it issued
+// none. SetGatherSessionTicket must be used for a ticket to be requested.
+// ztls does not negotiate TLS 1.3, so there is at most one ticket.
+func (c *Conn) SessionTicketLifetime() uint32 {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.SessionTicket == nil {
+		return 0
+	}
+	return hl.SessionTicket.LifetimeHint
+}
+
+// ServerTLSFingerprint returns the JA3S fingerprint of the ServerHello from
+// the last TLS handshake: the MD5 of its version, cipher suite and extension
+// IDs in order, written in decimal. It is also recorded in the handshake log.
+// It returns an empty string if no ServerHello was received.
+func (c *Conn) ServerTLSFingerprint() string {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerHello == nil {
+		return ""
+	}
+	sh := hl.ServerHello
+	extensions := make([]string, len(sh.ExtensionIDs))
+	for i, id := range sh.ExtensionIDs {
+		extensions[i] = strconv.Itoa(int(id))
+	}
+	ja3s := strconv.Itoa(int(sh.Version)) + "," + strconv.Itoa(int(sh.CipherSuite)) + "," + strings.Join(extensions, "-")
+	sum := md5.Sum([]byte(ja3s))
+	hl.JA3S = hex.EncodeToString(sum[:])
+	return hl.JA3S
+}
+
+// A ClientCertRequestEvent lists the certificate authorities a server named
+// when it asked for a client certificate
+type ClientCertRequestEvent struct {
+	CertificateAuthorities []string `json:"certificate_authorities"`
+}
+
+// RequestedClientCAs returns the distinguished names of the certificate
+// authorities the server listed in a CertificateRequest during the last TLS
+// handshake, and records them. It returns nil if the server did not ask for a
+// client certificate, and an empty list if it accepts any issuer. Names that
+// cannot be parsed are left out.
+func (c *Conn) RequestedClientCAs() []string {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.CertificateRequest == nil {
+		return nil
+	}
+	event := &ClientCertRequestEvent{CertificateAuthorities: []string{}}
+	for _, der := range hl.CertificateRequest.CertificateAuthorities {
+		var rdns pkix.RDNSequence
+		if rest, err := asn1.Unmarshal(der, &rdns); err != nil || len(rest) > 0 {
+			continue
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&rdns)
+		event.CertificateAuthorities = append(event.CertificateAuthorities, name.String())
+	}
+	c.grabData.ClientCertRequest = event
+	return event.CertificateAuthorities
+}
+
+// HandshakeMessageSizes returns the size in bytes of each handshake message
+// exchanged in the last TLS handshake, keyed by sender and message type.
+func (c *Conn) HandshakeMessageSizes() map[string]int {
+	if c.grabData.TLSHandshake == nil {
+		return nil
+	}
+	return c.grabData.TLSHandshake.MessageSizes
+}
+
+// EmbeddedSCTs returns the signed certificate timestamps embedded in the leaf
+// certificate the server presented. It returns nil if there was no leaf
+// certificate or it did not carry the SCT list extension.
+func (c *Conn) EmbeddedSCTs() []*ct.SignedCertificateTimestamp {
+	leaf := c.leafCertificate()
+	if leaf == nil {
+		return nil
+	}
+	return leaf.SignedCertificateTimestampList
+}
+
+// RevocationURLs summarizes where revocation status for the leaf certificate
+// can be checked.
+type RevocationURLs struct {
+	CRLDistributionPoints []string `json:"crl_distribution_points,omitempty"`
+	OCSPServers           []string `json:"ocsp_servers,omitempty"`
+}
+
+// LeafRevocationURLs returns the CRL distribution points and OCSP responders
+// listed in the leaf certificate the server presented, or nil if there was no
+// leaf certificate.
+func (c *Conn) LeafRevocationURLs() *RevocationURLs {
+	leaf := c.leafCertificate()
+	if leaf == nil {
+		return nil
+	}
+	return &RevocationURLs{
+		CRLDistributionPoints: leaf.CRLDistributionPoints,
+		OCSPServers:           leaf.OCSPServer,
+	}
+}
+
+// ErrNoLeafCertificate is returned by ServerPublicKey when no TLS handshake
+// has presented a parseable leaf certificate.
+var ErrNoLeafCertificate = errors.New("no leaf certificate was presented")
+
+// ServerPublicKey returns the public key of the leaf certificate the server
+// presented, wrapped in the keys package type that marshals it to JSON: a
+// *keys.RSAPublicKey or *keys.ECDSAPublicKey.
+func (c *Conn) ServerPublicKey() (interface{}, error) {
+	leaf := c.leafCertificate()
+	if leaf == nil {
+		return nil, ErrNoLeafCertificate
+	}
+	switch pub := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return &keys.RSAPublicKey{PublicKey: pub}, nil
+	case *ecdsa.PublicKey:
+		return &keys.ECDSAPublicKey{PublicKey: pub}, nil
+	case *x509.AugmentedECDSA:
+		return &keys.ECDSAPublicKey{PublicKey: pub.Pub}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// CertificateKeyStrength returns the size in bits and the algorithm, "rsa"
+// or "ecdsa", of the leaf certificate's public key, and whether it is weak:
+// an RSA modulus under 2048 bits or a curve under 256 bits. Other
+// algorithms are reported as "unknown" and not weak. bits is zero if no
+// leaf certificate was presented.
+func (c *Conn) CertificateKeyStrength() (bits int, algo string, weak bool) {
+	key, err := c.ServerPublicKey()
+	if err == ErrNoLeafCertificate {
+		return 0, "", false
+	}
+	switch key := key.(type) {
+	case *keys.RSAPublicKey:
+		bits = key.N.BitLen()
+		return bits, "rsa", bits < 2048
+	case *keys.ECDSAPublicKey:
+		bits = key.Params().BitSize
+		return bits, "ecdsa", bits < 256
+	default:
+		return 0, "unknown", false
+	}
+}
+
+// starttlsHandshake performs the TLS handshake after the server accepted
+// STARTTLS. If it fails, the server may be in any state, so the connection is
+// marked unusable and a *STARTTLSError wrapping the handshake error is
+// returned, matching ErrServerClosedAfterSTARTTLS if the server hung up
+// before answering the ClientHello and ErrPostSTARTTLSFailure otherwise. The
+// partial handshake is still recorded.
+func (c *Conn) starttlsHandshake() error {
+	if err := c.TLSHandshake(); err != nil {
+		c.starttlsFailed = true
+		if c.closedAfterSTARTTLS(err) {
+			return &STARTTLSError{Reason: ErrServerClosedAfterSTARTTLS, Err: err}
+		}
+		return &STARTTLSError{Reason: ErrPostSTARTTLSFailure, Err: err}
+	}
+	return nil
+}
+
+// closedAfterSTARTTLS reports whether a handshake error means the server
+// closed the connection without sending a single TLS record, and records it.
+func (c *Conn) closedAfterSTARTTLS(err error) bool {
+	if hl := c.grabData.TLSHandshake; hl != nil && hl.ServerHello != nil {
+		return false
+	}
+	if err != io.EOF && !errors.Is(err, syscall.ECONNRESET) {
+		return false
+	}
+	c.grabData.StartTLSServerClosed = true
+	return true
+}
+
+// checkUsable returns ErrPostSTARTTLSFailure if a failed STARTTLS handshake
+// left the connection in an unknown state
+func (c *Conn) checkUsable() error {
+	if c.starttlsFailed {
+		return ErrPostSTARTTLSFailure
+	}
+	return nil
+}
+
 func (c *Conn) sendStartTLSCommand(command string) error {
+	if err := c.checkUsable(); err != nil {
+		return err
+	}
 	// Don't doublehandshake
 	if c.isTls {
 		return fmt.Errorf(
@@ -344,7 +1289,7 @@ func (c *Conn) sendStartTLSCommand(command string) error {
 func (c *Conn) SMTPStartTLSHandshake() error {
 
 	// Send the command
-	if err := c.sendStartTLSCommand(SMTP_COMMAND); err != nil {
+	if err := c.sendStartTLSCommand("STARTTLS" + c.newline()); err != nil {
 		return err
 	}
 	// Read the response on a successful send
@@ -370,11 +1315,11 @@ func (c *Conn) SMTPStartTLSHandshake() error {
 	}
 
 	// Successful so far, attempt to do the actual handshake
-	return c.TLSHandshake()
+	return c.starttlsHandshake()
 }
 
 func (c *Conn) POP3StartTLSHandshake() error {
-	if err := c.sendStartTLSCommand(POP3_COMMAND); err != nil {
+	if err := c.sendStartTLSCommand("STLS" + c.newline()); err != nil {
 		return err
 	}
 
@@ -390,53 +1335,626 @@ func (c *Conn) POP3StartTLSHandshake() error {
 	if err != nil {
 		return err
 	}
-	return c.TLSHandshake()
+	return c.starttlsHandshake()
 }
 
-func (c *Conn) IMAPStartTLSHandshake() error {
-	if err := c.sendStartTLSCommand(IMAP_COMMAND); err != nil {
+// POP3Grab reads the banner, sends CAPA, and if the server advertises STLS
+// performs the STARTTLS handshake and sends CAPA again over TLS. It stops at
+// the first error. A server that does not support CAPA is not an error.
+func (c *Conn) POP3Grab() error {
+	if _, err := c.POP3Banner(make([]byte, 1024)); err != nil {
+		return err
+	}
+	capabilities, err := c.pop3Capabilities()
+	c.grabData.POP3Capabilities = capabilities
+	if err != nil || !containsFold(capabilities, "STLS") {
+		return err
+	}
+	if err := c.POP3StartTLSHandshake(); err != nil {
+		return err
+	}
+	c.grabData.POP3TLSCapabilities, err = c.pop3Capabilities()
+	return err
+}
+
+// nextIMAPTag returns a new tag for an IMAP command, so that responses to
+// different commands on the connection cannot be confused.
+func (c *Conn) nextIMAPTag() string {
+	c.imapTagCount++
+	return fmt.Sprintf("a%03d", c.imapTagCount)
+}
+
+// readImapTaggedResponse reads untagged responses until the line completing
+// the command tagged tag.
+func (c *Conn) readImapTaggedResponse(tag string, res []byte) (int, error) {
+	expr := regexp.MustCompile(`(?:^|\n)` + regexp.QuoteMeta(tag) + ` [^\r\n]*\r?\n$`)
+	return c.readIMAPResponse(res, expr)
+}
+
+// readIMAPResponse is readMailResponse for IMAP. A line ending in a {N}
+// literal marker is followed by N bytes of data that may contain CRLFs, so
+// those bytes are skipped and expr is only matched against the lines
+// around them, one line at a time.
+func (c *Conn) readIMAPResponse(res []byte, expr *regexp.Regexp) (int, error) {
+	conn := c.getUnderlyingConn()
+	length, scan := 0, 0
+	complete := false
+	for reads := 0; ; reads++ {
+		if c.maxReadCalls > 0 && reads >= c.maxReadCalls {
+			return length, util.ErrTooManyReads
+		}
+		n, err := conn.Read(res[length:])
+		length += n
+		if err != nil {
+			return length, err
+		}
+		for scan < length {
+			end := bytes.IndexByte(res[scan:length], '\n')
+			if end < 0 {
+				break
+			}
+			line := res[scan : scan+end+1]
+			scan += end + 1
+			if size, ok := imapLiteralSize(strings.TrimSuffix(string(line[0:end]), "\r")); ok {
+				scan += size
+				complete = false
+			} else {
+				complete = expr.Match(line)
+			}
+		}
+		if complete && scan == length {
+			return length, nil
+		}
+		if length == len(res) {
+			return length, c.mailOverflow(res, length, "imap")
+		}
+	}
+}
+
+func (c *Conn) IMAPStartTLSHandshake() error {
+	tag := c.nextIMAPTag()
+	if err := c.sendStartTLSCommand(tag + " STARTTLS" + c.newline()); err != nil {
 		return err
 	}
 
 	buf := make([]byte, 512)
-	n, err := c.readImapStatusResponse(buf)
+	n, err := c.readImapTaggedResponse(tag, buf)
 	c.grabData.StartTLS = string(buf[0:n])
 	if err == nil {
-		if !strings.HasPrefix(c.grabData.StartTLS, "a001 OK") {
+		status, text, ok := parseIMAPTaggedResponse(tag, c.grabData.StartTLS)
+		if !ok {
 			err = errors.New("Server did not indicate support for STARTTLS")
+		} else if status != "OK" {
+			err = &IMAPStatusError{Tag: tag, Status: status, Text: text}
 		}
 	}
 
 	if err != nil {
 		return err
 	}
-	return c.TLSHandshake()
+	return c.starttlsHandshake()
+}
+
+// smtpReset sends RSET to abandon the open mail transaction and returns the
+// server's reply.
+func (c *Conn) smtpReset() (string, error) {
+	c.smtpMailSent = false
+	if _, err := c.getUnderlyingConn().Write([]byte("RSET" + c.newline())); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 512)
+	n, err := c.readSmtpResponse(buf)
+	return string(buf[0:n]), err
+}
+
+// smtpAbortOnError is deferred by helpers that send MAIL FROM. If the helper
+// fails with *err set after MAIL FROM was sent, it sends RSET, so that an
+// early return never leaves a mail transaction open.
+func (c *Conn) smtpAbortOnError(err *error) {
+	if *err != nil && c.smtpMailSent {
+		c.smtpReset()
+	}
+}
+
+// SMTPRequiresAuth sends MAIL FROM with a null sender without
+// authenticating, and returns true if the server answers 530, as submission
+// servers do. RSET is always sent afterwards to end the transaction. EHLO
+// must have been sent first.
+func (c *Conn) SMTPRequiresAuth() (required bool, err error) {
+	if err = c.checkUsable(); err != nil {
+		return false, err
+	}
+	if c.grabData.EHLO == "" {
+		return false, ErrNoEHLO
+	}
+	event := new(SMTPAuthRequiredEvent)
+	c.grabData.SMTPAuthRequired = event
+	if _, err = c.getUnderlyingConn().Write([]byte("MAIL FROM:<>" + c.newline())); err != nil {
+		return false, err
+	}
+	c.smtpMailSent = true
+	defer c.smtpAbortOnError(&err)
+	buf := make([]byte, 512)
+	n, err := c.readSmtpResponse(buf)
+	event.MailResponse = string(buf[0:n])
+	if err != nil {
+		return false, err
+	}
+	if n >= 3 {
+		event.Code, _ = strconv.Atoi(event.MailResponse[0:3])
+	}
+	event.RequiresAuth = event.Code == 530
+
+	event.ResetResponse, err = c.smtpReset()
+	return event.RequiresAuth, err
+}
+
+// ErrUnknownMailProtocol is returned by STARTTLSFunctional for a protocol
+// other than smtp, pop3 or imap.
+var ErrUnknownMailProtocol = errors.New("protocol must be smtp, pop3 or imap")
+
+// pop3Capabilities sends CAPA and returns the capabilities the server lists,
+// or nil if it does not support CAPA. The parsed response is recorded as
+// POP3Capa, or POP3TLSCapa once TLS is up.
+func (c *Conn) pop3Capabilities() ([]string, error) {
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	if _, err := c.getUnderlyingConn().Write([]byte("CAPA" + c.newline())); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2048)
+	n, err := c.readMailResponse(buf, pop3MultiLineEndRegex, "pop3")
+	if err != nil {
+		return nil, err
+	}
+	lines := mailLines(string(buf[0:n]))
+	if !strings.HasPrefix(lines[0], "+OK") {
+		return nil, nil
+	}
+	lines = lines[1:]
+	for i, line := range lines {
+		if line == "." {
+			lines = lines[0:i]
+			break
+		}
+	}
+	event := new(POP3CapabilitiesEvent)
+	if c.isTls {
+		c.grabData.POP3TLSCapa = event
+	} else {
+		c.grabData.POP3Capa = event
+	}
+	return event.parse(lines), nil
+}
+
+// imapCapabilities sends CAPABILITY and records the capabilities the server
+// lists.
+func (c *Conn) imapCapabilities() ([]string, error) {
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	response, err := c.imapCommand("CAPABILITY", 2048)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range mailLines(response) {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "*" && strings.EqualFold(fields[1], "CAPABILITY") {
+			c.grabData.IMAPCapabilities = fields[2:]
+		}
+	}
+	return c.grabData.IMAPCapabilities, nil
+}
+
+// IMAPAuthMechanisms returns the SASL mechanisms listed as AUTH= tokens in
+// the capabilities from the greeting or CAPABILITY, without authenticating.
+// It returns nil if no capabilities have been read, and an empty list if
+// none are AUTH= tokens, as when LOGINDISABLED servers await STARTTLS.
+func (c *Conn) IMAPAuthMechanisms() []string {
+	if c.grabData.IMAPCapabilities == nil {
+		return nil
+	}
+	mechanisms := []string{}
+	for _, capability := range c.grabData.IMAPCapabilities {
+		if len(capability) > 5 && strings.EqualFold(capability[0:5], "AUTH=") {
+			mechanisms = append(mechanisms, capability[5:])
+		}
+	}
+	return mechanisms
+}
+
+// imapCommand sends command with a new tag and returns the full response,
+// reading at most size bytes. A tagged status other than OK is returned as
+// an IMAPStatusError along with the response.
+func (c *Conn) imapCommand(command string, size int) (string, error) {
+	tag := c.nextIMAPTag()
+	if _, err := c.getUnderlyingConn().Write([]byte(tag + " " + command + c.newline())); err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	n, err := c.readImapTaggedResponse(tag, buf)
+	response := string(buf[0:n])
+	if err != nil {
+		return response, err
+	}
+	if status, text, _ := parseIMAPTaggedResponse(tag, response); status != "OK" {
+		return response, &IMAPStatusError{Tag: tag, Status: status, Text: text}
+	}
+	return response, nil
+}
+
+// IMAPNamespace sends NAMESPACE and records the personal, other users' and
+// shared namespaces the server lists. Servers usually only answer once the
+// client has logged in.
+func (c *Conn) IMAPNamespace() (*IMAPNamespaceEvent, error) {
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	event := new(IMAPNamespaceEvent)
+	c.grabData.IMAPNamespace = event
+	response, err := c.imapCommand("NAMESPACE", 2048)
+	event.Response = response
+	if err != nil {
+		return event, err
+	}
+	return event, event.parse(response)
+}
+
+// IMAPListRoot sends LIST "" "%" and records the top level mailboxes, their
+// attributes and the hierarchy delimiter. Servers usually only answer once
+// the client has logged in.
+func (c *Conn) IMAPListRoot() (*IMAPListEvent, error) {
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	event := &IMAPListEvent{Reference: "", Pattern: "%"}
+	c.grabData.IMAPList = event
+	response, err := c.imapCommand(`LIST "" "%"`, 8192)
+	event.Response = response
+	if err != nil {
+		return event, err
+	}
+	return event, event.parse(response)
+}
+
+// imapIdleWait bounds how long IMAPCheckIdle waits for the continuation
+const imapIdleWait = 3 * time.Second
+
+// IMAPCheckIdle sends IDLE and, once the server answers with a continuation,
+// ends it with DONE, to see whether IDLE works rather than just whether it is
+// advertised. Servers only accept IDLE after login and SELECT. If no
+// continuation arrives within a few seconds it returns false and records the
+// timeout; a tagged reply may still arrive later, so the connection should
+// not be used for further commands.
+func (c *Conn) IMAPCheckIdle() (bool, error) {
+	if err := c.checkUsable(); err != nil {
+		return false, err
+	}
+	event := new(IMAPIdleEvent)
+	c.grabData.IMAPIdle = event
+	tag := c.nextIMAPTag()
+	conn := c.getUnderlyingConn()
+	if _, err := conn.Write([]byte(tag + " IDLE" + c.newline())); err != nil {
+		return false, err
+	}
+
+	deadline := time.Now().Add(imapIdleWait)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	expr := regexp.MustCompile(`(?:^|\n)(?:\+|` + regexp.QuoteMeta(tag) + ` )[^\r\n]*\r?\n$`)
+	buf := make([]byte, 512)
+	n, err := c.readIMAPResponse(buf, expr)
+	conn.SetReadDeadline(c.readDeadline)
+	event.Continuation = string(buf[0:n])
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			event.TimedOut = true
+			return false, nil
+		}
+		return false, err
+	}
+	if status, text, ok := parseIMAPTaggedResponse(tag, event.Continuation); ok {
+		return false, &IMAPStatusError{Tag: tag, Status: status, Text: text}
+	}
+
+	if _, err := conn.Write([]byte("DONE" + c.newline())); err != nil {
+		return false, err
+	}
+	n, err = c.readImapTaggedResponse(tag, buf)
+	event.Response = string(buf[0:n])
+	if err != nil {
+		return false, err
+	}
+	if status, text, _ := parseIMAPTaggedResponse(tag, event.Response); status != "OK" {
+		return false, &IMAPStatusError{Tag: tag, Status: status, Text: text}
+	}
+	event.Supported = true
+	return true, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// STARTTLSFunctional checks whether the server advertises STARTTLS for proto,
+// which is smtp, pop3 or imap, and if so performs the upgrade and reports
+// whether the TLS handshake succeeded. The advertisement is taken from the
+// EHLO response or IMAP greeting when there is one, and otherwise from EHLO,
+// CAPA or CAPABILITY sent here. err is only set if the capabilities could
+// not be read; a failed upgrade is reported as not functional.
+func (c *Conn) STARTTLSFunctional(proto string) (advertised bool, functional bool, err error) {
+	var upgrade func() error
+	switch strings.ToLower(proto) {
+	case "smtp":
+		if c.grabData.EHLO == "" {
+			if err = c.EHLODefault(); err != nil {
+				return false, false, err
+			}
+		}
+		advertised = ehloHasKeyword(c.grabData.EHLO, "STARTTLS")
+		upgrade = c.SMTPStartTLSHandshake
+	case "pop3":
+		var capabilities []string
+		if capabilities, err = c.pop3Capabilities(); err != nil {
+			return false, false, err
+		}
+		advertised = containsFold(capabilities, "STLS")
+		upgrade = c.POP3StartTLSHandshake
+	case "imap":
+		capabilities := c.grabData.IMAPCapabilities
+		if capabilities == nil {
+			if capabilities, err = c.imapCapabilities(); err != nil {
+				return false, false, err
+			}
+		}
+		advertised = containsFold(capabilities, "STARTTLS")
+		upgrade = c.IMAPStartTLSHandshake
+	default:
+		return false, false, ErrUnknownMailProtocol
+	}
+	if !advertised {
+		return false, false, nil
+	}
+	return true, upgrade() == nil, nil
+}
+
+// SMTPTLSReport summarizes the EHLO, STARTTLS and handshake results already
+// collected on the connection; nothing is sent. The certificate is checked
+// against the domain the connection was made for. Trusted is only
+// meaningful if Validated is set, which needs the handshake to have
+// verified the chain.
+func (c *Conn) SMTPTLSReport() SMTPTLSReport {
+	report := SMTPTLSReport{
+		STARTTLSOffered:  ehloHasKeyword(c.grabData.EHLO, "STARTTLS"),
+		STARTTLSAccepted: strings.HasPrefix(c.grabData.StartTLS, "2"),
+		Hostname:         c.domain,
+	}
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerHello == nil {
+		return report
+	}
+	report.HandshakeSucceeded = hl.ServerFinished != nil && !c.starttlsFailed
+	report.Version = hl.ServerHello.Version
+	report.CipherSuite = hl.ServerHello.CipherSuite
+	if c.domain != "" {
+		report.HostnameMatches = c.HostnameMatches(c.domain)
+	}
+	if certs := hl.ServerCertificates; certs != nil && certs.Validation != nil {
+		report.Validated = true
+		report.Trusted = certs.Validation.BrowserTrusted
+	}
+	return report
+}
+
+// readMailResponse reads a response matching expr into res. If the response
+// is longer than res, the partial data is recorded in an SMTPOverflowEvent
+// and ErrMailResponseOverflow is returned. If it is not complete after the
+// number of reads set with SetMaxReadCalls, util.ErrTooManyReads is returned.
+func (c *Conn) readMailResponse(res []byte, expr *regexp.Regexp, protocol string) (int, error) {
+	n, err := util.ReadUntilRegexLimit(c.getUnderlyingConn(), res, expr, c.maxReadCalls)
+	if err == util.ErrBufferFull {
+		err = c.mailOverflow(res, n, protocol)
+	}
+	return n, err
+}
+
+// mailOverflow records the partial response that filled res
+func (c *Conn) mailOverflow(res []byte, n int, protocol string) error {
+	c.grabData.MailOverflow = &SMTPOverflowEvent{
+		Protocol:  protocol,
+		Limit:     len(res),
+		Partial:   string(res[0:n]),
+		Truncated: true,
+	}
+	return ErrMailResponseOverflow
 }
 
 func (c *Conn) readSmtpResponse(res []byte) (int, error) {
-	return util.ReadUntilRegex(c.getUnderlyingConn(), res, smtpEndRegex)
+	return c.readMailResponse(res, smtpEndRegex, "smtp")
 }
 
 func (c *Conn) SMTPBanner(b []byte) (int, error) {
+	restore := c.applyBannerTimeout()
 	n, err := c.readSmtpResponse(b)
+	restore()
 	c.grabData.Banner = string(b[0:n])
 	return n, err
 }
 
+// smtpBannerGrace bounds how long SMTPBannerLenient waits for the greeting to
+// be terminated when no banner timeout is set
+const smtpBannerGrace = 2 * time.Second
+
+// SMTPBannerLenient reads the greeting like SMTPBanner, but if the final
+// "NNN " line has not arrived within the banner timeout, or a couple of
+// seconds if none is set, it returns whatever was read so far without an
+// error and records the banner as unterminated. A timeout is still an error
+// if nothing arrived.
+func (c *Conn) SMTPBannerLenient(b []byte) (int, error) {
+	conn := c.getUnderlyingConn()
+	grace := c.bannerTimeout
+	if grace <= 0 {
+		grace = smtpBannerGrace
+	}
+	deadline := time.Now().Add(grace)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	n, err := c.readSmtpResponse(b)
+	conn.SetReadDeadline(c.readDeadline)
+	c.grabData.Banner = string(b[0:n])
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && n > 0 {
+		c.grabData.BannerUnterminated = true
+		return n, nil
+	}
+	return n, err
+}
+
+// defaultEHLOName is sent in EHLO when neither the caller nor SetEHLOName
+// gave a name.
+const defaultEHLOName = "localhost"
+
+// SetEHLOName sets the name EHLO sends when it is called with an empty
+// domain.
+func (c *Conn) SetEHLOName(name string) error {
+	if strings.ContainsAny(name, "\r\n") {
+		return ErrInvalidEHLOName
+	}
+	c.ehloName = name
+	return nil
+}
+
+// EHLODefault sends EHLO with the name from SetEHLOName, or "localhost" if
+// none was set.
+func (c *Conn) EHLODefault() error {
+	return c.EHLO("")
+}
+
 func (c *Conn) EHLO(domain string) error {
-	cmd := []byte("EHLO " + domain + "\r\n")
-	if _, err := c.getUnderlyingConn().Write(cmd); err != nil {
+	ehlo, err := c.sendEHLO(domain)
+	if ehlo == "" && err != nil {
 		return err
 	}
+	c.grabData.EHLO = ehlo
+	size := parseEHLOSize(c.grabData.EHLO)
+	c.grabData.EHLOMaxMessageSize = &size
+	return err
+}
+
+// sendEHLO sends EHLO and returns the response, defaulting the name as EHLO
+// does
+func (c *Conn) sendEHLO(domain string) (string, error) {
+	if domain == "" {
+		domain = c.ehloName
+	}
+	if domain == "" {
+		domain = defaultEHLOName
+	}
+	if err := c.checkUsable(); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(domain, "\r\n") {
+		return "", ErrInvalidEHLOName
+	}
+	cmd := []byte("EHLO " + domain + c.newline())
+	if _, err := c.getUnderlyingConn().Write(cmd); err != nil {
+		return "", err
+	}
 
 	buf := make([]byte, 512)
 	n, err := c.readSmtpResponse(buf)
-	c.grabData.EHLO = string(buf[0:n])
+	return string(buf[0:n]), err
+}
+
+// SMTPStartTLSRecheck performs SMTPStartTLSHandshake, then sends EHLO again
+// over TLS and records how the advertised extensions changed. EHLO must
+// have been sent first; its response stays in the ehlo field.
+func (c *Conn) SMTPStartTLSRecheck(domain string) error {
+	if c.grabData.EHLO == "" {
+		return ErrNoEHLO
+	}
+	event := &SMTPExtensionsEvent{PreTLS: ehloExtensions(c.grabData.EHLO)}
+	if err := c.SMTPStartTLSHandshake(); err != nil {
+		return err
+	}
+	c.grabData.SMTPExtensions = event
+	ehlo, err := c.sendEHLO(domain)
+	event.PostTLS = ehloExtensions(ehlo)
+	event.compare()
 	return err
 }
 
+// parseEHLOSize returns the maximum message size a server advertised with
+// the SIZE extension in its EHLO response, or -1 if it did not. A size of
+// zero means there is no fixed limit.
+func parseEHLOSize(ehlo string) int64 {
+	for _, line := range mailLines(ehlo) {
+		if len(line) < 4 {
+			continue
+		}
+		fields := strings.Fields(line[4:])
+		if len(fields) == 0 || !strings.EqualFold(fields[0], "SIZE") {
+			continue
+		}
+		if len(fields) == 1 {
+			return 0
+		}
+		if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil && size >= 0 {
+			return size
+		}
+	}
+	return -1
+}
+
+// SMTPMaxMessageSize returns the SIZE limit from the EHLO response, 0 if the
+// server set no limit, and -1 if it is unknown.
+func (c *Conn) SMTPMaxMessageSize() int64 {
+	if c.grabData.EHLOMaxMessageSize == nil {
+		return -1
+	}
+	return *c.grabData.EHLOMaxMessageSize
+}
+
+// ehloHasKeyword returns true if any of the extension keywords appears in an
+// EHLO response.
+func ehloHasKeyword(ehlo string, keywords ...string) bool {
+	for _, line := range mailLines(ehlo) {
+		if len(line) < 4 {
+			continue
+		}
+		fields := strings.Fields(line[4:])
+		if len(fields) == 0 {
+			continue
+		}
+		for _, keyword := range keywords {
+			if strings.EqualFold(fields[0], keyword) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SMTPSupportsChunking returns true if the server advertised CHUNKING or
+// BINARYMIME in its EHLO response, meaning it accepts BDAT. It returns false
+// if EHLO has not been sent.
+func (c *Conn) SMTPSupportsChunking() bool {
+	return ehloHasKeyword(c.grabData.EHLO, "CHUNKING", "BINARYMIME")
+}
+
 func (c *Conn) SMTPHelp() error {
-	cmd := []byte("HELP\r\n")
+	if err := c.checkUsable(); err != nil {
+		return err
+	}
+	cmd := []byte("HELP" + c.newline())
 	h := new(SMTPHelpEvent)
 	if _, err := c.getUnderlyingConn().Write(cmd); err != nil {
 		c.grabData.SMTPHelp = h
@@ -449,26 +1967,253 @@ func (c *Conn) SMTPHelp() error {
 	return err
 }
 
+// SetAllowMultipleRCPT lifts the limit of one SMTPProbeRecipient call per
+// connection.
+func (c *Conn) SetAllowMultipleRCPT(allow bool) {
+	c.allowMultipleRCPT = allow
+}
+
+// SMTPProbeRecipient asks the server whether it would accept mail for rcpt.
+// EHLO must have been sent first; a null sender is given with MAIL FROM
+// before the first probe. Only one recipient may be probed per connection
+// unless SetAllowMultipleRCPT(true) has been called. If a probe fails, RSET
+// is sent to abandon the transaction.
+func (c *Conn) SMTPProbeRecipient(rcpt string) (accepted bool, code int, err error) {
+	if strings.ContainsAny(rcpt, "\r\n") {
+		return false, 0, ErrInvalidRecipient
+	}
+	if len(c.grabData.SMTPRCPT) > 0 && !c.allowMultipleRCPT {
+		return false, 0, ErrRCPTLimit
+	}
+	if err = c.checkUsable(); err != nil {
+		return false, 0, err
+	}
+	buf := make([]byte, 512)
+	defer c.smtpAbortOnError(&err)
+	if !c.smtpMailSent {
+		if _, err = c.getUnderlyingConn().Write([]byte("MAIL FROM:<>" + c.newline())); err != nil {
+			return false, 0, err
+		}
+		c.smtpMailSent = true
+		var n int
+		if n, err = c.readSmtpResponse(buf); err != nil {
+			return false, 0, err
+		}
+		if !strings.HasPrefix(string(buf[0:n]), "250") {
+			return false, 0, fmt.Errorf("MAIL FROM rejected: %s", strings.TrimSpace(string(buf[0:n])))
+		}
+	}
+
+	event := SMTPRecipientEvent{Recipient: rcpt}
+	defer func() {
+		c.grabData.SMTPRCPT = append(c.grabData.SMTPRCPT, event)
+	}()
+	if _, err = c.getUnderlyingConn().Write([]byte("RCPT TO:<" + rcpt + ">" + c.newline())); err != nil {
+		return false, 0, err
+	}
+	n, err := c.readSmtpResponse(buf)
+	event.Response = string(buf[0:n])
+	if err != nil {
+		return false, 0, err
+	}
+	if n < 3 {
+		return false, 0, errors.New("Bad return code for RCPT")
+	}
+	if event.Code, err = strconv.Atoi(event.Response[0:3]); err != nil {
+		return false, 0, errors.New("Bad return code for RCPT")
+	}
+	event.Accepted = event.Code == 250 || event.Code == 251
+	return event.Accepted, event.Code, nil
+}
+
+// defaultSMTPProbeCommands are sent by SMTPProbeCommands when it is given
+// no commands
+var defaultSMTPProbeCommands = []string{"NOOP", "HELP", "RSET"}
+
+// safeSMTPCommands only read or reset state, so SMTPProbeCommands sends
+// them. Anything else could send mail, start a queue run, end the session
+// or switch protocols, and is skipped unless SetAllowUnsafeSMTPCommands is
+// set.
+var safeSMTPCommands = map[string]bool{
+	"NOOP": true,
+	"HELP": true,
+	"RSET": true,
+	"VRFY": true,
+	"EXPN": true,
+	"EHLO": true,
+	"HELO": true,
+}
+
+// SetAllowUnsafeSMTPCommands lets SMTPProbeCommands send commands other than
+// NOOP, HELP, RSET, VRFY, EXPN, EHLO and HELO, such as MAIL, DATA and QUIT
+func (c *Conn) SetAllowUnsafeSMTPCommands(allow bool) {
+	c.allowUnsafeSMTP = allow
+}
+
+// SMTPProbeCommands sends each command in cmds, or NOOP, HELP and RSET if
+// cmds is empty, and returns the reply code for each. RSET is sent after
+// every probe, so that commands like MAIL do not leave a transaction open.
+// Only commands in safeSMTPCommands are sent; the rest are recorded as
+// skipped unless SetAllowUnsafeSMTPCommands(true) has been called. The
+// probes are recorded in order, including the one that failed if err is set.
+func (c *Conn) SMTPProbeCommands(cmds []string) (codes map[string]int, err error) {
+	if err = c.checkUsable(); err != nil {
+		return nil, err
+	}
+	if len(cmds) == 0 {
+		cmds = defaultSMTPProbeCommands
+	}
+	for _, cmd := range cmds {
+		if strings.ContainsAny(cmd, "\r\n") {
+			return nil, ErrInvalidSMTPCommand
+		}
+	}
+	codes = make(map[string]int)
+	buf := make([]byte, 512)
+	for _, cmd := range cmds {
+		probe := SMTPCommandProbe{Command: cmd}
+		verb := ""
+		if fields := strings.Fields(cmd); len(fields) > 0 {
+			verb = strings.ToUpper(fields[0])
+		}
+		if !safeSMTPCommands[verb] && !c.allowUnsafeSMTP {
+			probe.Skipped = true
+			c.grabData.SMTPCommands = append(c.grabData.SMTPCommands, probe)
+			continue
+		}
+		if _, err = c.getUnderlyingConn().Write([]byte(cmd + c.newline())); err != nil {
+			c.grabData.SMTPCommands = append(c.grabData.SMTPCommands, probe)
+			return codes, err
+		}
+		var n int
+		n, err = c.readSmtpResponse(buf)
+		probe.Response = string(buf[0:n])
+		if n >= 3 {
+			probe.Code, _ = strconv.Atoi(probe.Response[0:3])
+		}
+		c.grabData.SMTPCommands = append(c.grabData.SMTPCommands, probe)
+		if err != nil {
+			return codes, err
+		}
+		codes[cmd] = probe.Code
+		if verb != "RSET" {
+			if _, err = c.smtpReset(); err != nil {
+				return codes, err
+			}
+		}
+	}
+	return codes, nil
+}
+
 func (c *Conn) readPop3Response(res []byte) (int, error) {
-	return util.ReadUntilRegex(c.getUnderlyingConn(), res, pop3EndRegex)
+	return c.readMailResponse(res, pop3EndRegex, "pop3")
 }
 
 func (c *Conn) POP3Banner(b []byte) (int, error) {
+	restore := c.applyBannerTimeout()
 	n, err := c.readPop3Response(b)
+	restore()
 	c.grabData.Banner = string(b[0:n])
 	return n, err
 }
 
+// POP3APOP authenticates using the APOP command, which digests the secret
+// with the timestamp the server presented in its greeting. POP3Banner must
+// have been called first.
+func (c *Conn) POP3APOP(user, secret string) (bool, error) {
+	event := &POP3LoginEvent{
+		Method: "APOP",
+		User:   user,
+	}
+	c.grabData.POP3Login = event
+	if err := c.checkUsable(); err != nil {
+		return false, err
+	}
+
+	start := strings.Index(c.grabData.Banner, "<")
+	if start < 0 {
+		return false, ErrNoAPOPTimestamp
+	}
+	end := strings.Index(c.grabData.Banner[start:], ">")
+	if end < 0 {
+		return false, ErrNoAPOPTimestamp
+	}
+	timestamp := c.grabData.Banner[start : start+end+1]
+	digest := md5.Sum([]byte(timestamp + secret))
+
+	cmd := []byte("APOP " + user + " " + hex.EncodeToString(digest[:]) + c.newline())
+	if _, err := c.getUnderlyingConn().Write(cmd); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 512)
+	n, err := c.readPop3Response(buf)
+	event.Response = string(buf[0:n])
+	event.Success = strings.HasPrefix(event.Response, "+OK")
+	return event.Success, err
+}
+
+// pop3TopMaxSize caps how much of a TOP response is read
+const pop3TopMaxSize = 64 * 1024
+
+// POP3Top sends TOP for message msg, asking for its headers and the first
+// lines lines of its body, and returns the multi-line response without the
+// status line, terminating dot or dot-stuffing. The connection must be authenticated. A
+// -ERR answer is returned as a *POP3Error.
+func (c *Conn) POP3Top(msg, lines int) ([]byte, error) {
+	event := &POP3TopEvent{Message: msg, Lines: lines}
+	c.grabData.POP3Top = event
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	cmd := "TOP " + strconv.Itoa(msg) + " " + strconv.Itoa(lines)
+	if _, err := c.getUnderlyingConn().Write([]byte(cmd + c.newline())); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, pop3TopMaxSize)
+	n, err := c.readMailResponse(buf, pop3MultiLineEndRegex, "pop3")
+	event.Response = string(buf[0:n])
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(event.Response, "+OK") {
+		return nil, &POP3Error{Command: cmd, Response: strings.TrimSpace(event.Response)}
+	}
+	event.Success = true
+	body := event.Response[strings.Index(event.Response, "\n")+1:]
+	if strings.HasSuffix(body, ".\r\n") {
+		body = body[:len(body)-3]
+	} else {
+		body = body[:len(body)-2]
+	}
+	// Undo the dot-stuffing of lines that start with a dot
+	body = strings.Replace("\n"+body, "\n..", "\n.", -1)[1:]
+	return []byte(body), nil
+}
+
 func (c *Conn) readImapStatusResponse(res []byte) (int, error) {
-	return util.ReadUntilRegex(c.getUnderlyingConn(), res, imapStatusEndRegex)
+	return c.readIMAPResponse(res, imapStatusEndRegex)
 }
 
 func (c *Conn) IMAPBanner(b []byte) (int, error) {
+	restore := c.applyBannerTimeout()
 	n, err := c.readImapStatusResponse(b)
+	restore()
 	c.grabData.Banner = string(b[0:n])
+	c.grabData.IMAPCapabilities = parseIMAPCapabilities(c.grabData.Banner)
 	return n, err
 }
 
+// parseIMAPCapabilities returns the capabilities listed in a bracketed
+// CAPABILITY response code, as many servers include in their greeting, or
+// nil if there is none.
+func parseIMAPCapabilities(greeting string) []string {
+	match := imapCapabilityRegex.FindStringSubmatch(greeting)
+	if match == nil {
+		return nil
+	}
+	return strings.Fields(match[1])
+}
+
 func (c *Conn) CheckHeartbleed(b []byte) (int, error) {
 	if !c.isTls {
 		return 0, fmt.Errorf(
@@ -517,36 +2262,171 @@ func (c *Conn) BACNetVendorQuery() error {
 }
 
 func (c *Conn) SendModbusEcho() (int, error) {
+	event, w, err := c.readModbusDeviceID(0, 0)
+	// make sure the whole thing gets appended to the operation log
+	c.grabData.Modbus = event
+	return w, err
+}
+
+// readModbusDeviceID sends a read device identification request to unit and
+// reads the response, following up while the device has more objects. A
+// non-zero transactionID is sent in each request, and responses carrying
+// another ID are skipped.
+func (c *Conn) readModbusDeviceID(unit byte, transactionID uint16) (*ModbusEvent, int, error) {
+	event := new(ModbusEvent)
+	w, err := c.sendModbusDeviceIDRequest(unit, transactionID, 0x00)
+	if err != nil {
+		return event, w, errors.New("Could not write modbus request")
+	}
+
+	res, err := c.nextModbusResponse(transactionID)
+	event.Length = res.Length
+	event.UnitID = res.UnitID
+	event.Function = res.Function
+	event.Response = res.Data
+	event.ParseSelf()
+	if err != nil {
+		event.RawData = c.recordRaw(res.Raw)
+	}
+
+	// Devices with more objects than fit in a single response set the more
+	// follows flag, and expect a new request starting at the next object
+	for i := 0; err == nil && i < modbusMaxFollowUps; i++ {
+		mei := event.MEIResponse
+		if mei == nil || !mei.MoreFollows || mei.NextObjectID == 0 {
+			break
+		}
+		var n int
+		n, err = c.sendModbusDeviceIDRequest(unit, transactionID, byte(mei.NextObjectID))
+		w += n
+		if err != nil {
+			break
+		}
+		var next ModbusResponse
+		if next, err = c.nextModbusResponse(transactionID); err != nil {
+			event.RawData = c.recordRaw(next.Raw)
+			break
+		}
+		follow := ModbusEvent{
+			Function: next.Function,
+			Response: next.Data,
+		}
+		follow.ParseSelf()
+		if follow.MEIResponse == nil {
+			break
+		}
+		mei.Objects = append(mei.Objects, follow.MEIResponse.Objects...)
+		mei.ObjectCount = len(mei.Objects)
+		mei.MoreFollows = follow.MEIResponse.MoreFollows
+		mei.NextObjectID = follow.MEIResponse.NextObjectID
+	}
+	if event.MEIResponse != nil {
+		event.DeviceID = event.MEIResponse.DeviceID()
+	}
+	return event, w, err
+}
+
+// nextModbusResponse reads responses until one matches transactionID,
+// discarding late answers to earlier requests.
+func (c *Conn) nextModbusResponse(transactionID uint16) (ModbusResponse, error) {
+	for {
+		res, err := c.getModbusResponse(transactionID)
+		if err != errModbusStaleResponse {
+			return res, err
+		}
+	}
+}
+
+// ModbusScanUnits sends a read device identification request to each unit
+// ID in ids, as a serial to TCP gateway forwards each one to a different
+// device, and returns the device IDs of the units that answered. Each unit
+// gets its own transaction ID, so a late answer from one unit is not taken
+// for the next unit's. A unit that does not answer within modbusUnitWait is
+// skipped; the scan only stops early if the connection fails. The results
+// are recorded in a ModbusGatewayEvent.
+func (c *Conn) ModbusScanUnits(ids []byte) map[byte]*ModbusDeviceID {
+	event := &ModbusGatewayEvent{Units: make(map[byte]*ModbusDeviceID)}
+	c.grabData.ModbusGateway = event
+	conn := c.getUnderlyingConn()
+	defer conn.SetReadDeadline(c.readDeadline)
+	transactionID := binary.BigEndian.Uint16(ModbusHeaderBytes)
+	for _, unit := range ids {
+		deadline := time.Now().Add(modbusUnitWait)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		conn.SetReadDeadline(deadline)
+		transactionID++
+		if transactionID == 0 {
+			transactionID++
+		}
+		res, _, err := c.readModbusDeviceID(unit, transactionID)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			event.Unanswered = append(event.Unanswered, int(unit))
+			continue
+		}
+		if err != nil && res.Length == 0 {
+			event.Error = err.Error()
+			break
+		}
+		switch {
+		case res.UnitID != int(unit):
+			// Answered, but for another unit
+			event.Unanswered = append(event.Unanswered, int(unit))
+		case res.ExceptionReponse != nil:
+			if event.Exceptions == nil {
+				event.Exceptions = make(map[byte]*ExceptionResponse)
+			}
+			event.Exceptions[unit] = res.ExceptionReponse
+		case res.DeviceID != nil:
+			event.Units[unit] = res.DeviceID
+		}
+	}
+	return event.Units
+}
+
+func (c *Conn) sendModbusDeviceIDRequest(unit byte, transactionID uint16, objectID byte) (int, error) {
 	req := ModbusRequest{
-		Function: ModbusFunctionEncapsulatedInterface,
+		TransactionID: transactionID,
+		UnitID:        unit,
+		Function:      ModbusFunctionEncapsulatedInterface,
 		Data: []byte{
-			0x0E, // read device info
-			0x01, // product code
-			0x00, // object id, should always be 0 in initial request
+			0x0E,     // read device info
+			0x01,     // product code
+			objectID, // object id, 0 in the initial request
 		},
 	}
-
-	event := new(ModbusEvent)
-	data, err := req.MarshalBinary()
+	data, _ := req.MarshalBinary()
 	w := 0
 	for w < len(data) {
 		written, err := c.getUnderlyingConn().Write(data[w:]) // TODO verify write
 		w += written
 		if err != nil {
-			c.grabData.Modbus = event
-			return w, errors.New("Could not write modbus request")
+			return w, err
 		}
 	}
+	return w, nil
+}
 
-	res, err := c.GetModbusResponse()
-	event.Length = res.Length
-	event.UnitID = res.UnitID
-	event.Function = res.Function
-	event.Response = res.Data
-	event.ParseSelf()
-	// make sure the whole thing gets appended to the operation log
-	c.grabData.Modbus = event
-	return w, err
+// FTPBanner reads the FTP greeting and returns true if it has a 2xx code.
+func (c *Conn) FTPBanner() (bool, error) {
+	if c.grabData.FTP == nil {
+		c.grabData.FTP = new(ftp.FTPLog)
+	}
+	return ftp.GetFTPBanner(c.grabData.FTP, c.getUnderlyingConn())
+}
+
+// FTPFeat sends FEAT and returns the features the server lists, such as
+// "AUTH TLS" or "MDTM", without their leading space.
+func (c *Conn) FTPFeat() ([]string, error) {
+	if err := c.checkUsable(); err != nil {
+		return nil, err
+	}
+	if c.grabData.FTP == nil {
+		c.grabData.FTP = new(ftp.FTPLog)
+	}
+	return ftp.GetFTPFeatures(c.grabData.FTP, c.getUnderlyingConn())
 }
 
 func (c *Conn) GetFTPSCertificates() error {
@@ -557,10 +2437,14 @@ func (c *Conn) GetFTPSCertificates() error {
 	}
 
 	if ftpsReady {
-		return c.TLSHandshake()
-	} else {
-		return nil
+		if err := c.TLSHandshake(); err != nil {
+			if c.closedAfterSTARTTLS(err) {
+				return &STARTTLSError{Reason: ErrServerClosedAfterSTARTTLS, Err: err}
+			}
+			return err
+		}
 	}
+	return nil
 }
 
 func (c *Conn) SSHHandshake() error {
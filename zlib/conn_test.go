@@ -0,0 +1,1213 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/util"
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+// scriptedServer answers each line read from the client with the next
+// response in responses, and records the lines it received.
+func scriptedServer(t *testing.T, greeting string, responses ...string) (*Conn, <-chan []string) {
+	client, server := net.Pipe()
+	received := make(chan []string, 1)
+	go func() {
+		defer server.Close()
+		var lines []string
+		defer func() { received <- lines }()
+		if greeting != "" {
+			if _, err := server.Write([]byte(greeting)); err != nil {
+				return
+			}
+		}
+		r := bufio.NewReader(server)
+		for _, res := range responses {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+			if _, err := server.Write([]byte(res)); err != nil {
+				return
+			}
+		}
+	}()
+	return &Conn{conn: client}, received
+}
+
+func TestPOP3APOP(t *testing.T) {
+	c, received := scriptedServer(t, "+OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>\r\n", "+OK maildrop has 1 message (369 octets)\r\n")
+	defer c.Close()
+	if _, err := c.POP3Banner(make([]byte, 512)); err != nil {
+		t.Fatalf("unexpected error reading banner: %s", err)
+	}
+	ok, err := c.POP3APOP("mrose", "tanstaaf")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok || !c.grabData.POP3Login.Success {
+		t.Error("expected APOP login to succeed")
+	}
+	c.Close()
+	lines := <-received
+	expected := "APOP mrose c4c9334bac560ecc979e58001b3e22fb\r\n"
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("wrong APOP command, expected %q, got %q", expected, lines)
+	}
+}
+
+func TestPOP3APOPEarlierBracket(t *testing.T) {
+	c, received := scriptedServer(t, "+OK POP3 server -> ready <1896.697170952@dbc.mtview.ca.us>\r\n", "+OK maildrop has 1 message (369 octets)\r\n")
+	defer c.Close()
+	if _, err := c.POP3Banner(make([]byte, 512)); err != nil {
+		t.Fatalf("unexpected error reading banner: %s", err)
+	}
+	if _, err := c.POP3APOP("mrose", "tanstaaf"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+	lines := <-received
+	expected := "APOP mrose c4c9334bac560ecc979e58001b3e22fb\r\n"
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("wrong APOP command, expected %q, got %q", expected, lines)
+	}
+}
+
+func TestPOP3APOPNoTimestamp(t *testing.T) {
+	c, _ := scriptedServer(t, "+OK POP3 server ready\r\n")
+	defer c.Close()
+	if _, err := c.POP3Banner(make([]byte, 512)); err != nil {
+		t.Fatalf("unexpected error reading banner: %s", err)
+	}
+	if _, err := c.POP3APOP("mrose", "tanstaaf"); err != ErrNoAPOPTimestamp {
+		t.Errorf("expected ErrNoAPOPTimestamp, got %v", err)
+	}
+}
+
+// chunkedServer writes each chunk in a separate write to the client.
+func chunkedServer(chunks ...string) *Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		for _, chunk := range chunks {
+			if _, err := server.Write([]byte(chunk)); err != nil {
+				return
+			}
+		}
+	}()
+	return &Conn{conn: client}
+}
+
+func TestPOP3Top(t *testing.T) {
+	c, _ := scriptedServer(t, "", "+OK top of message follows\r\nSubject: hi\r\n\r\n..dotted\r\n.\r\n", "-ERR no such message\r\n")
+	defer c.Close()
+	top, err := c.POP3Top(1, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "Subject: hi\r\n\r\n.dotted\r\n"; string(top) != expected {
+		t.Errorf("expected %q, got %q", expected, top)
+	}
+	if _, err := c.POP3Top(9, 0); err == nil {
+		t.Error("expected an error for a missing message")
+	} else if _, ok := err.(*POP3Error); !ok {
+		t.Errorf("expected a POP3Error, got %v", err)
+	}
+	if c.grabData.POP3Top == nil || c.grabData.POP3Top.Message != 9 || c.grabData.POP3Top.Success {
+		t.Errorf("unexpected event %+v", c.grabData.POP3Top)
+	}
+}
+
+func TestBannerTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := &Conn{conn: client}
+	defer c.Close()
+	c.SetBannerTimeout(50 * time.Millisecond)
+	_, err := c.SMTPBanner(make([]byte, 512))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	// The banner timeout must not apply to later reads
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.Write([]byte("220 late\r\n"))
+	}()
+	if _, err := c.Read(make([]byte, 512)); err != nil {
+		t.Errorf("unexpected error after the banner: %s", err)
+	}
+}
+
+func TestBannerTimeoutCappedByReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := &Conn{conn: client, readDeadline: time.Now().Add(50 * time.Millisecond)}
+	defer c.Close()
+	c.SetBannerTimeout(time.Minute)
+	start := time.Now()
+	_, err := c.SMTPBanner(make([]byte, 512))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the read deadline to end the banner read, took %s", elapsed)
+	}
+}
+
+func TestPOP3Grab(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayRead("+OK POP3 ready\r\n"),
+		ReplayWrite("CAPA\r\n"),
+		ReplayRead("+OK\r\nUSER\r\nUIDL\r\n.\r\n"),
+	)}
+	if err := c.POP3Grab(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(c.grabData.POP3Capabilities) != 2 || c.grabData.TLSHandshake != nil {
+		t.Errorf("expected two capabilities and no TLS, got %q", c.grabData.POP3Capabilities)
+	}
+	if capa := c.grabData.POP3Capa; capa == nil || capa.STLSAvailable || len(capa.Lines) != 2 {
+		t.Errorf("expected no STLS in the CAPA event, got %+v", capa)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayRead("+OK POP3 ready\r\n"),
+		ReplayWrite("CAPA\r\n"),
+		ReplayRead("+OK\r\nSTLS\r\nSASL PLAIN LOGIN\r\n.\r\n"),
+		ReplayWrite("STLS\r\n"),
+		ReplayRead("+OK Begin TLS\r\n"),
+	)}
+	if err := c.POP3Grab(); !errors.Is(err, ErrPostSTARTTLSFailure) {
+		t.Errorf("expected ErrPostSTARTTLSFailure, got %v", err)
+	}
+	capa := c.grabData.POP3Capa
+	if capa == nil || !capa.STLSAvailable || !reflect.DeepEqual(capa.SASLMechanisms, []string{"PLAIN", "LOGIN"}) {
+		t.Errorf("expected STLS and two SASL mechanisms, got %+v", capa)
+	}
+	if c.grabData.StartTLS != "+OK Begin TLS\r\n" {
+		t.Errorf("unexpected STARTTLS response %q", c.grabData.StartTLS)
+	}
+}
+
+func TestSMTPBannerMultiline(t *testing.T) {
+	tests := [][]string{
+		{"220 mx.example.com ESMTP\r\n"},
+		{"220\r\n"},
+		{"220-mx.example.com ESMTP\r\n", "220 No UCE\r\n"},
+		{"220-mx.example.com ESMTP Postfix\r\n", "220-Unsolicited mail prohibited\r\n", "220 Ready\r\n"},
+		{"220-mx.example.com", " ESMTP\r\n220-", "second\r\n", "220 third\r\n"},
+	}
+	for _, chunks := range tests {
+		c := chunkedServer(chunks...)
+		expected := strings.Join(chunks, "")
+		n, err := c.SMTPBanner(make([]byte, 512))
+		if err != nil {
+			t.Errorf("unexpected error reading %q: %s", expected, err)
+		}
+		if n != len(expected) || c.grabData.Banner != expected {
+			t.Errorf("expected banner %q, got %q", expected, c.grabData.Banner)
+		}
+		c.Close()
+	}
+}
+
+func TestMailLFOnly(t *testing.T) {
+	tests := []struct {
+		read   func(c *Conn, b []byte) (int, error)
+		chunks []string
+	}{
+		{(*Conn).SMTPBanner, []string{"220 mx.example.com ESMTP\n"}},
+		{(*Conn).SMTPBanner, []string{"220-mx.example.com ESMTP\n", "220 Ready\n"}},
+		{(*Conn).readPop3Response, []string{"+OK POP3 ready\n"}},
+		{(*Conn).readImapStatusResponse, []string{"* OK IMAP4rev1 ready\n"}},
+		{func(c *Conn, b []byte) (int, error) {
+			return c.readImapTaggedResponse("a001", b)
+		}, []string{"* CAPABILITY IMAP4rev1\n", "a001 OK done\n"}},
+	}
+	for _, test := range tests {
+		c := chunkedServer(test.chunks...)
+		expected := strings.Join(test.chunks, "")
+		n, err := test.read(c, make([]byte, 512))
+		if err != nil {
+			t.Errorf("unexpected error reading %q: %s", expected, err)
+		}
+		if n != len(expected) {
+			t.Errorf("expected to read all of %q, got %d bytes", expected, n)
+		}
+		c.Close()
+	}
+
+	c := &Conn{conn: NewReplayConn(
+		ReplayRead("+OK POP3 ready\n"),
+		ReplayWrite("CAPA\r\n"),
+		ReplayRead("+OK\nSTLS\nUSER\n.\n"),
+		ReplayWrite("STLS\r\n"),
+		ReplayRead("-ERR not now\n"),
+	)}
+	c.POP3Grab()
+	if capa := c.grabData.POP3Capa; capa == nil || !capa.STLSAvailable || len(capa.Lines) != 2 {
+		t.Errorf("expected STLS and USER from an LF-only CAPA, got %+v", capa)
+	}
+
+	tops := map[string]string{
+		"+OK\r\n.\n":                        "",
+		"+OK\n.\n":                          "",
+		"+OK\nSubject: hi\n\n..dotted\n.\n": "Subject: hi\n\n.dotted\n",
+	}
+	for response, expected := range tops {
+		c := &Conn{conn: NewReplayConn(ReplayWrite("TOP 1 0\r\n"), ReplayRead(response))}
+		top, err := c.POP3Top(1, 0)
+		if err != nil {
+			t.Errorf("unexpected error for TOP response %q: %s", response, err)
+		} else if string(top) != expected {
+			t.Errorf("expected %q from TOP response %q, got %q", expected, response, top)
+		}
+	}
+
+	ehlo := "250-mx.example.com\n250-SIZE 1000\n250-STARTTLS\n250 8BITMIME\n"
+	if size := parseEHLOSize(ehlo); size != 1000 {
+		t.Errorf("expected SIZE 1000 from an LF-only EHLO, got %d", size)
+	}
+	if !ehloHasKeyword(ehlo, "STARTTLS") {
+		t.Error("expected STARTTLS in an LF-only EHLO")
+	}
+	if extensions := ehloExtensions(ehlo); !reflect.DeepEqual(extensions, []string{"SIZE 1000", "STARTTLS", "8BITMIME"}) {
+		t.Errorf("unexpected extensions %q", extensions)
+	}
+
+	imap := "* LIST () \"/\" INBOX\n* LIST () \"/\" Sent\na001 OK done\n"
+	if data := untaggedIMAPData(imap, "LIST"); !reflect.DeepEqual(data, []string{`() "/" INBOX`, `() "/" Sent`}) {
+		t.Errorf("unexpected LIST data %q", data)
+	}
+	if status, _, ok := parseIMAPTaggedResponse("a001", imap); !ok || status != "OK" {
+		t.Errorf("expected a tagged OK, got %q", status)
+	}
+}
+
+func TestSMTPBannerLenient(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Write([]byte("220-mx.example.com ESMTP\r\n"))
+	c := &Conn{conn: client}
+	c.SetBannerTimeout(50 * time.Millisecond)
+	n, err := c.SMTPBannerLenient(make([]byte, 512))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 26 || !c.grabData.BannerUnterminated {
+		t.Errorf("expected the partial banner to be kept, got %q", c.grabData.Banner)
+	}
+
+	c = chunkedServer("220-mx.example.com\r\n", "220 ESMTP\r\n")
+	if _, err := c.SMTPBannerLenient(make([]byte, 512)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.grabData.BannerUnterminated {
+		t.Error("expected a terminated banner")
+	}
+}
+
+func TestSMTPProbeRecipient(t *testing.T) {
+	c, received := scriptedServer(t, "", "250 2.1.0 Ok\r\n", "550 5.1.1 User unknown\r\n")
+	defer c.Close()
+	accepted, code, err := c.SMTPProbeRecipient("nobody@example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if accepted || code != 550 {
+		t.Errorf("expected rejection with 550, got accepted=%t code=%d", accepted, code)
+	}
+	if _, _, err := c.SMTPProbeRecipient("root@example.com"); err != ErrRCPTLimit {
+		t.Errorf("expected ErrRCPTLimit on second probe, got %v", err)
+	}
+	if len(c.grabData.SMTPRCPT) != 1 {
+		t.Errorf("expected one recorded probe, got %d", len(c.grabData.SMTPRCPT))
+	}
+	c.Close()
+	lines := <-received
+	if len(lines) != 2 || lines[0] != "MAIL FROM:<>\r\n" || lines[1] != "RCPT TO:<nobody@example.com>\r\n" {
+		t.Errorf("wrong commands sent: %q", lines)
+	}
+}
+
+func TestSMTPProbeRecipientInjection(t *testing.T) {
+	c, received := scriptedServer(t, "")
+	defer c.Close()
+	c.SetAllowMultipleRCPT(true)
+	for _, rcpt := range []string{"a@example.com>\r\nDATA", "a@example.com>\nRSET", "a@example.com\r"} {
+		if _, _, err := c.SMTPProbeRecipient(rcpt); err != ErrInvalidRecipient {
+			t.Errorf("expected ErrInvalidRecipient for %q, got %v", rcpt, err)
+		}
+	}
+	c.Close()
+	if lines := <-received; len(lines) != 0 {
+		t.Errorf("expected nothing to be sent, got %q", lines)
+	}
+}
+
+func TestEHLODefaultName(t *testing.T) {
+	c, received := scriptedServer(t, "", "250 mail.example.com\r\n")
+	defer c.Close()
+	if err := c.EHLODefault(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+	if lines := <-received; len(lines) != 1 || lines[0] != "EHLO localhost\r\n" {
+		t.Errorf("wrong EHLO command: %q", lines)
+	}
+}
+
+func TestSetEHLONameRejectsCRLF(t *testing.T) {
+	c := new(Conn)
+	if err := c.SetEHLOName("example.com\r\nRSET"); err != ErrInvalidEHLOName {
+		t.Errorf("expected ErrInvalidEHLOName, got %v", err)
+	}
+}
+
+func TestTLSProbeWithoutDialer(t *testing.T) {
+	c := new(Conn)
+	if _, err := c.ServerPrefersOwnCipherOrder(); err != ErrNoDialer {
+		t.Errorf("expected ErrNoDialer, got %v", err)
+	}
+}
+
+func TestClientHelloIntoleranceSizes(t *testing.T) {
+	c := new(Conn)
+	c.SetDial(func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			// Read the ClientHello and hang up without answering
+			server.Read(make([]byte, 4096))
+			server.Close()
+		}()
+		return client, nil
+	})
+	if _, err := c.CheckClientHelloIntolerance(); err != ErrNoServerHello {
+		t.Errorf("expected ErrNoServerHello, got %v", err)
+	}
+	event := c.grabData.Intolerance
+	if event == nil {
+		t.Fatal("expected an intolerance event")
+	}
+	if event.LargeHelloSize <= 512 || event.MinimalHelloSize >= event.LargeHelloSize {
+		t.Errorf("unexpected ClientHello sizes %d and %d", event.MinimalHelloSize, event.LargeHelloSize)
+	}
+	if event.Intolerant {
+		t.Error("expected no intolerance without a ServerHello")
+	}
+}
+
+func TestMaxReadCalls(t *testing.T) {
+	c := chunkedServer("220-a\r\n", "220-b\r\n", "220-c\r\n", "220 d\r\n")
+	defer c.Close()
+	c.SetMaxReadCalls(3)
+	if _, err := c.SMTPBanner(make([]byte, 512)); err != util.ErrTooManyReads {
+		t.Errorf("expected ErrTooManyReads, got %v", err)
+	}
+}
+
+func TestRecordHandshakeBytes(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		server.Read(make([]byte, 4096))
+		server.Write([]byte("\x15\x03\x01\x00\x02\x02\x28"))
+	}()
+	c := &Conn{conn: client}
+	c.SetRecordHandshakeBytes()
+	c.SetMaxRecordedBytes(16)
+	if err := c.TLSHandshake(); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	hl := c.grabData.TLSHandshake
+	if len(hl.RawClientBytes) != 16 || hl.RawClientBytes[0] != 0x16 {
+		t.Errorf("expected 16 bytes of ClientHello, got %x", hl.RawClientBytes)
+	}
+	if string(hl.RawServerBytes) != "\x15\x03\x01\x00\x02\x02\x28" {
+		t.Errorf("unexpected server bytes %x", hl.RawServerBytes)
+	}
+}
+
+func TestSetMaxFragmentLength(t *testing.T) {
+	c := &Conn{}
+	for _, code := range []uint8{0, 5} {
+		if err := c.SetMaxFragmentLength(code); err != ErrInvalidMaxFragmentLength {
+			t.Errorf("code %d: expected ErrInvalidMaxFragmentLength, got %v", code, err)
+		}
+	}
+	client, server := net.Pipe()
+	hello := make(chan []byte, 1)
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 4096)
+		n, _ := server.Read(buf)
+		hello <- buf[:n]
+	}()
+	c.conn = client
+	if err := c.SetMaxFragmentLength(2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.TLSHandshake()
+	if !strings.Contains(string(<-hello), "\x00\x01\x00\x01\x02") {
+		t.Error("ClientHello is missing the max_fragment_length extension")
+	}
+	if c.MaxFragmentLengthHonored() {
+		t.Error("expected the extension not to be honored without a ServerHello")
+	}
+}
+
+func TestSMTPBannerOverflow(t *testing.T) {
+	c := chunkedServer("220-mail.example.com ESMTP\r\n220-this greeting keeps going\r\n")
+	defer c.Close()
+	buf := make([]byte, 32)
+	if _, err := c.SMTPBanner(buf); err != ErrMailResponseOverflow {
+		t.Fatalf("expected ErrMailResponseOverflow, got %v", err)
+	}
+	overflow := c.grabData.MailOverflow
+	if overflow == nil || !overflow.Truncated || overflow.Limit != 32 || overflow.Partial != c.grabData.Banner {
+		t.Errorf("wrong overflow event: %+v", overflow)
+	}
+
+	// A complete response that exactly fills the buffer is not an overflow
+	c = chunkedServer("220 hi\r\n")
+	defer c.Close()
+	if n, err := c.SMTPBanner(make([]byte, 8)); err != nil || n != 8 {
+		t.Errorf("expected the full banner without error, got %d, %v", n, err)
+	}
+	if c.grabData.MailOverflow != nil {
+		t.Errorf("unexpected overflow event: %+v", c.grabData.MailOverflow)
+	}
+}
+
+func TestWHOISQuery(t *testing.T) {
+	c, received := scriptedServer(t, "", "Domain Name: EXAMPLE.COM\r\nRegistrar: RESERVED-Internet Assigned Numbers Authority\r\n")
+	defer c.Close()
+	res, err := c.WHOISQuery("example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(res, "Domain Name: EXAMPLE.COM\r\n") || c.grabData.WHOIS.Truncated {
+		t.Errorf("wrong WHOIS response %q", res)
+	}
+	if lines := <-received; len(lines) != 1 || lines[0] != "example.com\r\n" {
+		t.Errorf("wrong WHOIS query sent: %q", lines)
+	}
+}
+
+func TestIMAPBannerCapabilities(t *testing.T) {
+	c := chunkedServer("* OK [CAPABILITY IMAP4rev1 SASL-IR LOGIN-REFERRALS STARTTLS AUTH=PLAIN] Dovecot ready.\r\n")
+	defer c.Close()
+	if _, err := c.IMAPBanner(make([]byte, 512)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"IMAP4rev1", "SASL-IR", "LOGIN-REFERRALS", "STARTTLS", "AUTH=PLAIN"}
+	if strings.Join(c.grabData.IMAPCapabilities, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected capabilities %q, got %q", expected, c.grabData.IMAPCapabilities)
+	}
+	if caps := parseIMAPCapabilities("* OK IMAP4 ready\r\n"); caps != nil {
+		t.Errorf("expected no capabilities, got %q", caps)
+	}
+}
+
+func TestIMAPAuthMechanisms(t *testing.T) {
+	c := new(Conn)
+	if c.IMAPAuthMechanisms() != nil {
+		t.Error("expected nil before CAPABILITY")
+	}
+	c.grabData.IMAPCapabilities = []string{"IMAP4rev1", "AUTH=PLAIN", "auth=XOAUTH2", "SASL-IR", "AUTH="}
+	if mechanisms := c.IMAPAuthMechanisms(); !reflect.DeepEqual(mechanisms, []string{"PLAIN", "XOAUTH2"}) {
+		t.Errorf("expected PLAIN and XOAUTH2, got %q", mechanisms)
+	}
+}
+
+func TestIMAPStartTLSRefused(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 STARTTLS\r\n"),
+		ReplayRead("* BYE shutting down soon\r\n"),
+		ReplayRead("a001 NO STARTTLS not available\r\n"),
+	)}
+	err := c.IMAPStartTLSHandshake()
+	statusErr, ok := err.(*IMAPStatusError)
+	if !ok || statusErr.Status != "NO" || statusErr.Text != "STARTTLS not available" {
+		t.Errorf("expected an IMAPStatusError for NO, got %v", err)
+	}
+	if tag := c.nextIMAPTag(); tag != "a002" {
+		t.Errorf("expected next tag a002, got %s", tag)
+	}
+}
+
+func TestSMTPStartTLSHandshakeFailure(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("STARTTLS\r\n"),
+		ReplayRead("220 2.0.0 Ready to start TLS\r\n"),
+	)}
+	err := c.SMTPStartTLSHandshake()
+	if !errors.Is(err, ErrPostSTARTTLSFailure) {
+		t.Fatalf("expected ErrPostSTARTTLSFailure, got %v", err)
+	}
+	if startErr, ok := err.(*STARTTLSError); !ok || startErr.Err == nil {
+		t.Errorf("expected the handshake error to be kept, got %#v", err)
+	}
+	if c.grabData.TLSHandshake == nil {
+		t.Error("expected the partial handshake to be recorded")
+	}
+	if err := c.EHLO("example.com"); err != ErrPostSTARTTLSFailure {
+		t.Errorf("expected EHLO to be refused, got %v", err)
+	}
+}
+
+func TestSTARTTLSServerClosed(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 4096)
+		server.Read(buf)
+		server.Write([]byte("220 2.0.0 Ready to start TLS\r\n"))
+		server.Read(buf)
+	}()
+	c := &Conn{conn: client}
+	err := c.SMTPStartTLSHandshake()
+	if !errors.Is(err, ErrServerClosedAfterSTARTTLS) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected ErrServerClosedAfterSTARTTLS wrapping EOF, got %v", err)
+	}
+	if !c.grabData.StartTLSServerClosed {
+		t.Error("expected the close to be recorded")
+	}
+	if err := c.EHLO("example.com"); err != ErrPostSTARTTLSFailure {
+		t.Errorf("expected EHLO to be refused, got %v", err)
+	}
+}
+
+func TestSMTPStartTLSRecheck(t *testing.T) {
+	cert := selfSignedCert(t, "mx.example.com")
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 4096)
+		server.Read(buf)
+		server.Write([]byte("220 2.0.0 Ready to start TLS\r\n"))
+		tlsServer := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MaxVersion:   tls.VersionTLS12,
+		})
+		if err := tlsServer.Handshake(); err != nil {
+			return
+		}
+		tlsServer.Read(buf)
+		tlsServer.Write([]byte("250-mx.example.com\r\n250-SIZE 1000\r\n250 AUTH PLAIN LOGIN\r\n"))
+	}()
+
+	c := &Conn{conn: client}
+	if err := c.SMTPStartTLSRecheck(""); err != ErrNoEHLO {
+		t.Fatalf("expected ErrNoEHLO, got %v", err)
+	}
+	pre := "250-mx.example.com\r\n250-SIZE 1000\r\n250 STARTTLS\r\n"
+	c.grabData.EHLO = pre
+	if err := c.SMTPStartTLSRecheck(""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	event := c.grabData.SMTPExtensions
+	if !event.Changed {
+		t.Error("expected the extensions to change")
+	}
+	if !reflect.DeepEqual(event.Added, []string{"AUTH PLAIN LOGIN"}) || !reflect.DeepEqual(event.Removed, []string{"STARTTLS"}) {
+		t.Errorf("unexpected differences: added %q, removed %q", event.Added, event.Removed)
+	}
+	if c.grabData.EHLO != pre {
+		t.Errorf("expected the pre-TLS EHLO to be kept, got %q", c.grabData.EHLO)
+	}
+}
+
+func TestSTARTTLSFunctional(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("EHLO localhost\r\n"),
+		ReplayRead("250-mx.example.com\r\n250 STARTTLS\r\n"),
+		ReplayWrite("STARTTLS\r\n"),
+		ReplayRead("220 2.0.0 Ready to start TLS\r\n"),
+	)}
+	advertised, functional, err := c.STARTTLSFunctional("smtp")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !advertised || functional {
+		t.Errorf("expected advertised but not functional, got %t and %t", advertised, functional)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("CAPA\r\n"),
+		ReplayRead("+OK\r\nUSER\r\nUIDL\r\n.\r\n"),
+	)}
+	if advertised, functional, err = c.STARTTLSFunctional("pop3"); err != nil || advertised || functional {
+		t.Errorf("expected STLS not to be advertised, got %t, %t, %v", advertised, functional, err)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 CAPABILITY\r\n"),
+		ReplayRead("* CAPABILITY IMAP4rev1 LOGINDISABLED\r\na001 OK done\r\n"),
+	)}
+	if advertised, functional, err = c.STARTTLSFunctional("imap"); err != nil || advertised || functional {
+		t.Errorf("expected STARTTLS not to be advertised, got %t, %t, %v", advertised, functional, err)
+	}
+	if len(c.grabData.IMAPCapabilities) != 2 {
+		t.Errorf("expected 2 IMAP capabilities, got %q", c.grabData.IMAPCapabilities)
+	}
+
+	if _, _, err = new(Conn).STARTTLSFunctional("ftp"); err != ErrUnknownMailProtocol {
+		t.Errorf("expected ErrUnknownMailProtocol, got %v", err)
+	}
+}
+
+func TestSMTPRequiresAuth(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("MAIL FROM:<>\r\n"),
+		ReplayRead("530 5.7.0 Authentication required\r\n"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 Ok\r\n"),
+	)}
+	if _, err := c.SMTPRequiresAuth(); err != ErrNoEHLO {
+		t.Fatalf("expected ErrNoEHLO, got %v", err)
+	}
+	c.grabData.EHLO = "250 mx.example.com\r\n"
+	required, err := c.SMTPRequiresAuth()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !required {
+		t.Error("expected authentication to be required")
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseEHLOSize(t *testing.T) {
+	tests := []struct {
+		ehlo string
+		size int64
+	}{
+		{"250-mx.example.com\r\n250-PIPELINING\r\n250-SIZE 10485760\r\n250 8BITMIME\r\n", 10485760},
+		{"250-mx.example.com\r\n250 SIZE\r\n", 0},
+		{"250-mx.example.com\r\n250 STARTTLS\r\n", -1},
+		{"250-mx.example.com\r\n250 SIZE lots\r\n", -1},
+	}
+	for _, test := range tests {
+		if size := parseEHLOSize(test.ehlo); size != test.size {
+			t.Errorf("expected size %d for %q, got %d", test.size, test.ehlo, size)
+		}
+	}
+}
+
+func TestSMTPSupportsChunking(t *testing.T) {
+	tests := []struct {
+		ehlo     string
+		chunking bool
+	}{
+		{"", false},
+		{"250-mx.example.com\r\n250-PIPELINING\r\n250 CHUNKING\r\n", true},
+		{"250-mx.example.com\r\n250-binarymime\r\n250 8BITMIME\r\n", true},
+		{"250-mx.example.com\r\n250 8BITMIME\r\n", false},
+	}
+	for _, test := range tests {
+		c := &Conn{}
+		c.grabData.EHLO = test.ehlo
+		if chunking := c.SMTPSupportsChunking(); chunking != test.chunking {
+			t.Errorf("expected chunking %t for %q, got %t", test.chunking, test.ehlo, chunking)
+		}
+	}
+}
+
+func TestSetLineEnding(t *testing.T) {
+	replay := NewReplayConn(ReplayWrite("HELP\n"), ReplayRead("214 no help here\r\n"))
+	c := &Conn{conn: replay}
+	if err := c.SetLineEnding("\n"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.SMTPHelp(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+	if err := c.SetLineEnding("\n\r"); err != ErrInvalidLineEnding {
+		t.Errorf("expected ErrInvalidLineEnding, got %v", err)
+	}
+
+	// STARTTLS uses the line ending too
+	replay = NewReplayConn(ReplayWrite("STARTTLS\n"), ReplayRead("454 TLS not available\r\n"))
+	c = &Conn{conn: replay, lineEnding: "\n"}
+	if err := c.SMTPStartTLSHandshake(); err == nil {
+		t.Error("expected STARTTLS to be refused")
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+	replay = NewReplayConn(ReplayWrite("STLS\n"), ReplayRead("-ERR not available\r\n"))
+	c = &Conn{conn: replay, lineEnding: "\n"}
+	if err := c.POP3StartTLSHandshake(); err == nil {
+		t.Error("expected STLS to be refused")
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+	replay = NewReplayConn(ReplayWrite("a001 STARTTLS\n"), ReplayRead("a001 NO not available\r\n"))
+	c = &Conn{conn: replay, lineEnding: "\n"}
+	if err := c.IMAPStartTLSHandshake(); err == nil {
+		t.Error("expected IMAP STARTTLS to be refused")
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	c := chunkedServer("first\r\nsec", "ond\r\n", "third\r\nfourth\r\n")
+	defer c.Close()
+	lines, err := c.ReadLines(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	if expected := []string{"first", "second", "third"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected lines %q, got %q", expected, got)
+	}
+	if !strings.HasPrefix(c.grabData.Read, "first\r\nsecond\r\nthird\r\n") {
+		t.Errorf("unexpected recorded read %q", c.grabData.Read)
+	}
+}
+
+func TestReadLinesCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := &Conn{conn: client}
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	lines, err := c.ReadLines(ctx, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go server.Write([]byte("partial"))
+	cancel()
+	for line := range lines {
+		t.Errorf("unexpected line %q", line)
+	}
+	// The deadline used to interrupt the read must not outlive ReadLines
+	go server.Write([]byte("later\r\n"))
+	if _, err := c.Read(make([]byte, 64)); err != nil {
+		t.Errorf("unexpected error reading after cancelling: %s", err)
+	}
+}
+
+func TestIMAPNamespaceAndList(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 NAMESPACE\r\n"),
+		ReplayRead("* NAMESPACE ((\"\" \".\")) ((\"~\" \".\")) ((\"#shared.\" \".\")(\"#public.\" NIL))\r\na001 OK Namespace completed.\r\n"),
+		ReplayWrite("a002 LIST \"\" \"%\"\r\n"),
+		ReplayRead("* LIST (\\HasNoChildren) \".\" INBOX\r\n* LIST (\\HasChildren \\Noselect) \".\" \"Shared \\\"Folders\\\"\"\r\n* LIST () NIL {4}\r\nodd \r\na002 OK List completed.\r\n"),
+	)}
+	ns, err := c.IMAPNamespace()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(ns.Personal, []IMAPNamespace{{Prefix: "", Delimiter: "."}}) ||
+		!reflect.DeepEqual(ns.OtherUsers, []IMAPNamespace{{Prefix: "~", Delimiter: "."}}) ||
+		!reflect.DeepEqual(ns.Shared, []IMAPNamespace{{Prefix: "#shared.", Delimiter: "."}, {Prefix: "#public."}}) {
+		t.Errorf("wrong namespaces: %+v", ns)
+	}
+	list, err := c.IMAPListRoot()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []IMAPMailbox{
+		{Name: "INBOX", Delimiter: ".", Attributes: []string{"\\HasNoChildren"}},
+		{Name: "Shared \"Folders\"", Delimiter: ".", Attributes: []string{"\\HasChildren", "\\Noselect"}},
+		{Name: "odd "},
+	}
+	if !reflect.DeepEqual(list.Mailboxes, expected) {
+		t.Errorf("wrong mailboxes: %+v", list.Mailboxes)
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 NAMESPACE\r\n"),
+		ReplayRead("a001 NO Not logged in\r\n"),
+	)}
+	if _, err := c.IMAPNamespace(); err == nil {
+		t.Error("expected an IMAPStatusError")
+	} else if _, ok := err.(*IMAPStatusError); !ok {
+		t.Errorf("expected an IMAPStatusError, got %v", err)
+	}
+}
+
+func TestIMAPLiteralResponse(t *testing.T) {
+	// The literal holds what looks like the tagged completion, and is split
+	// across reads
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 LIST \"\" \"%\"\r\n"),
+		ReplayRead("* LIST (\\HasNoChildren) \"/\" {13}\r\na001 OK Lie\r\n"),
+		ReplayRead("\r\n* LIST () \"/\" INBOX\r\n"),
+		ReplayRead("a001 OK List completed.\r\n"),
+	)}
+	list, err := c.IMAPListRoot()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []IMAPMailbox{
+		{Name: "a001 OK Lie\r\n", Delimiter: "/", Attributes: []string{"\\HasNoChildren"}},
+		{Name: "INBOX", Delimiter: "/"},
+	}
+	if !reflect.DeepEqual(list.Mailboxes, expected) {
+		t.Errorf("wrong mailboxes: %+v", list.Mailboxes)
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIMAPLines(t *testing.T) {
+	lines := imapLines("* 1 FETCH (BODY[] {5}\r\nab\r\nc)\r\na001 OK\r\n")
+	expected := []string{"* 1 FETCH (BODY[] {5}\r\nab\r\nc)", "a001 OK"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %q, got %q", expected, lines)
+	}
+	values, err := parseIMAPValues(lines[0][2:])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body := values[2].([]interface{})
+	if len(body) != 2 || body[1] != "ab\r\nc" {
+		t.Errorf("wrong literal value: %q", body)
+	}
+}
+
+func TestReadUntilFunc(t *testing.T) {
+	// Done once the parentheses balance, which a regular expression cannot
+	// express
+	balanced := func(b []byte) bool {
+		depth := 0
+		for _, ch := range b {
+			switch ch {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+		}
+		return len(b) > 0 && depth == 0
+	}
+	c := &Conn{conn: NewReplayConn(
+		ReplayRead("(a (b"),
+		ReplayRead(" c) (d))"),
+	)}
+	buf := make([]byte, 64)
+	n, err := c.ReadUntilFunc(buf, balanced)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := string(buf[0:n]); got != "(a (b c) (d))" || c.grabData.Read != got {
+		t.Errorf("wrong data read: %q", got)
+	}
+
+	c = &Conn{conn: NewReplayConn(ReplayRead("((((("))}
+	if _, err := c.ReadUntilFunc(make([]byte, 5), balanced); err != util.ErrBufferFull {
+		t.Errorf("expected util.ErrBufferFull, got %v", err)
+	}
+
+	c = &Conn{conn: NewReplayConn(ReplayRead("(a b)"))}
+	if n, err := c.ReadUntilFunc(make([]byte, 5), balanced); err != nil || n != 5 {
+		t.Errorf("expected a response filling the buffer to succeed, got %d, %v", n, err)
+	}
+}
+
+func TestSMTPProbeCommands(t *testing.T) {
+	replay := NewReplayConn(
+		ReplayWrite("NOOP\r\n"),
+		ReplayRead("250 2.0.0 OK\r\n"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 OK\r\n"),
+		ReplayWrite("VRFY postmaster\r\n"),
+		ReplayRead("252 2.1.5 Cannot VRFY user\r\n"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 OK\r\n"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 OK\r\n"),
+	)
+	c := &Conn{conn: replay}
+	codes, err := c.SMTPProbeCommands([]string{"NOOP", "VRFY postmaster", "DATA", "ETRN example.com", "MAIL FROM:<>", "XYZZY", "RSET"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]int{"NOOP": 250, "VRFY postmaster": 252, "RSET": 250}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Errorf("expected %v, got %v", expected, codes)
+	}
+	probes := c.grabData.SMTPCommands
+	if len(probes) != 7 {
+		t.Fatalf("expected seven recorded probes, got %+v", probes)
+	}
+	for _, probe := range probes[2:6] {
+		if !probe.Skipped {
+			t.Errorf("expected %q to be skipped as unsafe", probe.Command)
+		}
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+
+	replay = NewReplayConn(
+		ReplayWrite("ETRN example.com\r\n"),
+		ReplayRead("250 Queuing started\r\n"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 OK\r\n"),
+	)
+	c = &Conn{conn: replay}
+	c.SetAllowUnsafeSMTPCommands(true)
+	if codes, err := c.SMTPProbeCommands([]string{"ETRN example.com"}); err != nil || codes["ETRN example.com"] != 250 {
+		t.Errorf("expected ETRN to be sent once allowed, got %v, %v", codes, err)
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := c.SMTPProbeCommands([]string{"NOOP\r\nQUIT"}); err != ErrInvalidSMTPCommand {
+		t.Errorf("expected ErrInvalidSMTPCommand, got %v", err)
+	}
+}
+
+func TestRecordedLengthReset(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("HELLO WORLD"),
+		ReplayWrite("HI"),
+		ReplayRead("GOODBYE WORLD"),
+		ReplayRead("BYE"),
+	)}
+	c.SetMaxRecordedBytes(5)
+	c.Write([]byte("HELLO WORLD"))
+	if c.grabData.WriteLength != 11 {
+		t.Errorf("expected the truncated write length, got %d", c.grabData.WriteLength)
+	}
+	c.Write([]byte("HI"))
+	if c.grabData.Write != "HI" || c.grabData.WriteLength != 0 {
+		t.Errorf("expected a short write to clear the length, got %q and %d", c.grabData.Write, c.grabData.WriteLength)
+	}
+	buf := make([]byte, 64)
+	c.Read(buf)
+	if c.grabData.ReadLength != 13 {
+		t.Errorf("expected the truncated read length, got %d", c.grabData.ReadLength)
+	}
+	c.Read(buf)
+	if c.grabData.Read != "BYE" || c.grabData.ReadLength != 0 {
+		t.Errorf("expected a short read to clear the length, got %q and %d", c.grabData.Read, c.grabData.ReadLength)
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	replay := NewReplayConn(ReplayWrite("STARTSSL\n"))
+	c := &Conn{conn: replay}
+	c.SetMaxRecordedBytes(5)
+	if err := c.WriteRaw([]byte("STARTSSL\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+	expected := []WriteEvent{{Data: []byte("START"), Length: 9}}
+	if !reflect.DeepEqual(c.grabData.RawWrites, expected) {
+		t.Errorf("wrong write events %+v", c.grabData.RawWrites)
+	}
+
+	c.isTls = true
+	if err := c.WriteRaw([]byte("x")); err != ErrRawWriteAfterTLS {
+		t.Errorf("expected ErrRawWriteAfterTLS, got %v", err)
+	}
+}
+
+func TestHandshakeOrderingAnomalies(t *testing.T) {
+	tests := []struct {
+		received  []string
+		anomalies []string
+	}{
+		{
+			received: []string{"server_hello", "server_certificate", "server_key_exchange", "server_hello_done",
+				"server_new_session_ticket", "server_change_cipher_spec", "server_finished"},
+		},
+		{
+			received: []string{"server_hello", "server_change_cipher_spec", "server_finished"},
+		},
+		{
+			received:  []string{"server_certificate", "server_hello"},
+			anomalies: []string{"server_certificate before server_hello", "server_hello after server_certificate"},
+		},
+		{
+			received:  []string{"server_hello", "server_hello"},
+			anomalies: []string{"duplicate server_hello"},
+		},
+		{
+			received:  []string{"server_hello", "server_certificate", "server_change_cipher_spec"},
+			anomalies: []string{"early server_change_cipher_spec"},
+		},
+	}
+	for _, test := range tests {
+		if anomalies := handshakeOrderingAnomalies(test.received); !reflect.DeepEqual(anomalies, test.anomalies) {
+			t.Errorf("%q: expected %q, got %q", test.received, test.anomalies, anomalies)
+		}
+	}
+	if _, err := new(Conn).CheckHandshakeOrdering(); err != ErrNoTLSHandshake {
+		t.Errorf("expected ErrNoTLSHandshake, got %v", err)
+	}
+}
+
+func TestServerTLSFingerprint(t *testing.T) {
+	c := new(Conn)
+	if fp := c.ServerTLSFingerprint(); fp != "" {
+		t.Errorf("expected no fingerprint without a handshake, got %q", fp)
+	}
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{
+		ServerHello: &ztls.ServerHello{
+			Version:      ztls.VersionTLS12,
+			CipherSuite:  0xc02f,
+			ExtensionIDs: []uint16{0xff01, 0x0000, 0x000b, 0x0023},
+		},
+	}
+	// md5("771,49199,65281-0-11-35")
+	const expected = "a2c05b7498f29a65608835b44035c0c5"
+	if fp := c.ServerTLSFingerprint(); fp != expected {
+		t.Errorf("expected %s, got %s", expected, fp)
+	}
+	if c.grabData.TLSHandshake.JA3S != expected {
+		t.Error("fingerprint was not recorded in the handshake log")
+	}
+}
+
+func TestIMAPCheckIdle(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 IDLE\r\n"),
+		ReplayRead("* 4 EXISTS\r\n+ idling\r\n"),
+		ReplayWrite("DONE\r\n"),
+		ReplayRead("a001 OK IDLE terminated\r\n"),
+	)}
+	if ok, err := c.IMAPCheckIdle(); !ok || err != nil {
+		t.Fatalf("expected IDLE to work, got %t and %v", ok, err)
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("a001 IDLE\r\n"),
+		ReplayRead("a001 BAD Unknown command\r\n"),
+	)}
+	if ok, err := c.IMAPCheckIdle(); ok || err == nil {
+		t.Errorf("expected an IMAPStatusError, got %t and %v", ok, err)
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Read(make([]byte, 64))
+	c = &Conn{conn: client}
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if ok, err := c.IMAPCheckIdle(); ok || err != nil || !c.grabData.IMAPIdle.TimedOut {
+		t.Errorf("expected a timeout, got %t and %v", ok, err)
+	}
+}
+
+func TestFTPFeat(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayRead("220 ProFTPD Server ready.\r\n"),
+		ReplayWrite("FEAT\r\n"),
+		ReplayRead("211-Features:\r\n MDTM\r\n AUTH TLS\r\n UTF8\r\n211 End\r\n"),
+	)}
+	if ok, err := c.FTPBanner(); !ok || err != nil {
+		t.Fatalf("expected a 2xx banner, got %t and %v", ok, err)
+	}
+	features, err := c.FTPFeat()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := []string{"MDTM", "AUTH TLS", "UTF8"}; !reflect.DeepEqual(features, expected) {
+		t.Errorf("expected %q, got %q", expected, features)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("FEAT\r\n"),
+		ReplayRead("500 FEAT not understood\r\n"),
+	)}
+	if features, err = c.FTPFeat(); features != nil || err != nil {
+		t.Errorf("expected no features, got %q and %v", features, err)
+	}
+}
+
+func TestSMTPResetOnError(t *testing.T) {
+	c := &Conn{conn: NewReplayConn(
+		ReplayWrite("MAIL FROM:<>\r\n"),
+		ReplayRead("451 4.3.0 Try again later\r\n"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 Ok\r\n"),
+	)}
+	if _, _, err := c.SMTPProbeRecipient("nobody@example.com"); err == nil {
+		t.Error("expected MAIL FROM to be rejected")
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("MAIL FROM:<>\r\n"),
+		ReplayRead("250 2.1.0 Ok\r\n"),
+		ReplayWrite("RCPT TO:<nobody@example.com>\r\n"),
+		ReplayRead("55"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 Ok\r\n"),
+	)}
+	if _, _, err := c.SMTPProbeRecipient("nobody@example.com"); err == nil {
+		t.Error("expected the RCPT response to fail")
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+	if c.smtpMailSent {
+		t.Error("expected the transaction to be closed")
+	}
+
+	c = &Conn{conn: NewReplayConn(
+		ReplayWrite("MAIL FROM:<>\r\n"),
+		ReplayRead("5"),
+		ReplayWrite("RSET\r\n"),
+		ReplayRead("250 2.0.0 Ok\r\n"),
+	)}
+	c.grabData.EHLO = "250 mx.example.com\r\n"
+	if _, err := c.SMTPRequiresAuth(); err == nil {
+		t.Error("expected the MAIL FROM response to fail")
+	}
+	if err := c.conn.(*ReplayConn).Done(); err != nil {
+		t.Error(err)
+	}
+}
@@ -15,27 +15,115 @@
 package zlib
 
 import (
+	"errors"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultPorts maps the protocols zgrab speaks to their well known ports
+var DefaultPorts = map[string]uint16{
+	"bacnet":     47808,
+	"dnp3":       20000,
+	"dns":        53,
+	"fox":        1911,
+	"ftp":        21,
+	"http":       80,
+	"https":      443,
+	"imap":       143,
+	"imaps":      993,
+	"modbus":     502,
+	"mqtt":       1883,
+	"mysql":      3306,
+	"pop3":       110,
+	"pop3s":      995,
+	"s7":         102,
+	"smtp":       25,
+	"smtps":      465,
+	"ssh":        22,
+	"submission": 587,
+	"telnet":     23,
+	"whois":      43,
+}
+
+// ErrNoDefaultPort is returned by Dial when the address has no port and
+// there is no default port for the dialer's protocol
+var ErrNoDefaultPort = errors.New("address has no port and the protocol has no default port")
+
 type Dialer struct {
 	Deadline  time.Time
 	Timeout   time.Duration
 	LocalAddr net.Addr
 	DualStack bool
 	KeepAlive time.Duration
+
+	// Protocol, if set, picks the port for addresses given without one,
+	// from Ports or else DefaultPorts
+	Protocol string
+	Ports    map[string]uint16
 }
 
+// resolveAddress appends the default port for the dialer's protocol to an
+// address without a port. ok is false if address was left unchanged.
+func (d *Dialer) resolveAddress(address string) (resolved string, ok bool, err error) {
+	if d.Protocol == "" {
+		return address, false, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address, false, nil
+	}
+	proto := strings.ToLower(d.Protocol)
+	port, found := d.Ports[proto]
+	if !found {
+		port, found = DefaultPorts[proto]
+	}
+	if !found {
+		return address, false, ErrNoDefaultPort
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), true, nil
+}
+
+// anyPort returns addr with its port cleared. Probes dial again while the
+// first connection is still open, and reusing a fixed local port for the
+// same remote would fail with EADDRINUSE.
+func anyPort(addr net.Addr) net.Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &net.TCPAddr{IP: a.IP, Zone: a.Zone}
+	case *net.UDPAddr:
+		return &net.UDPAddr{IP: a.IP, Zone: a.Zone}
+	}
+	return addr
+}
+
+// Dial connects to address. If the dialer has a Protocol and address has no
+// port, the protocol's default port is used and the resulting address is
+// recorded.
 func (d *Dialer) Dial(network, address string) (*Conn, error) {
 	c := &Conn{}
+	address, defaulted, err := d.resolveAddress(address)
+	if err != nil {
+		return c, err
+	}
+	if defaulted {
+		c.grabData.DialAddress = address
+	}
 	netDialer := net.Dialer{
 		Deadline:  d.Deadline,
 		Timeout:   d.Timeout,
 		LocalAddr: d.LocalAddr,
 		KeepAlive: d.KeepAlive,
 	}
-	var err error
 	c.conn, err = netDialer.Dial(network, address)
+	redialer := netDialer
+	redialer.LocalAddr = anyPort(d.LocalAddr)
+	c.dial = func() (net.Conn, error) {
+		return redialer.Dial(network, address)
+	}
+	if err == nil && d.LocalAddr != nil {
+		c.grabData.LocalAddr = c.conn.LocalAddr().String()
+	}
 	return c, err
 }
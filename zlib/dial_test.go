@@ -0,0 +1,98 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestResolveAddress(t *testing.T) {
+	d := &Dialer{Protocol: "IMAP", Ports: map[string]uint16{"pop3": 1110}}
+	tests := []struct {
+		address  string
+		expected string
+		ok       bool
+	}{
+		{"mail.example.com", "mail.example.com:143", true},
+		{"mail.example.com:993", "mail.example.com:993", false},
+		{"2001:db8::1", "[2001:db8::1]:143", true},
+		{"[2001:db8::1]", "[2001:db8::1]:143", true},
+	}
+	for _, test := range tests {
+		resolved, ok, err := d.resolveAddress(test.address)
+		if err != nil || resolved != test.expected || ok != test.ok {
+			t.Errorf("%s: expected %s and %t, got %s, %t and %v", test.address, test.expected, test.ok, resolved, ok, err)
+		}
+	}
+
+	d.Protocol = "pop3"
+	if resolved, _, _ := d.resolveAddress("10.0.0.1"); resolved != "10.0.0.1:1110" {
+		t.Errorf("expected the dialer's own port to win, got %s", resolved)
+	}
+	d.Protocol = "gopher"
+	if _, _, err := d.resolveAddress("10.0.0.1"); err != ErrNoDefaultPort {
+		t.Errorf("expected ErrNoDefaultPort, got %v", err)
+	}
+	d.Protocol = ""
+	if resolved, ok, _ := d.resolveAddress("10.0.0.1"); resolved != "10.0.0.1" || ok {
+		t.Errorf("expected the address to be left alone, got %s", resolved)
+	}
+}
+
+func TestDialFixedLocalPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Hold every connection open until the listener closes
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// Find a free local port to pin the first connection to
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := free.Addr().(*net.TCPAddr)
+	free.Close()
+
+	d := &Dialer{LocalAddr: local}
+	c, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	if c.grabData.LocalAddr != local.String() {
+		t.Errorf("expected local address %s, got %s", local, c.grabData.LocalAddr)
+	}
+
+	again, err := c.dial()
+	if err != nil {
+		t.Fatalf("expected the re-dial to pick another port, got %s", err)
+	}
+	defer again.Close()
+	if addr := again.LocalAddr().(*net.TCPAddr); !addr.IP.Equal(local.IP) || addr.Port == local.Port {
+		t.Errorf("expected %s with another port, got %s", local.IP, addr)
+	}
+}
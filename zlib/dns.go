@@ -0,0 +1,169 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	dnsTypeTXT    = 16
+	dnsClassCHAOS = 3
+
+	// Responses are read in full, so keep them bounded
+	dnsMaxMessageSize = 16 * 1024
+)
+
+var ErrInvalidDNSName = errors.New("invalid DNS name")
+
+var ErrDNSBadResponse = errors.New("malformed DNS response")
+
+// ErrDNSNoAnswer is returned by DNSChaosQuery when the response has no TXT
+// record, for instance because the server refused the query.
+var ErrDNSNoAnswer = errors.New("DNS response has no TXT answer")
+
+// A DNSChaosEvent represents a CHAOS class TXT query, such as version.bind,
+// and the server's answer
+type DNSChaosEvent struct {
+	Name    string `json:"name"`
+	RawData []byte `json:"raw_data,omitempty"`
+	RCode   int    `json:"rcode"`
+	Answer  string `json:"answer,omitempty"`
+}
+
+// dnsQuery builds a DNS query message with recursion not desired
+func dnsQuery(id uint16, name string, qtype, qclass uint16) ([]byte, error) {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, ErrInvalidDNSName
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qtype>>8), byte(qtype), byte(qclass>>8), byte(qclass))
+	return msg, nil
+}
+
+// skipDNSName returns the offset just past the possibly compressed name
+// starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, ErrDNSBadResponse
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xC0 == 0xC0:
+			return off + 2, nil
+		case l&0xC0 != 0:
+			return 0, ErrDNSBadResponse
+		}
+		off += 1 + l
+	}
+}
+
+// parseDNSTXTResponse returns the RCODE of a response to the query with id,
+// and the strings of its first TXT answer joined together.
+func parseDNSTXTResponse(msg []byte, id uint16) (rcode int, txt string, err error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[0:2]) != id || msg[2]&0x80 == 0 {
+		return 0, "", ErrDNSBadResponse
+	}
+	rcode = int(msg[3] & 0x0F)
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return rcode, "", err
+		}
+		off += 4
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return rcode, "", err
+		}
+		if off+10 > len(msg) {
+			return rcode, "", ErrDNSBadResponse
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off : off+2])
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return rcode, "", ErrDNSBadResponse
+		}
+		if rrtype != dnsTypeTXT {
+			off += rdlength
+			continue
+		}
+		rdata := msg[off : off+rdlength]
+		for len(rdata) > 0 {
+			l := int(rdata[0])
+			if 1+l > len(rdata) {
+				return rcode, "", ErrDNSBadResponse
+			}
+			txt += string(rdata[1 : 1+l])
+			rdata = rdata[1+l:]
+		}
+		return rcode, txt, nil
+	}
+	return rcode, "", ErrDNSNoAnswer
+}
+
+// DNSChaosQuery sends a CHAOS class TXT query for name, usually version.bind
+// or hostname.bind, over TCP and returns the TXT answer.
+func (c *Conn) DNSChaosQuery(name string) (string, error) {
+	event := &DNSChaosEvent{Name: name}
+	c.grabData.DNSChaos = event
+	var idBytes [2]byte
+	rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query, err := dnsQuery(id, name, dnsTypeTXT, dnsClassCHAOS)
+	if err != nil {
+		return "", err
+	}
+
+	// Messages over TCP are prefixed with their length
+	packet := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(packet, uint16(len(query)))
+	if _, err := c.getUnderlyingConn().Write(append(packet, query...)); err != nil {
+		return "", err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(c.getUnderlyingConn(), length[:]); err != nil {
+		return "", err
+	}
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size > dnsMaxMessageSize {
+		return "", ErrDNSBadResponse
+	}
+	msg := make([]byte, size)
+	n, err := io.ReadFull(c.getUnderlyingConn(), msg)
+	event.RawData = c.recordRaw(msg[0:n])
+	if err != nil {
+		return "", err
+	}
+	event.RCode, event.Answer, err = parseDNSTXTResponse(msg, id)
+	return event.Answer, err
+}
@@ -0,0 +1,71 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// dnsChaosServer answers one DNS query over TCP with a TXT record holding
+// answer.
+func dnsChaosServer(answer string) *Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		var length [2]byte
+		if _, err := io.ReadFull(server, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(server, query); err != nil {
+			return
+		}
+		res := append([]byte(nil), query...)
+		res[2], res[3] = 0x84, 0x00
+		res[7] = 1
+		res = append(res, 0xC0, 0x0C, 0x00, dnsTypeTXT, 0x00, dnsClassCHAOS, 0, 0, 0, 0)
+		res = append(res, 0x00, byte(len(answer)+1), byte(len(answer)))
+		res = append(res, answer...)
+		binary.BigEndian.PutUint16(length[:], uint16(len(res)))
+		server.Write(append(length[:], res...))
+	}()
+	return &Conn{conn: client}
+}
+
+func TestDNSChaosQuery(t *testing.T) {
+	c := dnsChaosServer("9.18.1")
+	defer c.Close()
+	answer, err := c.DNSChaosQuery("version.bind")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if answer != "9.18.1" {
+		t.Errorf("expected 9.18.1, got %q", answer)
+	}
+	if c.grabData.DNSChaos == nil || c.grabData.DNSChaos.RCode != 0 {
+		t.Errorf("unexpected event %+v", c.grabData.DNSChaos)
+	}
+}
+
+func TestDNSQueryInvalidName(t *testing.T) {
+	for _, name := range []string{"", "version..bind", string(make([]byte, 64)) + ".bind"} {
+		if _, err := dnsQuery(1, name, dnsTypeTXT, dnsClassCHAOS); err != ErrInvalidDNSName {
+			t.Errorf("expected ErrInvalidDNSName for %q, got %v", name, err)
+		}
+	}
+}
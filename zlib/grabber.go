@@ -104,6 +104,19 @@ func NewGrabTargetDecoder(reader io.Reader, domainOnly bool) processing.Decoder
 	}
 }
 
+// localAddrFor converts the configured local address to the address type
+// expected when dialing proto.
+func localAddrFor(proto string, addr net.Addr) net.Addr {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr
+	}
+	if proto == "udp" {
+		return &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+	}
+	return tcpAddr
+}
+
 func makeDialer(c *Config) func(string) (*Conn, error) {
 	proto := "tcp"
 	if c.BACNet {
@@ -113,7 +126,8 @@ func makeDialer(c *Config) func(string) (*Conn, error) {
 	return func(addr string) (*Conn, error) {
 		deadline := time.Now().Add(timeout)
 		d := Dialer{
-			Deadline: deadline,
+			Deadline:  deadline,
+			LocalAddr: localAddrFor(proto, c.LocalAddr),
 		}
 		conn, err := d.Dial(proto, addr)
 		conn.maxTlsVersion = c.TLSVersion
@@ -130,7 +144,8 @@ func makeNetDialer(c *Config) func(string, string) (net.Conn, error) {
 	return func(net, addr string) (net.Conn, error) {
 		deadline := time.Now().Add(timeout)
 		d := Dialer{
-			Deadline: deadline,
+			Deadline:  deadline,
+			LocalAddr: localAddrFor(proto, c.LocalAddr),
 		}
 		conn, err := d.Dial(proto, addr)
 		conn.maxTlsVersion = c.TLSVersion
@@ -145,6 +160,9 @@ func makeTLSConfig(config *Config, urlHost string) *ztls.Config {
 	tlsConfig := new(ztls.Config)
 	tlsConfig.InsecureSkipVerify = true
 	tlsConfig.MinVersion = ztls.VersionSSL30
+	if config.TLSDisableSSLv3 {
+		tlsConfig.MinVersion = ztls.VersionTLS10
+	}
 	tlsConfig.MaxVersion = config.TLSVersion
 	tlsConfig.RootCAs = config.RootCAPool
 	tlsConfig.HeartbeatEnabled = true
@@ -188,6 +206,9 @@ func makeTLSConfig(config *Config, urlHost string) *ztls.Config {
 	if config.GatherSessionTicket {
 		tlsConfig.ForceSessionTicketExt = true
 	}
+	if config.TLSOfferCompression {
+		tlsConfig.OfferCompression = true
+	}
 	if !config.NoSNI && urlHost != "" {
 		tlsConfig.ServerName = urlHost
 	}
@@ -205,6 +226,33 @@ func containsPort(host string) bool {
 	return strings.LastIndex(host, ":") > strings.LastIndex(host, "]")
 }
 
+// recordHTTPBody stores the body read from res, decoding it first if it was
+// sent compressed.
+func recordHTTPBody(res *http.Response, body string, maxSize int) {
+	if decoded, ok := decodeHTTPBody([]byte(body), res.Headers.Get("Content-Encoding"), maxSize); ok {
+		body = string(decoded)
+		res.Encoded = true
+	}
+	res.BodyText = body
+	m := sha256.New()
+	m.Write([]byte(body))
+	res.BodySHA256 = m.Sum(nil)
+}
+
+// gzipRequester asks for a gzip body as the transport itself would, but
+// leaves the response as sent so recordHTTPBody decodes it, caps its size
+// and marks it encoded.
+type gzipRequester struct {
+	transport http.RoundTripper
+}
+
+func (g gzipRequester) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Headers.Get("Accept-Encoding") == "" {
+		req.Headers.Set("Accept-Encoding", "gzip")
+	}
+	return g.transport.RoundTrip(req)
+}
+
 func makeHTTPGrabber(config *Config, grabData GrabData) func(string, string, string) error {
 	g := func(urlHost, endpoint, httpHost string) (err error) {
 
@@ -217,7 +265,7 @@ func makeHTTPGrabber(config *Config, grabData GrabData) func(string, string, str
 			Proxy:               nil, // TODO: implement proxying
 			Dial:                makeNetDialer(config),
 			DisableKeepAlives:   false,
-			DisableCompression:  false,
+			DisableCompression:  true,
 			MaxIdleConnsPerHost: -1,
 			TLSClientConfig:     tlsConfig,
 		}
@@ -229,16 +277,20 @@ func makeHTTPGrabber(config *Config, grabData GrabData) func(string, string, str
 			if str, err := util.ReadString(res.Body, config.HTTP.MaxSize*1024); err != nil {
 				return err
 			} else {
-				res.BodyText = str
-				m := sha256.New()
-				m.Write([]byte(str))
-				res.BodySHA256 = m.Sum(nil)
+				recordHTTPBody(res, str, config.HTTP.MaxSize*1024)
 			}
 			res.Body.Close()
 
 			if len(via) > config.HTTP.MaxRedirects {
+				grabData.HTTP.RedirectsTruncated = true
 				return errors.New(fmt.Sprintf("stopped after %d redirects", config.HTTP.MaxRedirects))
 			}
+			for _, prev := range via {
+				if prev.URL.String() == req.URL.String() {
+					grabData.HTTP.RedirectLoop = true
+					return errors.New("stopped at redirect loop to " + req.URL.String())
+				}
+			}
 
 			if req.URL.Scheme == "https" && transport.TLSClientConfig == nil {
 				transport.TLSClientConfig = makeTLSConfig(config, req.URL.Host)
@@ -247,7 +299,7 @@ func makeHTTPGrabber(config *Config, grabData GrabData) func(string, string, str
 			return nil
 		}
 		client.Jar = nil // Don't send or receive cookies (otherwise use CookieJar)
-		client.Transport = transport
+		client.Transport = gzipRequester{transport}
 
 		var fullURL string
 
@@ -296,10 +348,7 @@ func makeHTTPGrabber(config *Config, grabData GrabData) func(string, string, str
 		if str, err := util.ReadString(resp.Body, config.HTTP.MaxSize*1024); err != nil {
 			return err
 		} else {
-			grabData.HTTP.Response.BodyText = str
-			m := sha256.New()
-			m.Write([]byte(str))
-			grabData.HTTP.Response.BodySHA256 = m.Sum(nil)
+			recordHTTPBody(grabData.HTTP.Response, str, config.HTTP.MaxSize*1024)
 		}
 
 		resp.Body.Close()
@@ -357,8 +406,17 @@ func makeGrabber(config *Config) func(*Conn) error {
 		if config.GatherSessionTicket {
 			c.SetGatherSessionTicket()
 		}
-		if config.ExtendedMasterSecret {
-			c.SetOfferExtendedMasterSecret()
+		if config.TLSOfferCompression {
+			c.SetOfferCompression(true)
+		}
+		if config.TLSDisableSSLv3 {
+			c.DisableSSLv3()
+		}
+		if config.TLSCheckCloseNotify {
+			c.SetCheckCloseNotify()
+		}
+		if config.TLSRecordHandshakeBytes {
+			c.SetRecordHandshakeBytes()
 		}
 		if config.TLSVerbose {
 			c.SetTLSVerbose()
@@ -368,6 +426,16 @@ func makeGrabber(config *Config) func(*Conn) error {
 			c.sshScan = &config.SSH
 		}
 		c.ReadEncoding = config.Encoding
+		c.SetBannerTimeout(config.BannerTimeout)
+		c.SetMaxRecordedBytes(config.MaxRecordedBytes)
+		c.SetMaxReadCalls(config.MaxReadCalls)
+		if config.ProxyHeader > 0 {
+			c.SetProxyHeaderVersion(config.ProxyHeader)
+			if err := c.SendProxyHeader(c.LocalAddr(), c.RemoteAddr()); err != nil {
+				c.erroredComponent = "proxy_header"
+				return err
+			}
+		}
 		if config.TLS {
 			if err := c.TLSHandshake(); err != nil {
 				c.erroredComponent = "tls"
@@ -407,6 +475,13 @@ func makeGrabber(config *Config) func(*Conn) error {
 				return err
 			}
 
+			if config.FTPFeat && is200Banner {
+				if _, err := c.FTPFeat(); err != nil {
+					c.erroredComponent = "ftp-feat"
+					return err
+				}
+			}
+
 			if config.FTPAuthTLS && is200Banner {
 				if err := c.GetFTPSCertificates(); err != nil {
 					c.erroredComponent = "ftp-authtls"
@@ -468,6 +543,11 @@ func makeGrabber(config *Config) func(*Conn) error {
 			}
 		}
 
+		if config.Banners || config.SendData {
+			text := []byte(c.grabData.Banner + c.grabData.Read)
+			c.grabData.PEMCertificates = ExtractPEMCertificates(text)
+		}
+
 		if config.EHLO {
 			if err := c.EHLO(config.EHLODomain); err != nil {
 				c.erroredComponent = "ehlo"
@@ -491,6 +571,11 @@ func makeGrabber(config *Config) func(*Conn) error {
 					c.erroredComponent = "starttls"
 					return err
 				}
+			} else if config.SMTPRecheckEHLO {
+				if err := c.SMTPStartTLSRecheck(config.EHLODomain); err != nil {
+					c.erroredComponent = "starttls"
+					return err
+				}
 			} else {
 				if err := c.SMTPStartTLSHandshake(); err != nil {
 					c.erroredComponent = "starttls"
@@ -506,6 +591,48 @@ func makeGrabber(config *Config) func(*Conn) error {
 			}
 		}
 
+		if config.WHOISQuery != "" {
+			if _, err := c.WHOISQuery(config.WHOISQuery); err != nil {
+				c.erroredComponent = "whois"
+				return err
+			}
+		}
+
+		if config.DNSChaosQuery != "" {
+			if _, err := c.DNSChaosQuery(config.DNSChaosQuery); err != nil {
+				c.erroredComponent = "dns_chaos"
+				return err
+			}
+		}
+
+		if config.MQTT {
+			if _, err := c.MQTTConnect(config.MQTTClientID); err != nil {
+				c.erroredComponent = "mqtt"
+				return err
+			}
+		}
+
+		if config.MySQL {
+			if _, err := c.MySQLHandshake(); err != nil {
+				c.erroredComponent = "mysql"
+				return err
+			}
+		}
+
+		if config.RDP {
+			event, err := c.RDPNegotiate()
+			if err != nil {
+				c.erroredComponent = "rdp"
+				return err
+			}
+			if event.UsesTLS() {
+				if err := c.TLSHandshake(); err != nil {
+					c.erroredComponent = "tls"
+					return err
+				}
+			}
+		}
+
 		if config.BACNet {
 			if err := c.BACNetVendorQuery(); err != nil {
 				c.erroredComponent = "bacnet"
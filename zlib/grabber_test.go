@@ -1,6 +1,7 @@
 package zlib_test
 
 import (
+	"compress/gzip"
 	"fmt"
 	"github.com/zmap/zgrab/zlib"
 	. "github.com/zmap/zgrab/ztools/http"
@@ -176,4 +177,82 @@ func TestHTTPToHTTPSRedirect(t *testing.T) {
 	}
 }
 
+func grabRedirects(t *testing.T, handler HandlerFunc, maxRedirects int) *zlib.HTTP {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	addr, port := getAddrAndPortForServer(server)
+
+	config := &zlib.Config{
+		Port:               port,
+		Timeout:            time.Duration(3) * time.Second,
+		TLSVersion:         ztls.VersionTLS12,
+		Senders:            1,
+		ConnectionsPerHost: 1,
+		HTTP: zlib.HTTPConfig{
+			Endpoint:     "/",
+			Method:       "GET",
+			UserAgent:    "test UA",
+			MaxSize:      256,
+			MaxRedirects: maxRedirects,
+		},
+		ErrorLog:   zlog.New(os.Stderr, "banner-grab"),
+		GOMAXPROCS: 1,
+	}
+	grab := zlib.GrabBanner(config, &zlib.GrabTarget{Addr: addr})
+	return grab.Data.HTTP
+}
+
+func TestHTTPRedirectLoop(t *testing.T) {
+	httpData := grabRedirects(t, func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/" {
+			Redirect(w, r, "/a", StatusFound)
+		} else {
+			Redirect(w, r, "/", StatusFound)
+		}
+	}, 5)
+	if !httpData.RedirectLoop {
+		t.Error("expected a redirect loop")
+	}
+	if httpData.RedirectsTruncated {
+		t.Error("expected the loop to stop before the redirect limit")
+	}
+	if len(httpData.RedirectResponseChain) != 2 {
+		t.Errorf("expected 2 redirects, got %d", len(httpData.RedirectResponseChain))
+	}
+}
+
+func TestHTTPRedirectLimit(t *testing.T) {
+	httpData := grabRedirects(t, func(w ResponseWriter, r *Request) {
+		Redirect(w, r, r.URL.Path+"a", StatusFound)
+	}, 2)
+	if !httpData.RedirectsTruncated {
+		t.Error("expected the redirect chain to be truncated")
+	}
+	if httpData.RedirectLoop {
+		t.Error("unexpected redirect loop")
+	}
+	if len(httpData.RedirectResponseChain) != 3 {
+		t.Errorf("expected 3 redirects, got %d", len(httpData.RedirectResponseChain))
+	}
+}
+
+func TestHTTPGzipBody(t *testing.T) {
+	httpData := grabRedirects(t, func(w ResponseWriter, r *Request) {
+		if r.Headers.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("expected gzip to be requested, got %q", r.Headers.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		fmt.Fprint(gz, TEST_SERVER_BODY)
+		gz.Close()
+	}, 0)
+	res := httpData.Response
+	if res.BodyText != TEST_SERVER_BODY || !res.Encoded {
+		t.Errorf("expected the decoded body to be marked encoded, got %q and %t", res.BodyText, res.Encoded)
+	}
+	if res.Headers.Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the Content-Encoding header to be kept, got %s", res.Headers)
+	}
+}
+
 // TODO: add tests for more complex HTTP behavior/options
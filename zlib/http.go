@@ -15,11 +15,17 @@
 package zlib
 
 import (
-	"github.com/zmap/zgrab/ztools/http"
-	"github.com/zmap/zgrab/ztools/util"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"strings"
+
+	"github.com/zmap/zgrab/ztools/http"
+	"github.com/zmap/zgrab/ztools/util"
 )
 
 var knownHeaders map[string]int
@@ -75,6 +81,39 @@ type HTTPResponse struct {
 	Headers      HTTPHeaders `json:"headers,omitempty"`
 	Body         string      `json:"body,omitempty"`
 	BodySHA256   []byte      `json:"body_sha256,omitempty"`
+	Encoded      bool        `json:"body_encoded,omitempty"`
+}
+
+// decodeHTTPBody decodes a body sent with a gzip or deflate Content-Encoding.
+// At most maxSize bytes are decoded, so a small compressed body cannot expand
+// without bound. ok is false if the body was not encoded or did not decode,
+// in which case it should be kept as is.
+func decodeHTTPBody(body []byte, contentEncoding string, maxSize int) (decoded []byte, ok bool) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false
+		}
+		r = gz
+	case "deflate":
+		// Deflate is meant to be zlib wrapped, but some servers send raw
+		// deflate data. Skip the two byte zlib header when there is one.
+		if len(body) >= 2 && body[0]&0x0F == 8 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0 {
+			body = body[2:]
+		}
+		r = flate.NewReader(bytes.NewReader(body))
+	default:
+		return nil, false
+	}
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)))
+	// The body may have been cut off at the read limit, so keep whatever
+	// decoded before the data ran out
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, false
+	}
+	return decoded, true
 }
 
 type HTTP struct {
@@ -82,6 +121,11 @@ type HTTP struct {
 	ProxyResponse         *HTTPResponse    `json:"connect_response,omitempty"`
 	Response              *http.Response   `json:"response,omitempty"`
 	RedirectResponseChain []*http.Response `json:"redirect_response_chain,omitempty"`
+
+	// Set when redirects stopped at the --http-max-redirects limit, or on a
+	// redirect back to a URL already requested
+	RedirectsTruncated bool `json:"redirects_truncated,omitempty"`
+	RedirectLoop       bool `json:"redirect_loop,omitempty"`
 }
 
 type HTTPRequestResponse struct {
@@ -0,0 +1,47 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHTTPBodyGzip(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("<html><title>router login</title></html>"))
+	w.Close()
+	decoded, ok := decodeHTTPBody(buf.Bytes(), "gzip", 1024)
+	if !ok || string(decoded) != "<html><title>router login</title></html>" {
+		t.Errorf("wrong decoded body %q", decoded)
+	}
+	if _, ok := decodeHTTPBody([]byte("plain"), "", 1024); ok {
+		t.Error("expected an unencoded body to be left alone")
+	}
+}
+
+func TestDecodeHTTPBodySizeCap(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(strings.Repeat("A", 1<<20)))
+	w.Close()
+	decoded, ok := decodeHTTPBody(buf.Bytes(), "gzip", 4096)
+	if !ok || len(decoded) != 4096 {
+		t.Errorf("expected 4096 decoded bytes, got %d", len(decoded))
+	}
+}
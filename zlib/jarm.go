@@ -0,0 +1,427 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A JARMEvent records the ten JARM probe results and the fingerprint built
+// from them. Each probe result is the selected cipher suite, version, ALPN
+// and extension types separated by |, and is empty (|||) if the server did
+// not answer the probe with a ServerHello.
+type JARMEvent struct {
+	Probes      []string `json:"probes"`
+	Fingerprint string   `json:"fingerprint"`
+}
+
+type jarmProbe struct {
+	version      uint16
+	cipherList   string
+	cipherOrder  string
+	grease       bool
+	rareALPN     bool
+	supportLevel string
+	extOrder     string
+}
+
+// jarmProbes are the standard JARM probes, in the order their results are
+// combined into the fingerprint.
+var jarmProbes = []jarmProbe{
+	{0x0303, "ALL", "FORWARD", false, false, "1.2_SUPPORT", "REVERSE"},
+	{0x0303, "ALL", "REVERSE", false, false, "1.2_SUPPORT", "FORWARD"},
+	{0x0303, "ALL", "TOP_HALF", false, false, "NO_SUPPORT", "FORWARD"},
+	{0x0303, "ALL", "BOTTOM_HALF", false, true, "NO_SUPPORT", "FORWARD"},
+	{0x0303, "ALL", "MIDDLE_OUT", true, true, "NO_SUPPORT", "REVERSE"},
+	{0x0302, "ALL", "FORWARD", false, false, "NO_SUPPORT", "FORWARD"},
+	{0x0304, "ALL", "FORWARD", false, false, "1.3_SUPPORT", "REVERSE"},
+	{0x0304, "ALL", "REVERSE", false, false, "1.3_SUPPORT", "FORWARD"},
+	{0x0304, "NO1.3", "FORWARD", false, false, "1.3_SUPPORT", "FORWARD"},
+	{0x0304, "ALL", "MIDDLE_OUT", true, false, "1.3_SUPPORT", "REVERSE"},
+}
+
+// jarmCiphers is the ALL cipher list. The NO1.3 list omits the TLS 1.3
+// suites 0x1301 to 0x1305.
+var jarmCiphers = []uint16{
+	0x0016, 0x0033, 0x0067, 0xc09e, 0xc0a2, 0x009e, 0x0039, 0x006b,
+	0xc09f, 0xc0a3, 0x009f, 0x0045, 0x00be, 0x0088, 0x00c4, 0x009a,
+	0xc008, 0xc009, 0xc023, 0xc0ac, 0xc0ae, 0xc02b, 0xc00a, 0xc024,
+	0xc0ad, 0xc0af, 0xc02c, 0xc072, 0xc073, 0xcca9, 0x1302, 0x1301,
+	0xcc14, 0xc007, 0xc012, 0xc013, 0xc027, 0xc02f, 0xc014, 0xc028,
+	0xc030, 0xc060, 0xc061, 0xc076, 0xc077, 0xcca8, 0x1305, 0x1304,
+	0x1303, 0xcc13, 0xc011, 0x000a, 0x002f, 0x003c, 0xc09c, 0xc0a0,
+	0x009c, 0x0035, 0x003d, 0xc09d, 0xc0a1, 0x009d, 0x0041, 0x00ba,
+	0x0084, 0x00c0, 0x0007, 0x0004, 0x0005,
+}
+
+// jarmCipherIndex is the order used to compress the selected cipher suite
+// into the fingerprint.
+var jarmCipherIndex = []uint16{
+	0x0004, 0x0005, 0x0007, 0x000a, 0x0016, 0x002f, 0x0033, 0x0035,
+	0x0039, 0x003c, 0x003d, 0x0041, 0x0045, 0x0067, 0x006b, 0x0084,
+	0x0088, 0x009a, 0x009c, 0x009d, 0x009e, 0x009f, 0x00ba, 0x00be,
+	0x00c0, 0x00c4, 0xc007, 0xc008, 0xc009, 0xc00a, 0xc011, 0xc012,
+	0xc013, 0xc014, 0xc023, 0xc024, 0xc027, 0xc028, 0xc02b, 0xc02c,
+	0xc02f, 0xc030, 0xc060, 0xc061, 0xc072, 0xc073, 0xc076, 0xc077,
+	0xc09c, 0xc09d, 0xc09e, 0xc09f, 0xc0a0, 0xc0a1, 0xc0a2, 0xc0a3,
+	0xc0ac, 0xc0ad, 0xc0ae, 0xc0af, 0xcc13, 0xcc14, 0xcca8, 0xcca9,
+	0x1301, 0x1302, 0x1303, 0x1304, 0x1305,
+}
+
+var jarmALPNs = []string{"http/0.9", "http/1.0", "http/1.1", "spdy/1", "spdy/2", "spdy/3", "h2", "h2c", "hq"}
+
+var jarmRareALPNs = []string{"http/0.9", "http/1.0", "spdy/1", "spdy/2", "spdy/3", "h2c", "hq"}
+
+// jarmMaxResponse is how much of the server's reply is read for each probe
+const jarmMaxResponse = 1484
+
+const jarmEmptyProbe = "|||"
+
+// jarmReorder returns the entries of s in the named JARM order. The caller
+// must not modify s through the result.
+func jarmReorder(s [][]byte, order string) [][]byte {
+	n := len(s)
+	var out [][]byte
+	switch order {
+	case "REVERSE":
+		for i := n - 1; i >= 0; i-- {
+			out = append(out, s[i])
+		}
+	case "BOTTOM_HALF":
+		out = append(out, s[n/2+n%2:]...)
+	case "TOP_HALF":
+		if n%2 == 1 {
+			out = append(out, s[n/2])
+		}
+		out = append(out, jarmReorder(jarmReorder(s, "REVERSE"), "BOTTOM_HALF")...)
+	case "MIDDLE_OUT":
+		middle := n / 2
+		if n%2 == 1 {
+			out = append(out, s[middle])
+			for i := 1; i <= middle; i++ {
+				out = append(out, s[middle+i], s[middle-i])
+			}
+		} else {
+			for i := 1; i <= middle; i++ {
+				out = append(out, s[middle-1+i], s[middle-i])
+			}
+		}
+	default:
+		out = s
+	}
+	return out
+}
+
+func jarmUint16s(values []uint16) [][]byte {
+	out := make([][]byte, len(values))
+	for i, v := range values {
+		out[i] = []byte{byte(v >> 8), byte(v)}
+	}
+	return out
+}
+
+func jarmGrease() []byte {
+	var b [1]byte
+	rand.Read(b[:])
+	g := b[0]&0xf0 | 0x0a
+	return []byte{g, g}
+}
+
+func jarmRandom(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func appendUint16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// clientHello builds the TLS record holding the probe's ClientHello
+func (p *jarmProbe) clientHello(host string) []byte {
+	recordVersion, helloVersion := p.version, p.version
+	if p.version == 0x0304 {
+		recordVersion, helloVersion = 0x0301, 0x0303
+	}
+
+	ciphers := jarmCiphers
+	if p.cipherList == "NO1.3" {
+		ciphers = nil
+		for _, suite := range jarmCiphers {
+			if suite>>8 != 0x13 {
+				ciphers = append(ciphers, suite)
+			}
+		}
+	}
+	suites := jarmReorder(jarmUint16s(ciphers), p.cipherOrder)
+	if p.grease {
+		suites = append([][]byte{jarmGrease()}, suites...)
+	}
+
+	hello := appendUint16(nil, int(helloVersion))
+	hello = append(hello, jarmRandom(32)...)
+	hello = append(hello, 32)
+	hello = append(hello, jarmRandom(32)...)
+	hello = appendUint16(hello, 2*len(suites))
+	for _, suite := range suites {
+		hello = append(hello, suite...)
+	}
+	hello = append(hello, 1, 0)
+	extensions := p.extensions(host)
+	hello = appendUint16(hello, len(extensions))
+	hello = append(hello, extensions...)
+
+	handshake := []byte{0x01, 0}
+	handshake = appendUint16(handshake, len(hello))
+	handshake = append(handshake, hello...)
+
+	record := []byte{0x16}
+	record = appendUint16(record, int(recordVersion))
+	record = appendUint16(record, len(handshake))
+	return append(record, handshake...)
+}
+
+func (p *jarmProbe) extensions(host string) []byte {
+	var ext []byte
+	if p.grease {
+		ext = append(ext, jarmGrease()...)
+		ext = append(ext, 0, 0)
+	}
+
+	// server_name
+	ext = append(ext, 0x00, 0x00)
+	ext = appendUint16(ext, len(host)+5)
+	ext = appendUint16(ext, len(host)+3)
+	ext = append(ext, 0)
+	ext = appendUint16(ext, len(host))
+	ext = append(ext, host...)
+
+	ext = append(ext, 0x00, 0x17, 0x00, 0x00)       // extended_master_secret
+	ext = append(ext, 0x00, 0x01, 0x00, 0x01, 0x01) // max_fragment_length
+	ext = append(ext, 0xff, 0x01, 0x00, 0x01, 0x00) // renegotiation_info
+	ext = append(ext, 0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18, 0x00, 0x19)
+	ext = append(ext, 0x00, 0x0b, 0x00, 0x02, 0x01, 0x00) // ec_point_formats
+	ext = append(ext, 0x00, 0x23, 0x00, 0x00)             // session_ticket
+
+	names := jarmALPNs
+	if p.rareALPN {
+		names = jarmRareALPNs
+	}
+	alpns := make([][]byte, len(names))
+	for i, name := range names {
+		alpns[i] = append([]byte{byte(len(name))}, name...)
+	}
+	var alpnList []byte
+	for _, alpn := range jarmReorder(alpns, p.extOrder) {
+		alpnList = append(alpnList, alpn...)
+	}
+	ext = append(ext, 0x00, 0x10)
+	ext = appendUint16(ext, len(alpnList)+2)
+	ext = appendUint16(ext, len(alpnList))
+	ext = append(ext, alpnList...)
+
+	// signature_algorithms
+	ext = append(ext, 0x00, 0x0d, 0x00, 0x14, 0x00, 0x12, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01,
+		0x05, 0x03, 0x08, 0x05, 0x05, 0x01, 0x08, 0x06, 0x06, 0x01, 0x02, 0x01)
+
+	// key_share, with a random x25519 share
+	var share []byte
+	if p.grease {
+		share = append(share, jarmGrease()...)
+		share = append(share, 0x00, 0x01, 0x00)
+	}
+	share = append(share, 0x00, 0x1d, 0x00, 0x20)
+	share = append(share, jarmRandom(32)...)
+	ext = append(ext, 0x00, 0x33)
+	ext = appendUint16(ext, len(share)+2)
+	ext = appendUint16(ext, len(share))
+	ext = append(ext, share...)
+
+	ext = append(ext, 0x00, 0x2d, 0x00, 0x02, 0x01, 0x01) // psk_key_exchange_modes
+
+	if p.version == 0x0304 || p.supportLevel == "1.2_SUPPORT" {
+		supported := []uint16{0x0301, 0x0302, 0x0303, 0x0304}
+		if p.supportLevel == "1.2_SUPPORT" {
+			supported = supported[:3]
+		}
+		var versions []byte
+		if p.grease {
+			versions = append(versions, jarmGrease()...)
+		}
+		for _, v := range jarmReorder(jarmUint16s(supported), p.extOrder) {
+			versions = append(versions, v...)
+		}
+		ext = append(ext, 0x00, 0x2b)
+		ext = appendUint16(ext, len(versions)+1)
+		ext = append(ext, byte(len(versions)))
+		ext = append(ext, versions...)
+	}
+	return ext
+}
+
+// parseJARMServerHello returns the probe result for a server's reply
+func parseJARMServerHello(data []byte) string {
+	if len(data) < 44 || data[0] != 0x16 || data[5] != 0x02 {
+		return jarmEmptyProbe
+	}
+	helloLength := int(binary.BigEndian.Uint16(data[3:5]))
+	counter := int(data[43])
+	if len(data) < counter+46 {
+		return jarmEmptyProbe
+	}
+	result := hex.EncodeToString(data[counter+44:counter+46]) + "|" +
+		hex.EncodeToString(data[9:11]) + "|"
+	return result + jarmExtensions(data, counter, helloLength)
+}
+
+// jarmExtensions returns the selected ALPN protocol and the list of extension
+// types in the ServerHello, separated by |.
+func jarmExtensions(data []byte, counter, helloLength int) string {
+	if len(data) < counter+53 || data[counter+47] == 11 ||
+		string(data[counter+50:counter+53]) == "\x0e\xac\x0b" ||
+		(len(data) >= 85 && string(data[82:85]) == "\x0f\xf0\x0b") || counter+42 >= helloLength {
+		return "|"
+	}
+	count := counter + 49
+	max := int(binary.BigEndian.Uint16(data[counter+47:counter+49])) + count - 1
+	var types []string
+	var alpn string
+	for count < max {
+		if len(data) < count+4 {
+			return "|"
+		}
+		extType := hex.EncodeToString(data[count : count+2])
+		length := int(binary.BigEndian.Uint16(data[count+2 : count+4]))
+		if len(data) < count+4+length {
+			return "|"
+		}
+		if extType == "0010" && alpn == "" && length > 3 {
+			alpn = string(data[count+7 : count+4+length])
+		}
+		types = append(types, extType)
+		count += 4 + length
+	}
+	return alpn + "|" + strings.Join(types, "-")
+}
+
+// jarmHash combines the probe results into the 62 character fingerprint: a
+// compressed cipher suite and version for each probe, followed by a
+// truncated SHA-256 of the ALPNs and extensions.
+func jarmHash(probes []string) string {
+	empty := true
+	for _, probe := range probes {
+		if probe != jarmEmptyProbe {
+			empty = false
+		}
+	}
+	if empty {
+		return strings.Repeat("0", 62)
+	}
+	var fuzzy, rest string
+	for _, probe := range probes {
+		components := strings.Split(probe, "|")
+		fuzzy += jarmCipherByte(components[0]) + jarmVersionByte(components[1])
+		rest += components[2] + components[3]
+	}
+	sum := sha256.Sum256([]byte(rest))
+	return fuzzy + hex.EncodeToString(sum[:])[:32]
+}
+
+func jarmCipherByte(cipher string) string {
+	if cipher == "" {
+		return "00"
+	}
+	count := 1
+	for _, suite := range jarmCipherIndex {
+		if fmt.Sprintf("%04x", suite) == cipher {
+			break
+		}
+		count++
+	}
+	return fmt.Sprintf("%02x", count)
+}
+
+func jarmVersionByte(version string) string {
+	if len(version) < 4 || version[3] < '0' || version[3] > '5' {
+		return "0"
+	}
+	return string("abcdef"[version[3]-'0'])
+}
+
+// jarmHost returns the name sent in the probes' server_name extension
+func (c *Conn) jarmHost() string {
+	if c.domain != "" {
+		return c.domain
+	}
+	if c.conn != nil {
+		if host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// jarmProbe sends one probe on a new connection and returns its result. A
+// failure to connect or a reply other than a ServerHello gives an empty
+// result.
+func (c *Conn) jarmProbe(p *jarmProbe, host string) string {
+	conn, err := c.dial()
+	if err != nil {
+		return jarmEmptyProbe
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+	if _, err := conn.Write(p.clientHello(host)); err != nil {
+		return jarmEmptyProbe
+	}
+	buf := make([]byte, jarmMaxResponse)
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+		if n >= 5 && n >= 5+int(binary.BigEndian.Uint16(buf[3:5])) {
+			break
+		}
+	}
+	return parseJARMServerHello(buf[0:n])
+}
+
+// JARMFingerprint sends the ten JARM ClientHello probes, each on a new
+// connection to the target, and returns the JARM fingerprint of the
+// server's replies. A server that answers none of them has a fingerprint of
+// all zeros.
+func (c *Conn) JARMFingerprint() (string, error) {
+	if c.dial == nil {
+		return "", ErrNoDialer
+	}
+	host := c.jarmHost()
+	event := new(JARMEvent)
+	for i := range jarmProbes {
+		event.Probes = append(event.Probes, c.jarmProbe(&jarmProbes[i], host))
+	}
+	event.Fingerprint = jarmHash(event.Probes)
+	c.grabData.JARM = event
+	return event.Fingerprint, nil
+}
@@ -0,0 +1,84 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJARMReorder(t *testing.T) {
+	s := jarmUint16s([]uint16{1, 2, 3, 4, 5})
+	tests := map[string][]uint16{
+		"FORWARD":     {1, 2, 3, 4, 5},
+		"REVERSE":     {5, 4, 3, 2, 1},
+		"BOTTOM_HALF": {4, 5},
+		"TOP_HALF":    {3, 2, 1},
+		"MIDDLE_OUT":  {3, 4, 2, 5, 1},
+	}
+	for order, expected := range tests {
+		if got := jarmReorder(s, order); !reflect.DeepEqual(got, jarmUint16s(expected)) {
+			t.Errorf("%s: expected %v, got %v", order, jarmUint16s(expected), got)
+		}
+	}
+}
+
+func TestJARMClientHello(t *testing.T) {
+	for i, p := range jarmProbes {
+		hello := p.clientHello("example.com")
+		if len(hello) != 5+int(hello[3])<<8+int(hello[4]) {
+			t.Errorf("probe %d: record length does not match", i)
+		}
+		if !bytes.Contains(hello, []byte("example.com")) {
+			t.Errorf("probe %d: missing server name", i)
+		}
+	}
+}
+
+func TestParseJARMServerHello(t *testing.T) {
+	extensions := []byte{0xff, 0x01, 0x00, 0x01, 0x00, 0x00, 0x10, 0x00, 0x05, 0x00, 0x03, 0x02, 'h', '2'}
+	hello := []byte{0x03, 0x03}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello, 0x00, 0xc0, 0x2f, 0x00)
+	hello = appendUint16(hello, len(extensions))
+	hello = append(hello, extensions...)
+	handshake := append([]byte{0x02, 0x00}, appendUint16(nil, len(hello))...)
+	handshake = append(handshake, hello...)
+	record := append([]byte{0x16, 0x03, 0x03}, appendUint16(nil, len(handshake))...)
+	record = append(record, handshake...)
+
+	if got, expected := parseJARMServerHello(record), "c02f|0303|h2|ff01-0010"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := parseJARMServerHello([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}); got != jarmEmptyProbe {
+		t.Errorf("expected empty result for an alert, got %q", got)
+	}
+}
+
+func TestJARMHashEmpty(t *testing.T) {
+	probes := make([]string, len(jarmProbes))
+	for i := range probes {
+		probes[i] = jarmEmptyProbe
+	}
+	if hash := jarmHash(probes); hash != strings.Repeat("0", 62) {
+		t.Errorf("expected all zero fingerprint, got %s", hash)
+	}
+	probes[0] = "c02f|0303|h2|ff01-0010"
+	if hash := jarmHash(probes); len(hash) != 62 || !strings.HasPrefix(hash, "29d000") {
+		t.Errorf("unexpected fingerprint %s", hash)
+	}
+}
@@ -14,7 +14,539 @@
 
 package zlib
 
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+// ErrNoAPOPTimestamp is returned by POP3APOP when the server greeting did
+// not include a <timestamp> to digest.
+var ErrNoAPOPTimestamp = errors.New("POP3 greeting did not contain an APOP timestamp")
+
+// ErrInvalidEHLOName is returned when an EHLO name contains a line break,
+// which would inject an extra SMTP command.
+var ErrInvalidEHLOName = errors.New("EHLO name must not contain CR or LF")
+
+// An IMAPStatusError is returned when an IMAP server answers a tagged command
+// with NO or BAD
+type IMAPStatusError struct {
+	Tag    string
+	Status string
+	Text   string
+}
+
+func (e *IMAPStatusError) Error() string {
+	return "IMAP command " + e.Tag + " failed with " + e.Status + ": " + e.Text
+}
+
+// parseIMAPTaggedResponse finds the line completing the command tagged tag in
+// response, and returns its status and text.
+func parseIMAPTaggedResponse(tag, response string) (status, text string, ok bool) {
+	for _, line := range mailLines(response) {
+		if !strings.HasPrefix(line, tag+" ") {
+			continue
+		}
+		fields := strings.SplitN(line[len(tag)+1:], " ", 2)
+		status = strings.ToUpper(fields[0])
+		if len(fields) > 1 {
+			text = fields[1]
+		}
+		return status, text, true
+	}
+	return "", "", false
+}
+
+// ErrRCPTLimit is returned by SMTPProbeRecipient when a second recipient is
+// probed on a connection that has not opted in with SetAllowMultipleRCPT.
+var ErrRCPTLimit = errors.New("only one RCPT probe is allowed per connection")
+
+// ErrInvalidRecipient is returned by SMTPProbeRecipient for an address that
+// contains a line break, which would inject a second command.
+var ErrInvalidRecipient = errors.New("RCPT address must not contain CR or LF")
+
 // An SMTPHelpEvent represents sending a "HELP" message over SMTP
 type SMTPHelpEvent struct {
 	Response string
 }
+
+// ErrPostSTARTTLSFailure is returned when the TLS handshake fails after the
+// server accepted STARTTLS, and by any later command on the connection.
+var ErrPostSTARTTLSFailure = errors.New("TLS handshake failed after STARTTLS, connection is unusable")
+
+// ErrServerClosedAfterSTARTTLS is returned when the server accepted STARTTLS
+// (or AUTH TLS) but closed the connection instead of answering the
+// ClientHello.
+var ErrServerClosedAfterSTARTTLS = errors.New("server closed the connection after accepting STARTTLS")
+
+// A STARTTLSError is returned when the TLS handshake after STARTTLS fails. It
+// matches Reason, ErrPostSTARTTLSFailure or ErrServerClosedAfterSTARTTLS,
+// with errors.Is, and carries the handshake error that caused it in Err.
+type STARTTLSError struct {
+	Reason error
+	Err    error
+}
+
+func (e *STARTTLSError) Error() string {
+	return e.Reason.Error() + ": " + e.Err.Error()
+}
+
+func (e *STARTTLSError) Unwrap() []error {
+	return []error{e.Reason, e.Err}
+}
+
+// ErrMailResponseOverflow is returned when an SMTP, POP3 or IMAP response
+// does not fit in the read buffer. The partial response is recorded in an
+// SMTPOverflowEvent.
+var ErrMailResponseOverflow = errors.New("mail response exceeded the read limit")
+
+// An SMTPOverflowEvent represents a mail protocol response that was cut off
+// because it exceeded the read limit
+type SMTPOverflowEvent struct {
+	Protocol  string `json:"protocol"`
+	Limit     int    `json:"limit"`
+	Partial   string `json:"partial"`
+	Truncated bool   `json:"truncated"`
+}
+
+// An SMTPRecipientEvent represents probing a single recipient with RCPT TO
+type SMTPRecipientEvent struct {
+	Recipient string `json:"recipient"`
+	Response  string `json:"response,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Accepted  bool   `json:"accepted"`
+}
+
+// An SMTPCommandProbe is a single command sent by SMTPProbeCommands and the
+// server's reply
+type SMTPCommandProbe struct {
+	Command  string `json:"command"`
+	Response string `json:"response,omitempty"`
+	Code     int    `json:"code,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"`
+}
+
+// ErrInvalidSMTPCommand is returned by SMTPProbeCommands for a command that
+// contains a line break, which would inject a second command.
+var ErrInvalidSMTPCommand = errors.New("SMTP command must not contain CR or LF")
+
+// ErrNoEHLO is returned by SMTP probes that need the EHLO exchange to have
+// happened first.
+var ErrNoEHLO = errors.New("EHLO must be sent first")
+
+// An SMTPAuthRequiredEvent represents sending MAIL FROM without
+// authenticating, and the RSET that follows it
+type SMTPAuthRequiredEvent struct {
+	MailResponse  string `json:"mail_response,omitempty"`
+	Code          int    `json:"code,omitempty"`
+	RequiresAuth  bool   `json:"requires_auth"`
+	ResetResponse string `json:"reset_response,omitempty"`
+}
+
+// An SMTPExtensionsEvent compares the extensions a server advertised in EHLO
+// before and after STARTTLS. Servers often withhold AUTH until the channel
+// is encrypted.
+type SMTPExtensionsEvent struct {
+	PreTLS  []string `json:"pre_tls,omitempty"`
+	PostTLS []string `json:"post_tls,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed bool     `json:"changed"`
+}
+
+// ehloExtensions returns the extension lines of an EHLO response, without
+// the reply code and the greeting on the first line
+func ehloExtensions(ehlo string) []string {
+	var extensions []string
+	lines := mailLines(strings.TrimRight(ehlo, "\r\n"))
+	for _, line := range lines[1:] {
+		if len(line) > 4 {
+			extensions = append(extensions, strings.TrimSpace(line[4:]))
+		}
+	}
+	return extensions
+}
+
+// compare fills in the differences between the pre and post TLS lists
+func (e *SMTPExtensionsEvent) compare() {
+	e.Added = missingFrom(e.PostTLS, e.PreTLS)
+	e.Removed = missingFrom(e.PreTLS, e.PostTLS)
+	e.Changed = len(e.Added) > 0 || len(e.Removed) > 0
+}
+
+// missingFrom returns the entries of a that are not in b, ignoring case
+func missingFrom(a, b []string) []string {
+	var missing []string
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if strings.EqualFold(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, x)
+		}
+	}
+	return missing
+}
+
+// An SMTPTLSReport summarizes the STARTTLS posture of an SMTP server, as
+// needed to judge whether MTA-STS or DANE could be enforced for it
+type SMTPTLSReport struct {
+	STARTTLSOffered    bool             `json:"starttls_offered"`
+	STARTTLSAccepted   bool             `json:"starttls_accepted"`
+	HandshakeSucceeded bool             `json:"handshake_succeeded"`
+	Version            ztls.TLSVersion  `json:"version,omitempty"`
+	CipherSuite        ztls.CipherSuite `json:"cipher_suite,omitempty"`
+	Hostname           string           `json:"hostname,omitempty"`
+	HostnameMatches    bool             `json:"hostname_matches"`
+	Validated          bool             `json:"validated"`
+	Trusted            bool             `json:"trusted"`
+}
+
+// A POP3Error is returned when a POP3 server answers a command with -ERR,
+// for example TOP for a message number that does not exist
+type POP3Error struct {
+	Command  string
+	Response string
+}
+
+func (e *POP3Error) Error() string {
+	return "POP3 " + e.Command + " failed: " + e.Response
+}
+
+// A POP3TopEvent represents retrieving the headers and first lines of a
+// message with TOP
+type POP3TopEvent struct {
+	Message  int    `json:"message"`
+	Lines    int    `json:"lines"`
+	Response string `json:"response,omitempty"`
+	Success  bool   `json:"success"`
+}
+
+// A POP3CapabilitiesEvent represents a CAPA response: the full capability
+// lines, whether STLS is offered and the SASL mechanisms listed
+type POP3CapabilitiesEvent struct {
+	Lines          []string `json:"lines,omitempty"`
+	STLSAvailable  bool     `json:"stls_available"`
+	SASLMechanisms []string `json:"sasl_mechanisms,omitempty"`
+}
+
+// parse fills in the event from the capability lines of a
+// CAPA response and returns the capability names
+func (e *POP3CapabilitiesEvent) parse(lines []string) []string {
+	var capabilities []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		e.Lines = append(e.Lines, line)
+		capabilities = append(capabilities, fields[0])
+		switch strings.ToUpper(fields[0]) {
+		case "STLS":
+			e.STLSAvailable = true
+		case "SASL":
+			e.SASLMechanisms = append(e.SASLMechanisms, fields[1:]...)
+		}
+	}
+	return capabilities
+}
+
+// A POP3LoginEvent represents an attempt to authenticate to a POP3 server
+type POP3LoginEvent struct {
+	Method   string `json:"method"`
+	User     string `json:"user,omitempty"`
+	Response string `json:"response,omitempty"`
+	Success  bool   `json:"success"`
+}
+
+// ErrIMAPParse is returned when an untagged IMAP response cannot be parsed.
+var ErrIMAPParse = errors.New("malformed IMAP response")
+
+// An IMAPNamespace is one prefix and hierarchy delimiter from a NAMESPACE
+// response
+type IMAPNamespace struct {
+	Prefix    string `json:"prefix"`
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+// An IMAPNamespaceEvent represents sending NAMESPACE (RFC 2342) and the
+// personal, other users' and shared namespaces the server lists
+type IMAPNamespaceEvent struct {
+	Response   string          `json:"response,omitempty"`
+	Personal   []IMAPNamespace `json:"personal,omitempty"`
+	OtherUsers []IMAPNamespace `json:"other_users,omitempty"`
+	Shared     []IMAPNamespace `json:"shared,omitempty"`
+}
+
+// An IMAPMailbox is a single mailbox from a LIST response
+type IMAPMailbox struct {
+	Name       string   `json:"name"`
+	Delimiter  string   `json:"delimiter,omitempty"`
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+// An IMAPListEvent represents sending LIST and the mailboxes the server
+// returned
+type IMAPListEvent struct {
+	Reference string        `json:"reference"`
+	Pattern   string        `json:"pattern"`
+	Response  string        `json:"response,omitempty"`
+	Mailboxes []IMAPMailbox `json:"mailboxes,omitempty"`
+}
+
+// An IMAPIdleEvent represents sending IDLE, waiting for the continuation
+// and ending it with DONE
+type IMAPIdleEvent struct {
+	Continuation string `json:"continuation,omitempty"`
+	Response     string `json:"response,omitempty"`
+	TimedOut     bool   `json:"timed_out,omitempty"`
+	Supported    bool   `json:"supported"`
+}
+
+// imapParser splits the data of an untagged IMAP response into values.
+// Atoms, quoted strings and literals become strings, NIL becomes nil and
+// parenthesized lists become []interface{}.
+type imapParser struct {
+	s   string
+	pos int
+}
+
+func parseIMAPValues(s string) ([]interface{}, error) {
+	p := &imapParser{s: s}
+	return p.values(false)
+}
+
+func (p *imapParser) values(inList bool) ([]interface{}, error) {
+	var values []interface{}
+	for {
+		for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+			p.pos++
+		}
+		if p.pos == len(p.s) {
+			if inList {
+				return nil, ErrIMAPParse
+			}
+			return values, nil
+		}
+		switch p.s[p.pos] {
+		case ')':
+			if !inList {
+				return nil, ErrIMAPParse
+			}
+			p.pos++
+			return values, nil
+		case '(':
+			p.pos++
+			list, err := p.values(true)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, list)
+		case '"':
+			str, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, str)
+		case '{':
+			str, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, str)
+		default:
+			start := p.pos
+			for p.pos < len(p.s) && !strings.ContainsRune(" ()\"", rune(p.s[p.pos])) {
+				p.pos++
+			}
+			if atom := p.s[start:p.pos]; strings.EqualFold(atom, "NIL") {
+				values = append(values, nil)
+			} else {
+				values = append(values, atom)
+			}
+		}
+	}
+}
+
+func (p *imapParser) quoted() (string, error) {
+	var b []byte
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		switch ch := p.s[p.pos]; ch {
+		case '"':
+			p.pos++
+			return string(b), nil
+		case '\\':
+			if p.pos++; p.pos == len(p.s) {
+				return "", ErrIMAPParse
+			}
+			b = append(b, p.s[p.pos])
+		default:
+			b = append(b, ch)
+		}
+	}
+	return "", ErrIMAPParse
+}
+
+// literal reads a {N} marker, the CRLF after it and the N bytes of data
+func (p *imapParser) literal() (string, error) {
+	end := strings.Index(p.s[p.pos:], "}\r\n")
+	if end < 0 {
+		return "", ErrIMAPParse
+	}
+	size, err := strconv.ParseUint(p.s[p.pos+1:p.pos+end], 10, 31)
+	start := p.pos + end + 3
+	if err != nil || start+int(size) > len(p.s) {
+		return "", ErrIMAPParse
+	}
+	p.pos = start + int(size)
+	return p.s[start:p.pos], nil
+}
+
+// imapLiteralSize returns N if line, without its CRLF, ends with a {N}
+// literal marker, meaning the next N bytes are data rather than lines.
+func imapLiteralSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndex(line, "{")
+	if open < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseUint(line[open+1:len(line)-1], 10, 31)
+	if err != nil {
+		return 0, false
+	}
+	return int(size), true
+}
+
+// mailLines splits a mail protocol response into lines, accepting a bare LF
+// as well as CRLF as the line ending.
+func mailLines(response string) []string {
+	lines := strings.Split(response, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// imapLines splits response on CRLF or LF, keeping any literals, and the rest of
+// the line they continue, within the line that announced them.
+func imapLines(response string) []string {
+	var lines []string
+	var cur string
+	for len(response) > 0 {
+		end := strings.Index(response, "\n")
+		if end < 0 {
+			cur += response
+			break
+		}
+		line := strings.TrimSuffix(response[:end], "\r")
+		response = response[end+1:]
+		if size, ok := imapLiteralSize(line); ok && size <= len(response) {
+			cur += line + "\r\n" + response[:size]
+			response = response[size:]
+			continue
+		}
+		lines = append(lines, cur+line)
+		cur = ""
+	}
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+// untaggedIMAPData returns the data following "* name " on each line of
+// response that carries that untagged response.
+func untaggedIMAPData(response, name string) []string {
+	var data []string
+	prefix := "* " + name + " "
+	for _, line := range imapLines(response) {
+		if len(line) >= len(prefix) && strings.EqualFold(line[:len(prefix)], prefix) {
+			data = append(data, line[len(prefix):])
+		}
+	}
+	return data
+}
+
+// parseIMAPNamespaces converts one namespace group, NIL or a list of
+// (prefix delimiter) lists, from a NAMESPACE response.
+func parseIMAPNamespaces(v interface{}) ([]IMAPNamespace, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, ErrIMAPParse
+	}
+	namespaces := make([]IMAPNamespace, 0, len(list))
+	for _, entry := range list {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) < 2 {
+			return nil, ErrIMAPParse
+		}
+		prefix, ok := fields[0].(string)
+		if !ok {
+			return nil, ErrIMAPParse
+		}
+		delimiter, _ := fields[1].(string)
+		namespaces = append(namespaces, IMAPNamespace{Prefix: prefix, Delimiter: delimiter})
+	}
+	return namespaces, nil
+}
+
+// parse fills in the event from the untagged NAMESPACE line of a response
+func (e *IMAPNamespaceEvent) parse(response string) error {
+	data := untaggedIMAPData(response, "NAMESPACE")
+	if len(data) == 0 {
+		return ErrIMAPParse
+	}
+	values, err := parseIMAPValues(data[0])
+	if err != nil {
+		return err
+	}
+	if len(values) != 3 {
+		return ErrIMAPParse
+	}
+	if e.Personal, err = parseIMAPNamespaces(values[0]); err != nil {
+		return err
+	}
+	if e.OtherUsers, err = parseIMAPNamespaces(values[1]); err != nil {
+		return err
+	}
+	e.Shared, err = parseIMAPNamespaces(values[2])
+	return err
+}
+
+// parse fills in the event from the untagged LIST lines of a response
+func (e *IMAPListEvent) parse(response string) error {
+	for _, line := range untaggedIMAPData(response, "LIST") {
+		values, err := parseIMAPValues(line)
+		if err != nil {
+			return err
+		}
+		if len(values) != 3 {
+			return ErrIMAPParse
+		}
+		attributes, ok := values[0].([]interface{})
+		name, nameOK := values[2].(string)
+		if !ok || !nameOK {
+			return ErrIMAPParse
+		}
+		mailbox := IMAPMailbox{Name: name}
+		mailbox.Delimiter, _ = values[1].(string)
+		for _, attribute := range attributes {
+			if s, ok := attribute.(string); ok {
+				mailbox.Attributes = append(mailbox.Attributes, s)
+			}
+		}
+		e.Mailboxes = append(e.Mailboxes, mailbox)
+	}
+	return nil
+}
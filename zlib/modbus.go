@@ -17,18 +17,68 @@ package zlib
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 type MEIResponse struct {
 	ConformityLevel int          `json:"conformity_level"`
 	MoreFollows     bool         `json:"more_follows"`
+	NextObjectID    int          `json:"next_object_id,omitempty"`
 	ObjectCount     int          `json:"object_count"`
 	Objects         MEIObjectSet `json:"objects,omitempty"`
 }
 
+// DeviceID collects the objects of a read device identification response
+// into a ModbusDeviceID. Objects outside of the basic and regular categories
+// are kept in Extended, keyed by their object name.
+func (r *MEIResponse) DeviceID() *ModbusDeviceID {
+	d := new(ModbusDeviceID)
+	for _, obj := range r.Objects {
+		switch obj.OID {
+		case OIDVendor:
+			d.VendorName = obj.Value
+		case OIDProductCode:
+			d.ProductCode = obj.Value
+		case OIDRevision:
+			d.MajorMinorRevision = obj.Value
+		case OIDVendorURL:
+			d.VendorURL = obj.Value
+		case OIDProductName:
+			d.ProductName = obj.Value
+		case OIDModelName:
+			d.ModelName = obj.Value
+		case OIDUserApplicationName:
+			d.UserApplicationName = obj.Value
+		default:
+			if d.Extended == nil {
+				d.Extended = make(map[string]string)
+			}
+			d.Extended[obj.OID.Name()] = obj.Value
+		}
+	}
+	d.MoreFollows = r.MoreFollows
+	return d
+}
+
+// ModbusDeviceID is the decoded result of a Read Device Identification
+// (MEI type 0x0E) request.
+type ModbusDeviceID struct {
+	VendorName          string            `json:"vendor_name,omitempty"`
+	ProductCode         string            `json:"product_code,omitempty"`
+	MajorMinorRevision  string            `json:"major_minor_revision,omitempty"`
+	VendorURL           string            `json:"vendor_url,omitempty"`
+	ProductName         string            `json:"product_name,omitempty"`
+	ModelName           string            `json:"model_name,omitempty"`
+	UserApplicationName string            `json:"user_application_name,omitempty"`
+	Extended            map[string]string `json:"extended,omitempty"`
+	MoreFollows         bool              `json:"more_follows,omitempty"`
+}
+
 type MEIObjectSet []MEIObject
 
 func (ms *MEIObjectSet) MarshalJSON() ([]byte, error) {
@@ -89,13 +139,29 @@ type ExceptionResponse struct {
 	ExceptionType     byte         `json:"exception_type"`
 }
 
+// A ModbusGatewayEvent records a scan of the unit IDs behind a Modbus
+// gateway. Units maps each unit that identified itself to its device ID,
+// and Exceptions each unit that answered with an exception, often 0x0A or
+// 0x0B from the gateway when nothing answers at that address.
+type ModbusGatewayEvent struct {
+	Units      map[byte]*ModbusDeviceID    `json:"units,omitempty"`
+	Exceptions map[byte]*ExceptionResponse `json:"exceptions,omitempty"`
+	Unanswered []int                       `json:"unanswered,omitempty"`
+	Error      string                      `json:"error,omitempty"`
+}
+
 type ModbusEvent struct {
 	Length           int                `json:"length"`
 	UnitID           int                `json:"unit_id"`
 	Function         FunctionCode       `json:"function_code"`
 	Response         []byte             `json:"raw_response,omitempty"`
 	MEIResponse      *MEIResponse       `json:"mei_response,omitempty"`
+	DeviceID         *ModbusDeviceID    `json:"device_id,omitempty"`
 	ExceptionReponse *ExceptionResponse `json:"exception_response,omitempty"`
+
+	// RawData holds the bytes read for a response that could not be read
+	// or parsed
+	RawData []byte `json:"raw_data,omitempty"`
 }
 
 func (m *ModbusEvent) IsException() bool {
@@ -140,24 +206,27 @@ func (m *ModbusEvent) parseReponse() {
 	}
 	conformityLevel := m.Response[2]
 	moreFollows := (m.Response[3] != 0)
+	nextObjectID := m.Response[4]
 	objectCount := m.Response[5]
-	objects := make([]MEIObject, objectCount)
+	objects := make([]MEIObject, 0, objectCount)
 	it := 6
-	for idx := range objects {
+	for idx := 0; idx < int(objectCount); idx++ {
 		n, obj := parseMEIObject(m.Response[it:])
 		it += n
 		if obj == nil {
 			break
 		}
-		objects[idx] = *obj
+		objects = append(objects, *obj)
 	}
 	res := MEIResponse{
 		ConformityLevel: int(conformityLevel),
 		MoreFollows:     moreFollows,
+		NextObjectID:    int(nextObjectID),
 		ObjectCount:     int(objectCount),
 		Objects:         objects,
 	}
 	m.MEIResponse = &res
+	m.DeviceID = res.DeviceID()
 }
 
 func parseMEIObject(objectBytes []byte) (int, *MEIObject) {
@@ -183,16 +252,23 @@ type ExceptionFunctionCode byte
 type ExceptionCode byte
 
 type ModbusRequest struct {
-	Function FunctionCode
-	Data     []byte
+	// TransactionID is echoed back in the response. Zero sends the fixed ID
+	// from ModbusHeaderBytes.
+	TransactionID uint16
+	UnitID        byte
+	Function      FunctionCode
+	Data          []byte
 }
 
 func (r *ModbusRequest) MarshalBinary() (data []byte, err error) {
 	data = make([]byte, 7+1+len(r.Data))
 	copy(data[0:4], ModbusHeaderBytes)
+	if r.TransactionID != 0 {
+		binary.BigEndian.PutUint16(data[0:2], r.TransactionID)
+	}
 	msglen := len(r.Data) + 2 // unit ID and function
 	binary.BigEndian.PutUint16(data[4:6], uint16(msglen))
-	data[6] = 0
+	data[6] = r.UnitID
 	data[7] = byte(r.Function)
 	copy(data[8:], r.Data)
 	return
@@ -203,6 +279,57 @@ type ModbusResponse struct {
 	UnitID   int
 	Function FunctionCode
 	Data     []byte
+
+	// Raw is everything read for the response, including the header. It is
+	// set even when reading or parsing the response fails.
+	Raw []byte
+}
+
+type encodedModbusResponse struct {
+	Length       int             `json:"length"`
+	UnitID       int             `json:"unit_id"`
+	Function     FunctionCode    `json:"function_code"`
+	FunctionName string          `json:"function_name"`
+	Data         string          `json:"data,omitempty"`
+	DeviceID     *ModbusDeviceID `json:"device_id,omitempty"`
+}
+
+// MarshalJSON encodes the response with the name of its function code and
+// its data as hex. Read device identification responses also include the
+// decoded device ID.
+func (r *ModbusResponse) MarshalJSON() ([]byte, error) {
+	enc := encodedModbusResponse{
+		Length:       r.Length,
+		UnitID:       r.UnitID,
+		Function:     r.Function,
+		FunctionName: r.Function.Name(),
+		Data:         hex.EncodeToString(r.Data),
+	}
+	event := ModbusEvent{Function: r.Function, Response: r.Data}
+	event.ParseSelf()
+	enc.DeviceID = event.DeviceID
+	return json.Marshal(&enc)
+}
+
+// UnmarshalJSON decodes a response encoded by MarshalJSON. The function name
+// and device ID are derived from the other fields and are ignored.
+func (r *ModbusResponse) UnmarshalJSON(b []byte) error {
+	var enc encodedModbusResponse
+	if err := json.Unmarshal(b, &enc); err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(enc.Data)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+	r.Length = enc.Length
+	r.UnitID = enc.UnitID
+	r.Function = enc.Function
+	r.Data = data
+	return nil
 }
 
 func (c *Conn) ReadMin(res []byte, bytes int) (cnt int, err error) {
@@ -224,19 +351,39 @@ func (c *Conn) ReadMin(res []byte, bytes int) (cnt int, err error) {
 }
 
 func (c *Conn) GetModbusResponse() (res ModbusResponse, err error) {
+	return c.getModbusResponse(0)
+}
+
+// errModbusStaleResponse is returned by getModbusResponse for a complete
+// response whose transaction ID belongs to an earlier request
+var errModbusStaleResponse = errors.New("modbus: response to an earlier request")
+
+// getModbusResponse reads a response to the request sent with transactionID,
+// zero meaning the fixed ID from ModbusHeaderBytes. A response carrying a
+// different transaction ID is read in full and errModbusStaleResponse is
+// returned, so that the next response can be read after it.
+func (c *Conn) getModbusResponse(transactionID uint16) (res ModbusResponse, err error) {
 	var cnt int
-	buf := make([]byte, 1024) // should be more memory than we need
-	header := buf[0:7]
-	buf = buf[7:]
+	raw := make([]byte, 1024) // should be more memory than we need
+	header := raw[0:7]
+	buf := raw[7:]
 
 	cnt, err = c.ReadMin(header, 7)
 	if err != nil {
-		err = fmt.Errorf("modbus: could not get response: %s", err.Error())
+		res.Raw = raw[0:cnt]
+		err = fmt.Errorf("modbus: could not get response: %w", err)
 		return
 	}
 
 	// first 4 bytes should be known, verify them
-	if !bytes.Equal(header[0:4], ModbusHeaderBytes) {
+	expected := make([]byte, 4)
+	copy(expected, ModbusHeaderBytes)
+	if transactionID != 0 {
+		binary.BigEndian.PutUint16(expected[0:2], transactionID)
+	}
+	stale := transactionID != 0 && !bytes.Equal(header[0:2], expected[0:2]) && bytes.Equal(header[2:4], expected[2:4])
+	if !stale && !bytes.Equal(header[0:4], expected) {
+		res.Raw = header
 		err = fmt.Errorf("modbus: not a modbus response")
 		return
 	}
@@ -278,6 +425,10 @@ func (c *Conn) GetModbusResponse() (res ModbusResponse, err error) {
 		UnitID:   unitID,
 		Function: FunctionCode(buf[0]),
 		Data:     d,
+		Raw:      raw[0 : 7+cnt],
+	}
+	if err == nil && stale {
+		err = errModbusStaleResponse
 	}
 
 	return
@@ -288,8 +439,38 @@ type ModbusException struct {
 	ExceptionType ExceptionCode
 }
 
+type encodedModbusException struct {
+	Function      ExceptionFunctionCode `json:"function_code"`
+	FunctionName  string                `json:"function_name"`
+	ExceptionType ExceptionCode         `json:"exception_code"`
+	ExceptionName string                `json:"exception_name"`
+}
+
+// MarshalJSON encodes the exception with the names of the function that
+// failed and of the exception code
+func (e *ModbusException) MarshalJSON() ([]byte, error) {
+	enc := encodedModbusException{
+		Function:      e.Function,
+		FunctionName:  e.Function.FunctionCode().Name(),
+		ExceptionType: e.ExceptionType,
+		ExceptionName: e.ExceptionType.Name(),
+	}
+	return json.Marshal(&enc)
+}
+
+// UnmarshalJSON decodes an exception encoded by MarshalJSON
+func (e *ModbusException) UnmarshalJSON(b []byte) error {
+	var enc encodedModbusException
+	if err := json.Unmarshal(b, &enc); err != nil {
+		return err
+	}
+	e.Function = enc.Function
+	e.ExceptionType = enc.ExceptionType
+	return nil
+}
+
 func (e ExceptionFunctionCode) FunctionCode() FunctionCode {
-	code := byte(e) & byte(0x79)
+	code := byte(e) & byte(0x7F)
 	return FunctionCode(code)
 }
 
@@ -298,6 +479,56 @@ func (c FunctionCode) ExceptionFunctionCode() ExceptionFunctionCode {
 	return ExceptionFunctionCode(code)
 }
 
+var functionCodeNames = map[FunctionCode]string{
+	0x01: "read_coils",
+	0x02: "read_discrete_inputs",
+	0x03: "read_holding_registers",
+	0x04: "read_input_registers",
+	0x05: "write_single_coil",
+	0x06: "write_single_register",
+	0x07: "read_exception_status",
+	0x08: "diagnostics",
+	0x0B: "get_comm_event_counter",
+	0x0C: "get_comm_event_log",
+	0x0F: "write_multiple_coils",
+	0x10: "write_multiple_registers",
+	0x11: "report_server_id",
+	0x14: "read_file_record",
+	0x15: "write_file_record",
+	0x16: "mask_write_register",
+	0x17: "read_write_multiple_registers",
+	0x18: "read_fifo_queue",
+	0x2B: "encapsulated_interface_transport",
+}
+
+// Name returns the name of the function, or of the function that failed if
+// c is an exception
+func (c FunctionCode) Name() string {
+	if name, ok := functionCodeNames[c&0x7F]; ok {
+		return name
+	}
+	return "unknown." + strconv.Itoa(int(c&0x7F))
+}
+
+var exceptionCodeNames = map[ExceptionCode]string{
+	0x01: "illegal_function",
+	0x02: "illegal_data_address",
+	0x03: "illegal_data_value",
+	0x04: "server_device_failure",
+	0x05: "acknowledge",
+	0x06: "server_device_busy",
+	0x08: "memory_parity_error",
+	0x0A: "gateway_path_unavailable",
+	0x0B: "gateway_target_failed_to_respond",
+}
+
+func (c ExceptionCode) Name() string {
+	if name, ok := exceptionCodeNames[c]; ok {
+		return name
+	}
+	return "unknown." + strconv.Itoa(int(c))
+}
+
 func (c FunctionCode) IsException() bool {
 	return (byte(c) & 0x80) == 0x80
 }
@@ -309,6 +540,13 @@ var ModbusHeaderBytes = []byte{
 
 var ModbusFunctionEncapsulatedInterface = FunctionCode(0x2B)
 
+// modbusMaxFollowUps bounds the number of additional read device
+// identification requests issued when a device sets the more follows flag.
+const modbusMaxFollowUps = 8
+
+// modbusUnitWait is how long ModbusScanUnits waits for each unit to answer
+var modbusUnitWait = 2 * time.Second
+
 const (
 	FunctionCodeMEI = FunctionCode(0x2B)
 )
@@ -0,0 +1,276 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Read Device Identification response from a Schneider Electric M340 PLC
+var schneiderDeviceIDResponse = []byte{
+	0x0E, 0x01, 0x01, 0x00, 0x00, 0x03,
+	0x00, 0x12, 'S', 'c', 'h', 'n', 'e', 'i', 'd', 'e', 'r', ' ', 'E', 'l', 'e', 'c', 't', 'r', 'i', 'c',
+	0x01, 0x0C, 'B', 'M', 'X', ' ', 'P', '3', '4', ' ', '2', '0', '2', '0',
+	0x02, 0x04, 'v', '2', '.', '6',
+}
+
+func modbusFrame(function FunctionCode, data []byte) []byte {
+	frame := make([]byte, 8+len(data))
+	copy(frame[0:4], ModbusHeaderBytes)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(data)+2))
+	frame[7] = byte(function)
+	copy(frame[8:], data)
+	return frame
+}
+
+func TestModbusParseDeviceID(t *testing.T) {
+	event := ModbusEvent{
+		Function: FunctionCodeMEI,
+		Response: schneiderDeviceIDResponse,
+	}
+	event.ParseSelf()
+	if event.MEIResponse == nil {
+		t.Fatal("expected MEI response to be parsed")
+	}
+	if event.MEIResponse.ObjectCount != 3 || len(event.MEIResponse.Objects) != 3 {
+		t.Errorf("expected 3 objects, got %d", len(event.MEIResponse.Objects))
+	}
+	d := event.DeviceID
+	if d == nil {
+		t.Fatal("expected device ID to be parsed")
+	}
+	if d.VendorName != "Schneider Electric" {
+		t.Errorf("wrong vendor name: %s", d.VendorName)
+	}
+	if d.ProductCode != "BMX P34 2020" {
+		t.Errorf("wrong product code: %s", d.ProductCode)
+	}
+	if d.MajorMinorRevision != "v2.6" {
+		t.Errorf("wrong revision: %s", d.MajorMinorRevision)
+	}
+	if d.MoreFollows || d.Extended != nil {
+		t.Errorf("unexpected continuation or extended objects: %+v", d)
+	}
+}
+
+func TestModbusParseTruncatedObject(t *testing.T) {
+	event := ModbusEvent{
+		Function: FunctionCodeMEI,
+		Response: schneiderDeviceIDResponse[:30],
+	}
+	event.ParseSelf()
+	if event.DeviceID == nil {
+		t.Fatal("expected device ID to be parsed")
+	}
+	if event.DeviceID.VendorName != "Schneider Electric" {
+		t.Errorf("wrong vendor name: %s", event.DeviceID.VendorName)
+	}
+	if event.DeviceID.ProductCode != "" {
+		t.Errorf("expected truncated product code to be dropped, got %s", event.DeviceID.ProductCode)
+	}
+}
+
+func TestModbusMoreFollows(t *testing.T) {
+	first := []byte{
+		0x0E, 0x01, 0x01, 0xFF, 0x02, 0x02,
+		0x00, 0x07, 'S', 'I', 'E', 'M', 'E', 'N', 'S',
+		0x01, 0x08, '6', 'E', 'S', '7', ' ', '3', '1', '5',
+	}
+	second := []byte{
+		0x0E, 0x01, 0x01, 0x00, 0x00, 0x02,
+		0x02, 0x06, 'V', '3', '.', '2', '.', '8',
+		0x80, 0x03, 'C', 'P', 'U',
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		req := make([]byte, 11)
+		for _, res := range [][]byte{first, second} {
+			if _, err := server.Read(req); err != nil {
+				return
+			}
+			server.Write(modbusFrame(FunctionCodeMEI, res))
+		}
+	}()
+
+	c := &Conn{conn: client}
+	if _, err := c.SendModbusEcho(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d := c.grabData.Modbus.DeviceID
+	if d == nil {
+		t.Fatal("expected device ID to be parsed")
+	}
+	if d.VendorName != "SIEMENS" || d.ProductCode != "6ES7 315" || d.MajorMinorRevision != "V3.2.8" {
+		t.Errorf("wrong device ID: %+v", d)
+	}
+	if d.Extended["oid_128"] != "CPU" {
+		t.Errorf("expected extended object oid_128, got %v", d.Extended)
+	}
+	if d.MoreFollows {
+		t.Error("expected more follows to be cleared after follow-up")
+	}
+}
+
+func TestModbusScanUnits(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		req := make([]byte, 11)
+		for {
+			if _, err := server.Read(req); err != nil {
+				return
+			}
+			var frame []byte
+			switch req[6] {
+			case 1:
+				frame = modbusFrame(FunctionCodeMEI, schneiderDeviceIDResponse)
+			case 2:
+				// Gateway target device failed to respond
+				frame = modbusFrame(FunctionCodeMEI|0x80, []byte{0x0B})
+			default:
+				continue
+			}
+			copy(frame[0:2], req[0:2])
+			frame[6] = req[6]
+			server.Write(frame)
+		}
+	}()
+
+	c := &Conn{conn: client, readDeadline: time.Now().Add(200 * time.Millisecond)}
+	units := c.ModbusScanUnits([]byte{1, 2, 3})
+	if len(units) != 1 || units[1] == nil || units[1].VendorName != "Schneider Electric" {
+		t.Errorf("expected only unit 1 to identify itself, got %+v", units)
+	}
+	event := c.grabData.ModbusGateway
+	if e := event.Exceptions[2]; e == nil || e.ExceptionType != 0x0B {
+		t.Errorf("expected a gateway exception for unit 2, got %+v", event.Exceptions)
+	}
+	if !reflect.DeepEqual(event.Unanswered, []int{3}) || event.Error != "" {
+		t.Errorf("expected unit 3 to time out, got %v and %q", event.Unanswered, event.Error)
+	}
+}
+
+func TestModbusScanUnitsLateAnswer(t *testing.T) {
+	defer func(wait time.Duration) { modbusUnitWait = wait }(modbusUnitWait)
+	modbusUnitWait = 200 * time.Millisecond
+	// Unit 1 answers after its wait is over, just before unit 2 does
+	delays := map[byte]time.Duration{1: 250 * time.Millisecond, 2: 100 * time.Millisecond}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		var mu sync.Mutex
+		for {
+			req := make([]byte, 11)
+			if _, err := server.Read(req); err != nil {
+				return
+			}
+			frame := modbusFrame(FunctionCodeMEI, schneiderDeviceIDResponse)
+			copy(frame[0:2], req[0:2])
+			frame[6] = req[6]
+			go func() {
+				time.Sleep(delays[req[6]])
+				mu.Lock()
+				defer mu.Unlock()
+				server.Write(frame)
+			}()
+		}
+	}()
+
+	c := &Conn{conn: client}
+	units := c.ModbusScanUnits([]byte{1, 2, 3})
+	if len(units) != 2 || units[2] == nil || units[3] == nil {
+		t.Errorf("expected units 2 and 3 to identify themselves, got %+v", units)
+	}
+	if event := c.grabData.ModbusGateway; !reflect.DeepEqual(event.Unanswered, []int{1}) || event.Error != "" {
+		t.Errorf("expected only unit 1 to time out, got %v and %q", event.Unanswered, event.Error)
+	}
+}
+
+func TestModbusRawDataOnFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		server.Read(make([]byte, 11))
+		server.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
+	}()
+
+	c := &Conn{conn: client}
+	c.SetMaxRecordedBytes(4)
+	if _, err := c.SendModbusEcho(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if raw := c.grabData.Modbus.RawData; string(raw) != "HTTP" {
+		t.Errorf("expected the first 4 bytes read, got %q", raw)
+	}
+}
+
+func TestModbusResponseJSONRoundTrip(t *testing.T) {
+	res := ModbusResponse{
+		Length:   len(schneiderDeviceIDResponse) + 2,
+		UnitID:   0,
+		Function: FunctionCodeMEI,
+		Data:     schneiderDeviceIDResponse,
+	}
+	b, err := json.Marshal(&res)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(b), `"function_name":"encapsulated_interface_transport"`) ||
+		!strings.Contains(string(b), `"vendor_name":"Schneider Electric"`) {
+		t.Errorf("missing function name or device ID in %s", b)
+	}
+	var decoded ModbusResponse
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(res, decoded) {
+		t.Errorf("round trip changed response, expected %+v, got %+v", res, decoded)
+	}
+}
+
+func TestModbusExceptionJSONRoundTrip(t *testing.T) {
+	e := ModbusException{
+		Function:      FunctionCodeMEI.ExceptionFunctionCode(),
+		ExceptionType: 0x02,
+	}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `{"function_code":171,"function_name":"encapsulated_interface_transport","exception_code":2,"exception_name":"illegal_data_address"}`
+	if string(b) != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+	var decoded ModbusException
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if decoded != e {
+		t.Errorf("round trip changed exception, expected %+v, got %+v", e, decoded)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	mqttPacketConnect = 0x10
+	mqttPacketConnAck = 0x20
+
+	// MQTT 3.1.1
+	mqttProtocolLevel = 0x04
+	mqttCleanSession  = 0x02
+	mqttKeepAlive     = 60
+)
+
+var mqttReturnCodeNames = map[byte]string{
+	0x00: "accepted",
+	0x01: "unacceptable_protocol_version",
+	0x02: "identifier_rejected",
+	0x03: "server_unavailable",
+	0x04: "bad_username_or_password",
+	0x05: "not_authorized",
+}
+
+var ErrMQTTBadConnAck = errors.New("invalid MQTT CONNACK packet")
+
+// An MQTTConnectEvent represents sending an MQTT CONNECT packet and the
+// broker's CONNACK reply
+type MQTTConnectEvent struct {
+	ClientID       string `json:"client_id"`
+	RawData        []byte `json:"raw_data,omitempty"`
+	SessionPresent bool   `json:"session_present"`
+	ReturnCode     byte   `json:"return_code"`
+	ReturnCodeName string `json:"return_code_name,omitempty"`
+}
+
+// MQTTReturnCodeName returns the name of a CONNACK return code
+func MQTTReturnCodeName(code byte) string {
+	if name, ok := mqttReturnCodeNames[code]; ok {
+		return name
+	}
+	return "unknown." + strconv.Itoa(int(code))
+}
+
+// mqttConnectPacket builds a version 3.1.1 CONNECT packet with a clean
+// session and no credentials.
+func mqttConnectPacket(clientID string) []byte {
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, mqttProtocolLevel, mqttCleanSession)
+	body = append(body, byte(mqttKeepAlive>>8), byte(mqttKeepAlive))
+	body = appendMQTTString(body, clientID)
+
+	packet := []byte{mqttPacketConnect}
+	packet = appendMQTTLength(packet, len(body))
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(s)))
+	b = append(b, l[:]...)
+	return append(b, s...)
+}
+
+// appendMQTTLength appends a remaining length field, which is encoded in
+// seven bit groups with the high bit set on all but the last byte.
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// parseConnAck fills in the event from a CONNACK packet
+func (e *MQTTConnectEvent) parseConnAck(b []byte) error {
+	if len(b) < 4 || b[0] != mqttPacketConnAck || b[1] != 0x02 {
+		return ErrMQTTBadConnAck
+	}
+	e.SessionPresent = b[2]&0x01 != 0
+	e.ReturnCode = b[3]
+	e.ReturnCodeName = MQTTReturnCodeName(e.ReturnCode)
+	return nil
+}
+
+// MQTTConnect sends an MQTT CONNECT packet with the given client identifier
+// and records the broker's CONNACK. A return code other than accepted
+// usually means the broker requires authentication.
+func (c *Conn) MQTTConnect(clientID string) (*MQTTConnectEvent, error) {
+	event := &MQTTConnectEvent{ClientID: clientID}
+	c.grabData.MQTT = event
+	if _, err := c.getUnderlyingConn().Write(mqttConnectPacket(clientID)); err != nil {
+		return event, err
+	}
+	buf := make([]byte, 4)
+	n, err := c.ReadMin(buf, len(buf))
+	event.RawData = c.recordRaw(buf[0:n])
+	if err != nil {
+		return event, err
+	}
+	return event, event.parseConnAck(buf[0:n])
+}
@@ -0,0 +1,53 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMQTTConnectPacket(t *testing.T) {
+	expected := []byte{
+		0x10, 0x11, // CONNECT, remaining length
+		0x00, 0x04, 'M', 'Q', 'T', 'T', // protocol name
+		0x04,       // protocol level
+		0x02,       // clean session
+		0x00, 0x3c, // keep alive
+		0x00, 0x05, 'z', 'g', 'r', 'a', 'b', // client identifier
+	}
+	if got := mqttConnectPacket("zgrab"); !bytes.Equal(got, expected) {
+		t.Errorf("wrong CONNECT packet, expected %x, got %x", expected, got)
+	}
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	if got := appendMQTTLength(nil, 321); !bytes.Equal(got, []byte{0xc1, 0x02}) {
+		t.Errorf("wrong encoding of 321: %x", got)
+	}
+}
+
+func TestMQTTParseConnAck(t *testing.T) {
+	e := new(MQTTConnectEvent)
+	if err := e.parseConnAck([]byte{0x20, 0x02, 0x01, 0x05}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !e.SessionPresent || e.ReturnCode != 5 || e.ReturnCodeName != "not_authorized" {
+		t.Errorf("wrong CONNACK parse: %+v", e)
+	}
+	if err := e.parseConnAck([]byte{0x30, 0x02, 0x00, 0x00}); err != ErrMQTTBadConnAck {
+		t.Errorf("expected ErrMQTTBadConnAck, got %v", err)
+	}
+}
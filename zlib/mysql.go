@@ -0,0 +1,247 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// The handshake is a single small packet, so keep it bounded
+	mysqlMaxPacketSize = 4096
+
+	mysqlErrorPacket = 0xff
+
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+)
+
+var mysqlCapabilityNames = map[uint32]string{
+	0x00000001: "long_password",
+	0x00000002: "found_rows",
+	0x00000004: "long_flag",
+	0x00000008: "connect_with_db",
+	0x00000010: "no_schema",
+	0x00000020: "compress",
+	0x00000040: "odbc",
+	0x00000080: "local_files",
+	0x00000100: "ignore_space",
+	0x00000200: "protocol_41",
+	0x00000400: "interactive",
+	0x00000800: "ssl",
+	0x00001000: "ignore_sigpipe",
+	0x00002000: "transactions",
+	0x00004000: "reserved",
+	0x00008000: "secure_connection",
+	0x00010000: "multi_statements",
+	0x00020000: "multi_results",
+	0x00040000: "ps_multi_results",
+	0x00080000: "plugin_auth",
+	0x00100000: "connect_attrs",
+	0x00200000: "plugin_auth_lenenc_client_data",
+	0x00400000: "can_handle_expired_passwords",
+	0x00800000: "session_track",
+	0x01000000: "deprecate_eof",
+}
+
+var ErrMySQLBadHandshake = errors.New("malformed MySQL handshake packet")
+
+// A MySQLError is returned when the server answers the connection with an
+// error packet instead of a handshake, e.g. because the scanning host is not
+// allowed to connect
+type MySQLError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *MySQLError) Error() string {
+	return "MySQL error " + strconv.Itoa(int(e.Code)) + ": " + e.Message
+}
+
+// A MySQLHandshakeEvent represents the initial handshake packet a MySQL or
+// MariaDB server sends on connect
+type MySQLHandshakeEvent struct {
+	RawData         []byte   `json:"raw_data,omitempty"`
+	ProtocolVersion byte     `json:"protocol_version"`
+	ServerVersion   string   `json:"server_version,omitempty"`
+	ConnectionID    uint32   `json:"connection_id"`
+	Salt            []byte   `json:"salt,omitempty"`
+	Capabilities    uint32   `json:"capability_flags"`
+	CapabilityNames []string `json:"capability_names,omitempty"`
+	CharacterSet    byte     `json:"character_set"`
+	StatusFlags     uint16   `json:"status_flags"`
+	AuthPluginName  string   `json:"auth_plugin_name,omitempty"`
+	ErrorCode       uint16   `json:"error_code,omitempty"`
+	ErrorMessage    string   `json:"error_message,omitempty"`
+}
+
+// MySQLCapabilityNames returns the names of the capability flags that are
+// set, lowest bit first
+func MySQLCapabilityNames(flags uint32) []string {
+	var names []string
+	for bit := uint(0); bit < 32; bit++ {
+		flag := uint32(1) << bit
+		if flags&flag == 0 {
+			continue
+		}
+		if name, ok := mysqlCapabilityNames[flag]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "unknown."+strconv.Itoa(int(flag)))
+		}
+	}
+	return names
+}
+
+// mysqlReader consumes the fields of a packet payload
+type mysqlReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *mysqlReader) next(n int) []byte {
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	out := r.b[0:n]
+	r.b = r.b[n:]
+	return out
+}
+
+// nulString reads a NUL terminated string, or the rest of the payload if
+// the terminator is missing and allowEnd is set
+func (r *mysqlReader) nulString(allowEnd bool) string {
+	if r.err {
+		return ""
+	}
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		if !allowEnd {
+			r.err = true
+			return ""
+		}
+		i = len(r.b)
+	}
+	s := string(r.b[0:i])
+	r.b = r.b[i:]
+	if len(r.b) > 0 {
+		r.b = r.b[1:]
+	}
+	return s
+}
+
+// parseHandshake fills in the event from the payload of the first packet.
+// Protocol version 10 splits the salt into an 8 byte part and a second
+// part after the capability flags; version 9 sends it as a single NUL
+// terminated string.
+func (e *MySQLHandshakeEvent) parseHandshake(payload []byte) error {
+	r := &mysqlReader{b: payload}
+	proto := r.next(1)
+	if r.err {
+		return ErrMySQLBadHandshake
+	}
+	e.ProtocolVersion = proto[0]
+	if e.ProtocolVersion == mysqlErrorPacket {
+		code := r.next(2)
+		if r.err {
+			return ErrMySQLBadHandshake
+		}
+		e.ErrorCode = binary.LittleEndian.Uint16(code)
+		e.ErrorMessage = string(r.b)
+		return &MySQLError{Code: e.ErrorCode, Message: e.ErrorMessage}
+	}
+	e.ServerVersion = r.nulString(false)
+	if id := r.next(4); !r.err {
+		e.ConnectionID = binary.LittleEndian.Uint32(id)
+	}
+	if e.ProtocolVersion < 10 {
+		e.Salt = []byte(r.nulString(true))
+		if r.err {
+			return ErrMySQLBadHandshake
+		}
+		return nil
+	}
+
+	salt := append([]byte(nil), r.next(8)...)
+	r.next(1)
+	lower := r.next(2)
+	if r.err {
+		return ErrMySQLBadHandshake
+	}
+	e.Salt = salt
+	e.Capabilities = uint32(binary.LittleEndian.Uint16(lower))
+	if len(r.b) == 0 {
+		e.CapabilityNames = MySQLCapabilityNames(e.Capabilities)
+		return nil
+	}
+
+	charset := r.next(1)
+	status := r.next(2)
+	upper := r.next(2)
+	saltLen := r.next(1)
+	r.next(10)
+	if r.err {
+		return ErrMySQLBadHandshake
+	}
+	e.CharacterSet = charset[0]
+	e.StatusFlags = binary.LittleEndian.Uint16(status)
+	e.Capabilities |= uint32(binary.LittleEndian.Uint16(upper)) << 16
+	e.CapabilityNames = MySQLCapabilityNames(e.Capabilities)
+
+	if e.Capabilities&mysqlClientSecureConnection != 0 {
+		n := int(saltLen[0]) - 8
+		if n < 13 {
+			n = 13
+		}
+		if n > len(r.b) {
+			n = len(r.b)
+		}
+		part := r.next(n)
+		e.Salt = append(e.Salt, bytes.TrimRight(part, "\x00")...)
+	}
+	if e.Capabilities&mysqlClientPluginAuth != 0 {
+		e.AuthPluginName = r.nulString(true)
+	}
+	return nil
+}
+
+// MySQLHandshake reads the initial handshake packet the server sends on
+// connect, recording the server version, salt, capability flags and
+// authentication plugin. Nothing is sent, so this must run before anything
+// else on the connection.
+func (c *Conn) MySQLHandshake() (*MySQLHandshakeEvent, error) {
+	event := new(MySQLHandshakeEvent)
+	c.grabData.MySQL = event
+	var header [4]byte
+	if _, err := io.ReadFull(c.getUnderlyingConn(), header[:]); err != nil {
+		return event, err
+	}
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if size == 0 || size > mysqlMaxPacketSize {
+		return event, ErrMySQLBadHandshake
+	}
+	payload := make([]byte, size)
+	n, err := io.ReadFull(c.getUnderlyingConn(), payload)
+	event.RawData = c.recordRaw(payload[0:n])
+	if err != nil {
+		return event, err
+	}
+	return event, event.parseHandshake(payload)
+}
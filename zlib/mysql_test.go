@@ -0,0 +1,88 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mysqlHandshakeV10 is the handshake of a MySQL 8.0 server
+var mysqlHandshakeV10 = []byte{
+	0x4a, 0x00, 0x00, 0x00,
+	0x0a, '8', '.', '0', '.', '3', '6', 0x00,
+	0x0d, 0x00, 0x00, 0x00,
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x00,
+	0xff, 0xff, 0xff, 0x02, 0x00, 0xff, 0xdf, 0x15,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14, 0x00,
+	'c', 'a', 'c', 'h', 'i', 'n', 'g', '_', 's', 'h', 'a', '2', '_',
+	'p', 'a', 's', 's', 'w', 'o', 'r', 'd', 0x00,
+}
+
+func TestMySQLHandshake(t *testing.T) {
+	conn := NewReplayConn(ReplayRead(string(mysqlHandshakeV10)))
+	c := &Conn{conn: conn}
+	event, err := c.MySQLHandshake()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if event.ProtocolVersion != 10 || event.ServerVersion != "8.0.36" || event.ConnectionID != 13 {
+		t.Errorf("unexpected header fields: %+v", event)
+	}
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	if !bytes.Equal(event.Salt, salt) {
+		t.Errorf("expected salt %x, got %x", salt, event.Salt)
+	}
+	if event.Capabilities != 0xdfffffff || event.CharacterSet != 0xff || event.StatusFlags != 2 {
+		t.Errorf("unexpected flags: %+v", event)
+	}
+	if event.AuthPluginName != "caching_sha2_password" {
+		t.Errorf("expected caching_sha2_password, got %q", event.AuthPluginName)
+	}
+	if err := conn.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMySQLHandshakeV9(t *testing.T) {
+	payload := []byte("\x093.23.58\x00\x05\x00\x00\x00abcdefgh\x00")
+	e := new(MySQLHandshakeEvent)
+	if err := e.parseHandshake(payload); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if e.ServerVersion != "3.23.58" || e.ConnectionID != 5 || string(e.Salt) != "abcdefgh" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func TestMySQLHandshakeError(t *testing.T) {
+	payload := []byte("\xff\x6a\x04Host '10.0.0.1' is not allowed to connect to this MySQL server")
+	e := new(MySQLHandshakeEvent)
+	err := e.parseHandshake(payload)
+	if merr, ok := err.(*MySQLError); !ok || merr.Code != 1130 {
+		t.Fatalf("expected a MySQLError with code 1130, got %v", err)
+	}
+	if e.ErrorCode != 1130 {
+		t.Errorf("expected the error to be recorded, got %d", e.ErrorCode)
+	}
+}
+
+func TestMySQLCapabilityNames(t *testing.T) {
+	names := MySQLCapabilityNames(0x00080200)
+	if len(names) != 2 || names[0] != "protocol_41" || names[1] != "plugin_auth" {
+		t.Errorf("unexpected names: %v", names)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/x509/pkix"
+)
+
+var (
+	ErrNoStapledOCSP         = errors.New("the server did not staple an OCSP response")
+	ErrNoIssuerCertificate   = errors.New("the server did not present the leaf certificate's issuer")
+	ErrOCSPMalformed         = errors.New("malformed OCSP response")
+	ErrOCSPUnsuccessful      = errors.New("OCSP responder did not return a successful response")
+	ErrOCSPNoMatchingStatus  = errors.New("OCSP response has no status for the leaf certificate")
+	ErrOCSPResponderNotValid = errors.New("OCSP responder certificate is not authorized by the issuer")
+	ErrOCSPStatusUnknown     = errors.New("OCSP responder does not know the leaf certificate")
+	ErrOCSPStale             = errors.New("OCSP response is past its next update")
+	ErrOCSPNotYetValid       = errors.New("OCSP response is not valid yet")
+)
+
+// An OCSPRevokedError is returned by StapledOCSPStatus when the stapled
+// response says the leaf certificate is revoked
+type OCSPRevokedError struct {
+	RevokedAt time.Time
+	Reason    int
+}
+
+func (e *OCSPRevokedError) Error() string {
+	return "certificate was revoked at " + e.RevokedAt.Format(time.RFC3339)
+}
+
+var oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// The ASN.1 structures of an OCSP response, from RFC 6960 section 4.2.1
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw            asn1.RawContent
+	Version        int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID asn1.RawValue
+	ProducedAt     time.Time `asn1:"generalized"`
+	Responses      []ocspSingleResponse
+}
+
+type ocspSingleResponse struct {
+	CertID           ocspCertID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspHashes maps the CertID hash algorithms to their hash functions
+var ocspHashes = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// matches reports whether id names the certificate with serial issued by
+// issuer. The issuer is identified by the hashes of its subject and of its
+// public key, as serial numbers are only unique per issuer.
+func (id *ocspCertID) matches(serial *big.Int, issuer *x509.Certificate) bool {
+	if id.SerialNumber == nil || id.SerialNumber.Cmp(serial) != 0 {
+		return false
+	}
+	hash, ok := ocspHashes[id.HashAlgorithm.Algorithm.String()]
+	if !ok {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	if !bytes.Equal(id.NameHash, h.Sum(nil)) {
+		return false
+	}
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(id.IssuerKeyHash, h.Sum(nil))
+}
+
+// parseOCSPResponse decodes a DER OCSP response down to its basic response
+func parseOCSPResponse(der []byte) (*ocspBasicResponse, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil || len(rest) > 0 {
+		return nil, ErrOCSPMalformed
+	}
+	if resp.Status != 0 {
+		return nil, ErrOCSPUnsuccessful
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasicResponse) {
+		return nil, ErrOCSPMalformed
+	}
+	basic := new(ocspBasicResponse)
+	if rest, err := asn1.Unmarshal(resp.Response.Response, basic); err != nil || len(rest) > 0 {
+		return nil, ErrOCSPMalformed
+	}
+	return basic, nil
+}
+
+// checkSignature verifies the response was signed by issuer, or by a
+// responder certificate included in the response that issuer delegated OCSP
+// signing to.
+func (b *ocspBasicResponse) checkSignature(issuer *x509.Certificate) error {
+	signer := issuer
+	if len(b.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(b.Certificates[0].FullBytes)
+		if err != nil {
+			return ErrOCSPMalformed
+		}
+		if !responder.Equal(issuer) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return err
+			}
+			delegated := false
+			for _, usage := range responder.ExtKeyUsage {
+				delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+			}
+			if !delegated {
+				return ErrOCSPResponderNotValid
+			}
+			signer = responder
+		}
+	}
+	algo := x509.SignatureAlgorithmFromOID(b.SignatureAlgorithm.Algorithm)
+	return signer.CheckSignature(algo, b.TBSResponseData.Raw, b.Signature.RightAlign())
+}
+
+// StapledOCSPStatus parses the OCSP response stapled in the last TLS
+// handshake, checks it was signed by the issuer of the leaf certificate, and
+// returns the status of the leaf and the window the status is valid for. A
+// response outside that window is reported as ErrOCSPStale or
+// ErrOCSPNotYetValid, a revoked certificate as an OCSPRevokedError and an
+// unknown one as ErrOCSPStatusUnknown, with the window still filled in.
+func (c *Conn) StapledOCSPStatus() (good bool, thisUpdate, nextUpdate time.Time, err error) {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || len(hl.OCSPResponse) == 0 {
+		return false, thisUpdate, nextUpdate, ErrNoStapledOCSP
+	}
+	leaf := c.leafCertificate()
+	if leaf == nil {
+		return false, thisUpdate, nextUpdate, ErrNoLeafCertificate
+	}
+	certs := c.AllPresentedCertificates()
+	if len(certs) < 2 {
+		return false, thisUpdate, nextUpdate, ErrNoIssuerCertificate
+	}
+	issuer := certs[1]
+
+	basic, err := parseOCSPResponse(hl.OCSPResponse)
+	if err != nil {
+		return false, thisUpdate, nextUpdate, err
+	}
+	if err = basic.checkSignature(issuer); err != nil {
+		return false, thisUpdate, nextUpdate, err
+	}
+	for _, single := range basic.TBSResponseData.Responses {
+		if !single.CertID.matches(leaf.SerialNumber, issuer) {
+			continue
+		}
+		thisUpdate, nextUpdate = single.ThisUpdate, single.NextUpdate
+		now := time.Now()
+		switch {
+		case now.Before(thisUpdate):
+			return false, thisUpdate, nextUpdate, ErrOCSPNotYetValid
+		case !nextUpdate.IsZero() && now.After(nextUpdate):
+			return false, thisUpdate, nextUpdate, ErrOCSPStale
+		}
+		switch {
+		case bool(single.Good):
+			return true, thisUpdate, nextUpdate, nil
+		case bool(single.Unknown):
+			return false, thisUpdate, nextUpdate, ErrOCSPStatusUnknown
+		default:
+			return false, thisUpdate, nextUpdate, &OCSPRevokedError{
+				RevokedAt: single.Revoked.RevocationTime,
+				Reason:    int(single.Revoked.Reason),
+			}
+		}
+	}
+	return false, thisUpdate, nextUpdate, ErrOCSPNoMatchingStatus
+}
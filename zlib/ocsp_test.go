@@ -0,0 +1,182 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/x509/pkix"
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// ocspTestResponse builds an OCSP response for the certificate with serial
+// issued by issuer, signed by key
+func ocspTestResponse(t *testing.T, key *ecdsa.PrivateKey, issuer *testCert, serial int64, single ocspSingleResponse) []byte {
+	point, err := issuer.key.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameHash, keyHash := sha1.Sum(issuer.cert.RawSubject), sha1.Sum(point)
+	single.CertID = ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  big.NewInt(serial),
+	}
+	data := ocspResponseData{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: []byte{0x04, 0x00}},
+		ProducedAt:     single.ThisUpdate,
+		Responses:      []ocspSingleResponse{single},
+	}
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		t.Fatalf("could not marshal response data: %s", err)
+	}
+	digest := sha256.Sum256(tbs)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("could not sign: %s", err)
+	}
+	data.Raw = tbs
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    data,
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal basic response: %s", err)
+	}
+	der, err := asn1.Marshal(ocspResponse{
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasicResponse, Response: basic},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal response: %s", err)
+	}
+	return der
+}
+
+func TestStapledOCSPStatus(t *testing.T) {
+	ca := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	leaf := issueTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+	}, ca)
+	c := new(Conn)
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{
+		ServerCertificates: &ztls.Certificates{
+			Certificate: ztls.SimpleCertificate{Raw: leaf.cert.Raw},
+			Chain:       []ztls.SimpleCertificate{{Raw: ca.cert.Raw}},
+		},
+	}
+	if _, _, _, err := c.StapledOCSPStatus(); err != ErrNoStapledOCSP {
+		t.Errorf("expected ErrNoStapledOCSP, got %v", err)
+	}
+
+	thisUpdate := time.Now().UTC().Truncate(time.Second)
+	nextUpdate := thisUpdate.Add(24 * time.Hour)
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, ca, 42, ocspSingleResponse{
+		Good:       true,
+		ThisUpdate: thisUpdate,
+		NextUpdate: nextUpdate,
+	})
+	good, this, next, err := c.StapledOCSPStatus()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !good || !this.Equal(thisUpdate) || !next.Equal(nextUpdate) {
+		t.Errorf("wrong status: %t, %s, %s", good, this, next)
+	}
+
+	revokedAt := thisUpdate.Add(-time.Hour)
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, ca, 42, ocspSingleResponse{
+		Revoked:    ocspRevokedInfo{RevocationTime: revokedAt, Reason: 1},
+		ThisUpdate: thisUpdate,
+	})
+	good, _, _, err = c.StapledOCSPStatus()
+	if revoked, ok := err.(*OCSPRevokedError); good || !ok || !revoked.RevokedAt.Equal(revokedAt) || revoked.Reason != 1 {
+		t.Errorf("expected revocation, got %t and %v", good, err)
+	}
+
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, ca, 42, ocspSingleResponse{
+		Unknown:    true,
+		ThisUpdate: thisUpdate,
+	})
+	if _, _, _, err = c.StapledOCSPStatus(); err != ErrOCSPStatusUnknown {
+		t.Errorf("expected ErrOCSPStatusUnknown, got %v", err)
+	}
+
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, ca, 7, ocspSingleResponse{
+		Good:       true,
+		ThisUpdate: thisUpdate,
+	})
+	if _, _, _, err = c.StapledOCSPStatus(); err != ErrOCSPNoMatchingStatus {
+		t.Errorf("expected ErrOCSPNoMatchingStatus, got %v", err)
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, otherKey, ca, 42, ocspSingleResponse{
+		Good:       true,
+		ThisUpdate: thisUpdate,
+	})
+	if good, _, _, err = c.StapledOCSPStatus(); good || err == nil {
+		t.Error("expected a signature error")
+	}
+
+	// A response for another issuer's certificate with the same serial
+	impostor := issueTestCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "Test CA"},
+		IsCA:    true,
+	}, nil)
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, impostor, 42, ocspSingleResponse{
+		Good:       true,
+		ThisUpdate: thisUpdate,
+	})
+	if _, _, _, err = c.StapledOCSPStatus(); err != ErrOCSPNoMatchingStatus {
+		t.Errorf("expected ErrOCSPNoMatchingStatus for another issuer, got %v", err)
+	}
+
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, ca, 42, ocspSingleResponse{
+		Good:       true,
+		ThisUpdate: thisUpdate.Add(-48 * time.Hour),
+		NextUpdate: thisUpdate.Add(-24 * time.Hour),
+	})
+	if good, _, _, err = c.StapledOCSPStatus(); good || err != ErrOCSPStale {
+		t.Errorf("expected ErrOCSPStale, got %t and %v", good, err)
+	}
+
+	c.grabData.TLSHandshake.OCSPResponse = ocspTestResponse(t, ca.key, ca, 42, ocspSingleResponse{
+		Good:       true,
+		ThisUpdate: thisUpdate.Add(time.Hour),
+	})
+	if good, _, _, err = c.StapledOCSPStatus(); good || err != ErrOCSPNotYetValid {
+		t.Errorf("expected ErrOCSPNotYetValid, got %t and %v", good, err)
+	}
+}
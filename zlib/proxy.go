@@ -0,0 +1,124 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// proxyV2Signature starts every version 2 PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Proxy = 0x21 // version 2, PROXY command
+	proxyV2TCP4  = 0x11 // AF_INET, STREAM
+	proxyV2TCP6  = 0x21 // AF_INET6, STREAM
+)
+
+var ErrProxyHeaderAddrs = errors.New("PROXY header addresses must both be TCP4 or both be TCP6")
+
+// A ProxyHeaderEvent represents sending a PROXY protocol header at the start
+// of the connection
+type ProxyHeaderEvent struct {
+	Version int    `json:"version"`
+	Source  string `json:"source"`
+	Dest    string `json:"destination"`
+	Header  []byte `json:"header"`
+}
+
+// SetProxyHeaderVersion selects the text (1) or binary (2) form of the PROXY
+// protocol header sent by SendProxyHeader. The default is 1.
+func (c *Conn) SetProxyHeaderVersion(version int) {
+	c.proxyHeaderVersion = version
+}
+
+// SendProxyHeader writes a PROXY protocol header claiming the connection is
+// from src to dst, for targets behind load balancers that expect one. It must
+// be called before any other data, including banners, is read or written.
+func (c *Conn) SendProxyHeader(src, dst net.Addr) error {
+	version := c.proxyHeaderVersion
+	if version == 0 {
+		version = 1
+	}
+	header, err := makeProxyHeader(version, src, dst)
+	if err != nil {
+		return err
+	}
+	c.grabData.ProxyHeader = &ProxyHeaderEvent{
+		Version: version,
+		Source:  src.String(),
+		Dest:    dst.String(),
+		Header:  header,
+	}
+	_, err = c.getUnderlyingConn().Write(header)
+	return err
+}
+
+func makeProxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcTCP, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, ErrProxyHeaderAddrs
+	}
+	dstTCP, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, ErrProxyHeaderAddrs
+	}
+	srcIP, dstIP := srcTCP.IP.To4(), dstTCP.IP.To4()
+	tcp6 := srcIP == nil
+	if tcp6 {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		if dstTCP.IP.To4() != nil {
+			return nil, ErrProxyHeaderAddrs
+		}
+	}
+	if srcIP == nil || dstIP == nil {
+		return nil, ErrProxyHeaderAddrs
+	}
+
+	switch version {
+	case 1:
+		family := "TCP4"
+		if tcp6 {
+			family = "TCP6"
+		}
+		return []byte("PROXY " + family + " " + srcIP.String() + " " + dstIP.String() + " " +
+			strconv.Itoa(srcTCP.Port) + " " + strconv.Itoa(dstTCP.Port) + "\r\n"), nil
+	case 2:
+		family := byte(proxyV2TCP4)
+		if tcp6 {
+			family = proxyV2TCP6
+		}
+		var addrs []byte
+		addrs = append(addrs, srcIP...)
+		addrs = append(addrs, dstIP...)
+		var ports [4]byte
+		binary.BigEndian.PutUint16(ports[0:2], uint16(srcTCP.Port))
+		binary.BigEndian.PutUint16(ports[2:4], uint16(dstTCP.Port))
+		addrs = append(addrs, ports[:]...)
+
+		header := append([]byte(nil), proxyV2Signature...)
+		header = append(header, proxyV2Proxy, family)
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(addrs)))
+		header = append(header, length[:]...)
+		return append(header, addrs...), nil
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version %d", version)
+	}
+}
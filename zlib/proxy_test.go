@@ -0,0 +1,56 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443}
+	header, err := makeProxyHeader(1, src, dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n"; string(header) != expected {
+		t.Errorf("expected %q, got %q", expected, header)
+	}
+
+	src.IP = net.ParseIP("2001:db8::1")
+	if _, err := makeProxyHeader(1, src, dst); err != ErrProxyHeaderAddrs {
+		t.Errorf("expected ErrProxyHeaderAddrs for mixed families, got %v", err)
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}
+	header, err := makeProxyHeader(2, src, dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(header) != 16+36 || !bytes.HasPrefix(header, proxyV2Signature) {
+		t.Fatalf("wrong v2 header %x", header)
+	}
+	if !bytes.Equal(header[12:16], []byte{0x21, 0x21, 0x00, 0x24}) {
+		t.Errorf("wrong v2 command, family or length %x", header[12:16])
+	}
+	if header[len(header)-1] != 2 || header[len(header)-3] != 1 {
+		t.Errorf("wrong v2 ports %x", header[len(header)-4:])
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	tpktVersion = 3
+
+	x224ConnectionRequest = 0xe0
+	x224ConnectionConfirm = 0xd0
+
+	rdpNegRequest  = 0x01
+	rdpNegResponse = 0x02
+	rdpNegFailure  = 0x03
+
+	// Security protocols from [MS-RDPBCGR] 2.2.1.1.1
+	RDPProtocolRDP      = 0x00000000
+	RDPProtocolSSL      = 0x00000001
+	RDPProtocolHybrid   = 0x00000002
+	RDPProtocolRDSTLS   = 0x00000004
+	RDPProtocolHybridEx = 0x00000008
+	RDPProtocolRDSAAD   = 0x00000010
+
+	// rdpRequestedProtocols asks for TLS and CredSSP, which every server
+	// from Windows Server 2008 on supports
+	rdpRequestedProtocols = RDPProtocolSSL | RDPProtocolHybrid | RDPProtocolHybridEx
+
+	// The Connection Confirm is a few dozen bytes
+	rdpMaxPacketSize = 1024
+)
+
+var rdpProtocolNames = map[uint32]string{
+	RDPProtocolSSL:      "ssl",
+	RDPProtocolHybrid:   "hybrid",
+	RDPProtocolRDSTLS:   "rdstls",
+	RDPProtocolHybridEx: "hybrid_ex",
+	RDPProtocolRDSAAD:   "rdsaad",
+}
+
+var rdpFailureNames = map[uint32]string{
+	1: "ssl_required_by_server",
+	2: "ssl_not_allowed_by_server",
+	3: "ssl_cert_not_on_server",
+	4: "inconsistent_flags",
+	5: "hybrid_required_by_server",
+	6: "ssl_with_user_auth_required_by_server",
+}
+
+var ErrRDPBadResponse = errors.New("malformed RDP Connection Confirm")
+
+// An RDPNegotiateEvent represents sending an X.224 Connection Request with an
+// RDP Negotiation Request, and the protocol the server selected or the
+// reason it refused
+type RDPNegotiateEvent struct {
+	RawData            []byte   `json:"raw_data,omitempty"`
+	RequestedProtocols uint32   `json:"requested_protocols"`
+	RequestedNames     []string `json:"requested_names,omitempty"`
+	SelectedProtocol   *uint32  `json:"selected_protocol,omitempty"`
+	SelectedName       string   `json:"selected_name,omitempty"`
+	ResponseFlags      byte     `json:"response_flags,omitempty"`
+	FailureCode        *uint32  `json:"failure_code,omitempty"`
+	FailureName        string   `json:"failure_name,omitempty"`
+}
+
+// RDPProtocolNames returns the names of the security protocol flags set in
+// protocols, or "rdp" for standard RDP security
+func RDPProtocolNames(protocols uint32) []string {
+	if protocols == RDPProtocolRDP {
+		return []string{"rdp"}
+	}
+	var names []string
+	for bit := uint(0); bit < 32; bit++ {
+		flag := uint32(1) << bit
+		if protocols&flag == 0 {
+			continue
+		}
+		if name, ok := rdpProtocolNames[flag]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "unknown."+strconv.Itoa(int(flag)))
+		}
+	}
+	return names
+}
+
+// UsesTLS returns true if the selected protocol continues with a TLS
+// handshake
+func (e *RDPNegotiateEvent) UsesTLS() bool {
+	return e.SelectedProtocol != nil && *e.SelectedProtocol != RDPProtocolRDP
+}
+
+// rdpConnectionRequest builds a TPKT wrapped X.224 Connection Request
+// carrying an RDP Negotiation Request for protocols
+func rdpConnectionRequest(protocols uint32) []byte {
+	neg := make([]byte, 8)
+	neg[0] = rdpNegRequest
+	binary.LittleEndian.PutUint16(neg[2:4], uint16(len(neg)))
+	binary.LittleEndian.PutUint32(neg[4:8], protocols)
+
+	// Length indicator, code, destination and source references, class
+	x224 := []byte{byte(6 + len(neg)), x224ConnectionRequest, 0, 0, 0, 0, 0}
+	x224 = append(x224, neg...)
+
+	packet := []byte{tpktVersion, 0, 0, 0}
+	binary.BigEndian.PutUint16(packet[2:4], uint16(4+len(x224)))
+	return append(packet, x224...)
+}
+
+// parseConnectionConfirm fills in the event from the X.224 Connection
+// Confirm following the TPKT header. A confirm without negotiation data
+// comes from a server that only speaks standard RDP security.
+func (e *RDPNegotiateEvent) parseConnectionConfirm(b []byte) error {
+	if len(b) < 7 || b[1] != x224ConnectionConfirm || int(b[0])+1 > len(b) {
+		return ErrRDPBadResponse
+	}
+	neg := b[7 : int(b[0])+1]
+	if len(neg) == 0 {
+		selected := uint32(RDPProtocolRDP)
+		e.SelectedProtocol = &selected
+		e.SelectedName = "rdp"
+		return nil
+	}
+	if len(neg) < 8 || binary.LittleEndian.Uint16(neg[2:4]) != 8 {
+		return ErrRDPBadResponse
+	}
+	value := binary.LittleEndian.Uint32(neg[4:8])
+	switch neg[0] {
+	case rdpNegResponse:
+		e.ResponseFlags = neg[1]
+		e.SelectedProtocol = &value
+		if names := RDPProtocolNames(value); len(names) == 1 {
+			e.SelectedName = names[0]
+		}
+	case rdpNegFailure:
+		e.FailureCode = &value
+		if name, ok := rdpFailureNames[value]; ok {
+			e.FailureName = name
+		} else {
+			e.FailureName = "unknown." + strconv.Itoa(int(value))
+		}
+	default:
+		return ErrRDPBadResponse
+	}
+	return nil
+}
+
+// RDPNegotiate sends an X.224 Connection Request offering TLS and CredSSP
+// and records which security protocol the server selected, or why it
+// refused. If the server selected a TLS based protocol, TLSHandshake can be
+// called next on the same connection.
+func (c *Conn) RDPNegotiate() (*RDPNegotiateEvent, error) {
+	event := &RDPNegotiateEvent{
+		RequestedProtocols: rdpRequestedProtocols,
+		RequestedNames:     RDPProtocolNames(rdpRequestedProtocols),
+	}
+	c.grabData.RDP = event
+	if _, err := c.getUnderlyingConn().Write(rdpConnectionRequest(rdpRequestedProtocols)); err != nil {
+		return event, err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(c.getUnderlyingConn(), header[:]); err != nil {
+		return event, err
+	}
+	size := int(binary.BigEndian.Uint16(header[2:4]))
+	if header[0] != tpktVersion || size <= len(header) || size > rdpMaxPacketSize {
+		event.RawData = c.recordRaw(header[:])
+		return event, ErrRDPBadResponse
+	}
+	body := make([]byte, size-len(header))
+	n, err := io.ReadFull(c.getUnderlyingConn(), body)
+	event.RawData = c.recordRaw(append(header[:], body[0:n]...))
+	if err != nil {
+		return event, err
+	}
+	return event, event.parseConnectionConfirm(body)
+}
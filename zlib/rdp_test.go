@@ -0,0 +1,78 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRDPConnectionRequest(t *testing.T) {
+	expected := []byte{
+		0x03, 0x00, 0x00, 0x13,
+		0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x08, 0x00, 0x0b, 0x00, 0x00, 0x00,
+	}
+	if got := rdpConnectionRequest(rdpRequestedProtocols); !bytes.Equal(got, expected) {
+		t.Errorf("expected %x, got %x", expected, got)
+	}
+}
+
+func TestRDPNegotiate(t *testing.T) {
+	replay := NewReplayConn(
+		ReplayWrite(string(rdpConnectionRequest(rdpRequestedProtocols))),
+		ReplayRead("\x03\x00\x00\x13\x0e\xd0\x00\x00\x12\x34\x00\x02\x1f\x08\x00\x02\x00\x00\x00"),
+	)
+	c := &Conn{conn: replay}
+	event, err := c.RDPNegotiate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if event.SelectedProtocol == nil || *event.SelectedProtocol != RDPProtocolHybrid || event.SelectedName != "hybrid" {
+		t.Errorf("expected hybrid to be selected, got %+v", event)
+	}
+	if event.ResponseFlags != 0x1f || !event.UsesTLS() {
+		t.Errorf("unexpected response flags %x", event.ResponseFlags)
+	}
+	if !reflect.DeepEqual(event.RequestedNames, []string{"ssl", "hybrid", "hybrid_ex"}) {
+		t.Errorf("wrong requested names %v", event.RequestedNames)
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRDPParseConnectionConfirm(t *testing.T) {
+	e := new(RDPNegotiateEvent)
+	if err := e.parseConnectionConfirm([]byte("\x0e\xd0\x00\x00\x12\x34\x00\x03\x00\x08\x00\x05\x00\x00\x00")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if e.FailureCode == nil || *e.FailureCode != 5 || e.FailureName != "hybrid_required_by_server" || e.UsesTLS() {
+		t.Errorf("expected a hybrid_required_by_server failure, got %+v", e)
+	}
+
+	e = new(RDPNegotiateEvent)
+	if err := e.parseConnectionConfirm([]byte("\x06\xd0\x00\x00\x12\x34\x00")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if e.SelectedName != "rdp" || e.UsesTLS() {
+		t.Errorf("expected standard RDP security, got %+v", e)
+	}
+
+	if err := new(RDPNegotiateEvent).parseConnectionConfirm([]byte("\x0e\xe0\x00")); err != ErrRDPBadResponse {
+		t.Errorf("expected ErrRDPBadResponse, got %v", err)
+	}
+}
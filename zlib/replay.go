@@ -0,0 +1,145 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A ReplayStep is one read or write in a scripted ReplayConn session
+type ReplayStep struct {
+	// Write is true if the step expects the client to write Data, and false
+	// if Data is returned to the client by Read
+	Write bool
+	Data  []byte
+}
+
+// ReplayRead returns a step that feeds data to the next Read calls
+func ReplayRead(data string) ReplayStep {
+	return ReplayStep{Data: []byte(data)}
+}
+
+// ReplayWrite returns a step that expects the next Write calls to send data
+func ReplayWrite(data string) ReplayStep {
+	return ReplayStep{Write: true, Data: []byte(data)}
+}
+
+// ReplayConn is a net.Conn that plays back a scripted session, so that the
+// protocol methods of Conn can be tested without a socket. Reads return the
+// data of read steps in order, and writes must match the data of write
+// steps. A step may be consumed by several calls. Once the script is done,
+// Read returns io.EOF.
+type ReplayConn struct {
+	steps  []ReplayStep
+	offset int
+	closed bool
+}
+
+// NewReplayConn returns a ReplayConn that plays back steps
+func NewReplayConn(steps ...ReplayStep) *ReplayConn {
+	return &ReplayConn{steps: steps}
+}
+
+// next returns the remaining data of the current step, dropping steps that
+// have been consumed
+func (r *ReplayConn) next() (*ReplayStep, []byte) {
+	for len(r.steps) > 0 && r.offset == len(r.steps[0].Data) {
+		r.steps = r.steps[1:]
+		r.offset = 0
+	}
+	if len(r.steps) == 0 {
+		return nil, nil
+	}
+	return &r.steps[0], r.steps[0].Data[r.offset:]
+}
+
+func (r *ReplayConn) Read(b []byte) (int, error) {
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	step, data := r.next()
+	if step == nil {
+		return 0, io.EOF
+	}
+	if step.Write {
+		return 0, fmt.Errorf("replay: read while expecting write of %q", data)
+	}
+	n := copy(b, data)
+	r.offset += n
+	return n, nil
+}
+
+func (r *ReplayConn) Write(b []byte) (int, error) {
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for written < len(b) {
+		step, data := r.next()
+		if step == nil || !step.Write {
+			return written, fmt.Errorf("replay: unexpected write of %q", b[written:])
+		}
+		n := len(b) - written
+		if n > len(data) {
+			n = len(data)
+		}
+		if !bytes.Equal(b[written:written+n], data[0:n]) {
+			return written, fmt.Errorf("replay: wrote %q, expected %q", b[written:written+n], data[0:n])
+		}
+		r.offset += n
+		written += n
+	}
+	return written, nil
+}
+
+// Done returns an error if part of the script has not been played back
+func (r *ReplayConn) Done() error {
+	if step, data := r.next(); step != nil {
+		if step.Write {
+			return fmt.Errorf("replay: expected write of %q", data)
+		}
+		return fmt.Errorf("replay: %q was never read", data)
+	}
+	return nil
+}
+
+func (r *ReplayConn) Close() error {
+	r.closed = true
+	return nil
+}
+
+func (r *ReplayConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (r *ReplayConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (r *ReplayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (r *ReplayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (r *ReplayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
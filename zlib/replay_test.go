@@ -0,0 +1,48 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import "testing"
+
+func TestReplayConnSMTP(t *testing.T) {
+	replay := NewReplayConn(
+		ReplayRead("220 mx.example.com ESMTP\r\n"),
+		ReplayWrite("EHLO scanner.example.com\r\n"),
+		ReplayRead("250-mx.example.com\r\n250 STARTTLS\r\n"),
+	)
+	c := &Conn{conn: replay}
+	if _, err := c.SMTPBanner(make([]byte, 512)); err != nil {
+		t.Fatalf("unexpected error reading banner: %s", err)
+	}
+	if err := c.EHLO("scanner.example.com"); err != nil {
+		t.Fatalf("unexpected error sending EHLO: %s", err)
+	}
+	if c.grabData.EHLO != "250-mx.example.com\r\n250 STARTTLS\r\n" {
+		t.Errorf("wrong EHLO response %q", c.grabData.EHLO)
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplayConnUnexpectedWrite(t *testing.T) {
+	replay := NewReplayConn(ReplayWrite("EHLO a\r\n"))
+	if _, err := replay.Write([]byte("HELO a\r\n")); err == nil {
+		t.Error("expected an error for a mismatched write")
+	}
+	if err := replay.Done(); err == nil {
+		t.Error("expected Done to report the unplayed write")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+// Only named curves are used in practice
+const ecCurveTypeNamed = 3
+
+var ErrServerKeyExchangeParse = errors.New("malformed ServerKeyExchange message")
+
+var ErrNoServerKeyExchange = errors.New("server did not send a ServerKeyExchange message")
+
+// ErrUnsupportedKeyExchange is returned by ParseServerKeyExchange for key
+// exchanges other than DHE and ECDHE with a named curve
+var ErrUnsupportedKeyExchange = errors.New("ServerKeyExchange is not DHE or named curve ECDHE")
+
+// ServerKeyExchangeParams are the fields of a DHE or ECDHE ServerKeyExchange
+// message. Params is the exact byte span the signature covers, after the
+// client and server randoms.
+type ServerKeyExchangeParams struct {
+	Params      []byte                 `json:"params"`
+	DHPrime     []byte                 `json:"dh_prime,omitempty"`
+	DHGenerator []byte                 `json:"dh_generator,omitempty"`
+	DHPublic    []byte                 `json:"dh_public,omitempty"`
+	NamedCurve  uint16                 `json:"named_curve,omitempty"`
+	ECPoint     []byte                 `json:"ec_point,omitempty"`
+	SigAndHash  *ztls.SignatureAndHash `json:"signature_and_hash,omitempty"`
+	Signature   []byte                 `json:"signature,omitempty"`
+}
+
+// skxReader reads the length prefixed fields of a key exchange message
+type skxReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *skxReader) next(n int) []byte {
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	out := r.b[0:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *skxReader) vector(lenBytes int) []byte {
+	l := r.next(lenBytes)
+	if r.err {
+		return nil
+	}
+	n := 0
+	for _, b := range l {
+		n = n<<8 | int(b)
+	}
+	return r.next(n)
+}
+
+// ParseServerKeyExchange splits the body of a ServerKeyExchange message, as
+// recorded in ServerKeyExchange.Raw, into its parameters and signature. The
+// key exchange is taken from the name of the negotiated suite, and version
+// decides whether the signature is preceded by its algorithms. Anonymous
+// suites have no signature.
+func ParseServerKeyExchange(raw []byte, suite ztls.CipherSuite, version ztls.TLSVersion) (*ServerKeyExchangeParams, error) {
+	name := suite.String()
+	p := new(ServerKeyExchangeParams)
+	r := &skxReader{b: raw}
+	switch {
+	case strings.Contains(name, "_ECDHE_") || strings.Contains(name, "_ECDH_anon_"):
+		curveType := r.next(1)
+		if r.err {
+			return nil, ErrServerKeyExchangeParse
+		}
+		if curveType[0] != ecCurveTypeNamed {
+			return nil, ErrUnsupportedKeyExchange
+		}
+		curve := r.next(2)
+		p.ECPoint = r.vector(1)
+		if !r.err {
+			p.NamedCurve = uint16(curve[0])<<8 | uint16(curve[1])
+		}
+	case strings.Contains(name, "_DHE_") || strings.Contains(name, "_DH_anon_"):
+		p.DHPrime = r.vector(2)
+		p.DHGenerator = r.vector(2)
+		p.DHPublic = r.vector(2)
+	default:
+		return nil, ErrUnsupportedKeyExchange
+	}
+	if r.err {
+		return nil, ErrServerKeyExchangeParse
+	}
+	p.Params = raw[0 : len(raw)-len(r.b)]
+	if len(r.b) == 0 {
+		return p, nil
+	}
+
+	if version >= ztls.VersionTLS12 {
+		algs := r.next(2)
+		if !r.err {
+			sh := ztls.SignatureAndHashFromCode(uint16(algs[0])<<8 | uint16(algs[1]))
+			p.SigAndHash = &sh
+		}
+	}
+	p.Signature = r.vector(2)
+	if r.err || len(r.b) != 0 {
+		return nil, ErrServerKeyExchangeParse
+	}
+	return p, nil
+}
+
+// ServerKeyExchange returns the body of the ServerKeyExchange message from
+// the last handshake, or nil if the server did not send one
+func (c *Conn) ServerKeyExchange() []byte {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerKeyExchange == nil {
+		return nil
+	}
+	return hl.ServerKeyExchange.Raw
+}
+
+// ServerKeyExchangeParams parses the ServerKeyExchange message from the last
+// handshake with ParseServerKeyExchange. It works from the raw message, so
+// it gives the parameters even when ztls could not use them.
+func (c *Conn) ServerKeyExchangeParams() (*ServerKeyExchangeParams, error) {
+	raw := c.ServerKeyExchange()
+	if raw == nil || c.grabData.TLSHandshake.ServerHello == nil {
+		return nil, ErrNoServerKeyExchange
+	}
+	sh := c.grabData.TLSHandshake.ServerHello
+	return ParseServerKeyExchange(raw, sh.CipherSuite, sh.Version)
+}
+
+// PSKIdentityHint returns the identity hint from the ServerKeyExchange of the
+// last handshake, or "" if the server chose a suite other than PSK or sent
+// no hint. ztls cannot finish a PSK handshake, but it records the hint
+// before giving up.
+func (c *Conn) PSKIdentityHint() string {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerKeyExchange == nil {
+		return ""
+	}
+	return hl.ServerKeyExchange.PSKIdentityHint
+}
@@ -0,0 +1,67 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+func TestParseServerKeyExchangeECDHE(t *testing.T) {
+	params := []byte{0x03, 0x00, 0x17, 0x03, 0x04, 0xaa, 0xbb}
+	raw := append(append([]byte(nil), params...), 0x04, 0x01, 0x00, 0x02, 0xde, 0xad)
+	p, err := ParseServerKeyExchange(raw, ztls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ztls.VersionTLS12)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(p.Params, params) || p.NamedCurve != 23 || !bytes.Equal(p.ECPoint, []byte{0x04, 0xaa, 0xbb}) {
+		t.Errorf("wrong parameters: %+v", p)
+	}
+	if p.SigAndHash == nil || *p.SigAndHash != ztls.SignatureAndHashFromCode(0x0401) {
+		t.Errorf("wrong signature algorithms: %v", p.SigAndHash)
+	}
+	if !bytes.Equal(p.Signature, []byte{0xde, 0xad}) {
+		t.Errorf("wrong signature: %x", p.Signature)
+	}
+
+	if _, err := ParseServerKeyExchange(raw[0:len(raw)-1], ztls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ztls.VersionTLS12); err != ErrServerKeyExchangeParse {
+		t.Errorf("expected ErrServerKeyExchangeParse for a truncated signature, got %v", err)
+	}
+}
+
+func TestParseServerKeyExchangeDHE(t *testing.T) {
+	raw := []byte{
+		0x00, 0x01, 0x17,
+		0x00, 0x01, 0x02,
+		0x00, 0x01, 0x08,
+		0x00, 0x02, 0x01, 0x02,
+	}
+	p, err := ParseServerKeyExchange(raw, ztls.TLS_DHE_RSA_WITH_AES_128_CBC_SHA, ztls.VersionTLS10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(p.DHPrime, []byte{0x17}) || !bytes.Equal(p.DHGenerator, []byte{0x02}) || !bytes.Equal(p.DHPublic, []byte{0x08}) {
+		t.Errorf("wrong parameters: %+v", p)
+	}
+	if len(p.Params) != 9 || p.SigAndHash != nil || !bytes.Equal(p.Signature, []byte{0x01, 0x02}) {
+		t.Errorf("wrong signature: %+v", p)
+	}
+
+	if _, err := ParseServerKeyExchange(raw, ztls.TLS_RSA_WITH_AES_128_CBC_SHA, ztls.VersionTLS10); err != ErrUnsupportedKeyExchange {
+		t.Errorf("expected ErrUnsupportedKeyExchange, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"syscall"
+)
+
+const (
+	sslv2ClientHello = 1
+	sslv2ServerHello = 4
+	sslv2Version     = 0x0002
+)
+
+// sslv2CipherNames are the SSLv2 cipher kinds from the SSL 2.0 draft
+var sslv2CipherNames = map[uint32]string{
+	0x010080: "SSL_CK_RC4_128_WITH_MD5",
+	0x020080: "SSL_CK_RC4_128_EXPORT40_WITH_MD5",
+	0x030080: "SSL_CK_RC2_128_CBC_WITH_MD5",
+	0x040080: "SSL_CK_RC2_128_CBC_EXPORT40_WITH_MD5",
+	0x050080: "SSL_CK_IDEA_128_CBC_WITH_MD5",
+	0x060040: "SSL_CK_DES_64_CBC_WITH_MD5",
+	0x0700C0: "SSL_CK_DES_192_EDE3_CBC_WITH_MD5",
+}
+
+// sslv2ExportCiphers are the cipher kinds limited to 40 bit keys
+var sslv2ExportCiphers = map[uint32]bool{
+	0x020080: true,
+	0x040080: true,
+}
+
+var ErrSSLv2BadServerHello = errors.New("malformed SSLv2 SERVER-HELLO")
+
+var errTLSRecord = errors.New("received a TLS record instead of SSLv2")
+
+// An SSLv2Cipher is a three byte SSLv2 cipher kind
+type SSLv2Cipher struct {
+	Value  uint32 `json:"value"`
+	Name   string `json:"name"`
+	Export bool   `json:"export,omitempty"`
+}
+
+// An SSLv2Event records whether the server answered an SSLv2 CLIENT-HELLO,
+// and the cipher kinds and certificate from its SERVER-HELLO. A server that
+// offers export ciphers is exposed to the cheapest form of DROWN.
+type SSLv2Event struct {
+	Supported     bool          `json:"supported"`
+	Version       uint16        `json:"version,omitempty"`
+	Ciphers       []SSLv2Cipher `json:"ciphers,omitempty"`
+	ExportCiphers bool          `json:"export_ciphers"`
+	Certificate   []byte        `json:"certificate,omitempty"`
+}
+
+// SSLv2CipherName returns the name of an SSLv2 cipher kind
+func SSLv2CipherName(kind uint32) string {
+	if name, ok := sslv2CipherNames[kind]; ok {
+		return name
+	}
+	return "unknown." + strconv.FormatUint(uint64(kind), 16)
+}
+
+// sslv2ClientHelloRecord builds a CLIENT-HELLO offering every SSLv2 cipher
+// kind, in a record with a two byte header.
+func sslv2ClientHelloRecord() []byte {
+	kinds := []uint32{0x010080, 0x020080, 0x030080, 0x040080, 0x050080, 0x060040, 0x0700C0}
+	challenge := make([]byte, 16)
+	rand.Read(challenge)
+
+	msg := []byte{sslv2ClientHello, sslv2Version >> 8, sslv2Version & 0xff}
+	msg = appendUint16(msg, 3*len(kinds))
+	msg = appendUint16(msg, 0) // session ID length
+	msg = appendUint16(msg, len(challenge))
+	for _, kind := range kinds {
+		msg = append(msg, byte(kind>>16), byte(kind>>8), byte(kind))
+	}
+	msg = append(msg, challenge...)
+	return append([]byte{0x80 | byte(len(msg)>>8), byte(len(msg))}, msg...)
+}
+
+// parseSSLv2ServerHello parses the body of a SERVER-HELLO record, without
+// its record header. The certificate, cipher specs and connection ID must
+// all fit in the record.
+func parseSSLv2ServerHello(b []byte) (*SSLv2Event, error) {
+	if len(b) < 11 || b[0] != sslv2ServerHello {
+		return nil, ErrSSLv2BadServerHello
+	}
+	event := &SSLv2Event{Supported: true}
+	event.Version = binary.BigEndian.Uint16(b[3:5])
+	certLength := int(binary.BigEndian.Uint16(b[5:7]))
+	cipherLength := int(binary.BigEndian.Uint16(b[7:9]))
+	connectionIDLength := int(binary.BigEndian.Uint16(b[9:11]))
+	b = b[11:]
+	if cipherLength%3 != 0 || len(b) < certLength+cipherLength+connectionIDLength {
+		return nil, ErrSSLv2BadServerHello
+	}
+	event.Certificate = b[0:certLength]
+	for specs := b[certLength : certLength+cipherLength]; len(specs) > 0; specs = specs[3:] {
+		kind := uint32(specs[0])<<16 | uint32(specs[1])<<8 | uint32(specs[2])
+		cipher := SSLv2Cipher{Value: kind, Name: SSLv2CipherName(kind), Export: sslv2ExportCiphers[kind]}
+		event.ExportCiphers = event.ExportCiphers || cipher.Export
+		event.Ciphers = append(event.Ciphers, cipher)
+	}
+	return event, nil
+}
+
+// readSSLv2Record reads one SSLv2 record with a two or three byte header
+// and returns its body, without any padding.
+func readSSLv2Record(r io.Reader) ([]byte, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[0:2]); err != nil {
+		return nil, err
+	}
+	if header[0] >= 0x14 && header[0] <= 0x18 {
+		// a TLS record, usually an alert refusing the hello
+		return nil, errTLSRecord
+	}
+	var length, padding int
+	if header[0]&0x80 != 0 {
+		length = int(header[0]&0x7f)<<8 | int(header[1])
+	} else {
+		if _, err := io.ReadFull(r, header[2:3]); err != nil {
+			return nil, err
+		}
+		length = int(header[0]&0x3f)<<8 | int(header[1])
+		padding = int(header[2])
+	}
+	if padding > length {
+		return nil, ErrSSLv2BadServerHello
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body[0 : length-padding], nil
+}
+
+// CheckSSLv2 sends an SSLv2 CLIENT-HELLO offering every cipher kind on a new
+// connection to the target, and records the ciphers the server offers in
+// reply. A server that answers with anything other than a SERVER-HELLO, or
+// closes or resets the connection without answering, does not support
+// SSLv2. Any other error, such as a timeout, is returned.
+func (c *Conn) CheckSSLv2() (bool, error) {
+	if c.dial == nil {
+		return false, ErrNoDialer
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+
+	event := new(SSLv2Event)
+	c.grabData.SSLv2 = event
+	if _, err := conn.Write(sslv2ClientHelloRecord()); err != nil {
+		return false, err
+	}
+	body, err := readSSLv2Record(conn)
+	if err == errTLSRecord || err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(body) == 0 || body[0] != sslv2ServerHello {
+		return false, nil
+	}
+	hello, err := parseSSLv2ServerHello(body)
+	if err != nil {
+		return false, err
+	}
+	*event = *hello
+	return true, nil
+}
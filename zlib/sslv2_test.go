@@ -0,0 +1,138 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sslv2TestCertificate is the self-signed RSA certificate OpenSSL issues by
+// default ("Internet Widgits Pty Ltd"), as used by the ztls tests
+var sslv2TestCertificate, _ = hex.DecodeString("308202b030820219a00302010202090085b0bba48a7fb8ca300d06092a864886f70d01010505003045310b3009060355" +
+	"040613024155311330110603550408130a536f6d652d53746174653121301f060355040a1318496e7465726e65742057" +
+	"69646769747320507479204c7464301e170d3130303432343039303933385a170d3131303432343039303933385a3045" +
+	"310b3009060355040613024155311330110603550408130a536f6d652d53746174653121301f060355040a1318496e74" +
+	"65726e6574205769646769747320507479204c746430819f300d06092a864886f70d010101050003818d003081890281" +
+	"8100bb79d6f517b5e5bf4610d0dc69bee62b07435ad0032d8a7a4385b71452e7a5654c2c78b8238cb5b482e5de1f953b" +
+	"7e62a52ca533d6fe125c7a56fcf506bffa587b263fb5cd04d3d0c921964ac7f4549f5abfef427100fe1899077f7e887d" +
+	"7df10439c4a22edb51c97ce3c04c3b326601cfafb11db8719a1ddbdb896baeda2d790203010001a381a73081a4301d06" +
+	"03551d0e04160414b1ade2855acfcb28db69ce2369ded3268e18883930750603551d23046e306c8014b1ade2855acfcb" +
+	"28db69ce2369ded3268e188839a149a4473045310b3009060355040613024155311330110603550408130a536f6d652d" +
+	"53746174653121301f060355040a1318496e7465726e6574205769646769747320507479204c746482090085b0bba48a" +
+	"7fb8ca300c0603551d13040530030101ff300d06092a864886f70d010105050003818100086c4524c76bb159ab0c52cc" +
+	"f2b014d7879d7a6475b55a9566e4c52b8eae12661feb4f38b36e60d392fdf74108b52513b1187a24fb301dbaed98b917" +
+	"ece7d73159db95d31d78ea50565cd5825a2d5a5f33c4b6d8c97590968c0f5298b5cd981f89205ff2a01ca31b9694dda9" +
+	"fd57e970e8266d71999b266e3850296c90a7bdd9")
+
+// sslv2ServerHelloRecord returns a SERVER-HELLO record laid out as OpenSSL
+// 0.9.8 sends it with SSLv2 enabled: a two byte header, no session ID hit,
+// an X.509 certificate, the cipher specs and a 16 byte connection ID.
+func sslv2ServerHelloRecord(cert []byte, kinds ...uint32) []byte {
+	connectionID := bytes.Repeat([]byte{0xab}, 16)
+	msg := []byte{sslv2ServerHello, 0x00, 0x01, sslv2Version >> 8, sslv2Version & 0xff}
+	msg = appendUint16(msg, len(cert))
+	msg = appendUint16(msg, 3*len(kinds))
+	msg = appendUint16(msg, len(connectionID))
+	msg = append(msg, cert...)
+	for _, kind := range kinds {
+		msg = append(msg, byte(kind>>16), byte(kind>>8), byte(kind))
+	}
+	msg = append(msg, connectionID...)
+	return append([]byte{0x80 | byte(len(msg)>>8), byte(len(msg))}, msg...)
+}
+
+func TestParseSSLv2ServerHello(t *testing.T) {
+	record := sslv2ServerHelloRecord(sslv2TestCertificate, 0x010080, 0x020080, 0x0700c0)
+	body, err := readSSLv2Record(bytes.NewReader(record))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	event, err := parseSSLv2ServerHello(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []SSLv2Cipher{
+		{Value: 0x010080, Name: "SSL_CK_RC4_128_WITH_MD5"},
+		{Value: 0x020080, Name: "SSL_CK_RC4_128_EXPORT40_WITH_MD5", Export: true},
+		{Value: 0x0700c0, Name: "SSL_CK_DES_192_EDE3_CBC_WITH_MD5"},
+	}
+	if !reflect.DeepEqual(event.Ciphers, expected) {
+		t.Errorf("wrong ciphers %+v", event.Ciphers)
+	}
+	if !event.Supported || !event.ExportCiphers || event.Version != 2 || !bytes.Equal(event.Certificate, sslv2TestCertificate) {
+		t.Errorf("wrong event %+v", event)
+	}
+
+	// Each length must fit in what is left of the record
+	malformed := map[string][]byte{
+		"truncated":           body[0:14],
+		"no connection ID":    body[0 : len(body)-1],
+		"long certificate":    append([]byte{}, body...),
+		"long cipher specs":   append([]byte{}, body...),
+		"partial cipher spec": append([]byte{}, body...),
+		"long connection ID":  append([]byte{}, body...),
+		"not a SERVER-HELLO":  append([]byte{}, body...),
+		"header only":         body[0:11],
+	}
+	malformed["long certificate"][5] = 0xff
+	malformed["long cipher specs"][7] = 0x30
+	malformed["partial cipher spec"][8] = 0x08
+	malformed["long connection ID"][10] = 0xff
+	malformed["not a SERVER-HELLO"][0] = sslv2ClientHello
+	for name, b := range malformed {
+		if _, err := parseSSLv2ServerHello(b); err != ErrSSLv2BadServerHello {
+			t.Errorf("%s: expected ErrSSLv2BadServerHello, got %v", name, err)
+		}
+	}
+}
+
+func TestCheckSSLv2(t *testing.T) {
+	hello := sslv2ServerHelloRecord(sslv2TestCertificate, 0x010080, 0x0700c0)
+	for _, reply := range [][]byte{hello, {0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}, nil} {
+		client, server := net.Pipe()
+		go func(reply []byte) {
+			defer server.Close()
+			hello := make([]byte, 512)
+			if n, _ := server.Read(hello); n < 3 || hello[2] != sslv2ClientHello {
+				return
+			}
+			server.Write(reply)
+		}(reply)
+		c := new(Conn)
+		c.SetDial(func() (net.Conn, error) { return client, nil })
+		supported, err := c.CheckSSLv2()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if expected := len(reply) > 0 && reply[0]&0x80 != 0; supported != expected || c.grabData.SSLv2.Supported != expected {
+			t.Errorf("expected supported to be %t, got %t", expected, supported)
+		}
+	}
+
+	// A server that never answers is not known to lack SSLv2
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Read(make([]byte, 512))
+	c := &Conn{readDeadline: time.Now().Add(50 * time.Millisecond)}
+	c.SetDial(func() (net.Conn, error) { return client, nil })
+	if supported, err := c.CheckSSLv2(); supported || err == nil {
+		t.Errorf("expected a timeout error, got %t, %v", supported, err)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"strings"
+
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+// Grades GradeTLS can give, from best to worst
+const (
+	gradeA = iota
+	gradeAMinus
+	gradeB
+	gradeC
+	gradeF
+)
+
+var gradeNames = []string{"A", "A-", "B", "C", "F"}
+
+// GradeTLS grades the TLS results collected in data in the style of SSL
+// Labs. Every finding caps the grade, and the lowest cap wins:
+//
+//	F   Heartbleed; SSL 3.0 negotiated; a NULL, anonymous, export or single
+//	    DES cipher suite negotiated
+//	C   SSL 3.0 supported; RC4 negotiated; TLS compression; no secure
+//	    renegotiation
+//	B   a version below TLS 1.2 negotiated or supported; no forward secrecy;
+//	    3DES negotiated
+//	A-  the server follows the client's cipher suite order
+//
+// A handshake with no findings gets an A. If the certificate was validated
+// and is not trusted, the grade is T unless it is already F. Results of
+// probes that were not run, such as SupportedVersions or CheckHeartbleed,
+// are simply not considered. The grade is empty if there was no ServerHello.
+func GradeTLS(data *GrabData) (string, []string) {
+	hl := data.TLSHandshake
+	if hl == nil || hl.ServerHello == nil {
+		return "", nil
+	}
+	grade := gradeA
+	var findings []string
+	limit := func(to int, finding string) {
+		findings = append(findings, finding)
+		if to > grade {
+			grade = to
+		}
+	}
+
+	sh := hl.ServerHello
+	suite := sh.CipherSuite.String()
+	if data.Heartbleed != nil && data.Heartbleed.Vulnerable {
+		limit(gradeF, "vulnerable to Heartbleed")
+	}
+	if sh.Version == ztls.VersionSSL30 {
+		limit(gradeF, "SSL 3.0 negotiated")
+	}
+	switch {
+	case strings.Contains(suite, "_NULL_"):
+		limit(gradeF, "NULL cipher negotiated: "+suite)
+	case strings.Contains(suite, "_anon_"):
+		limit(gradeF, "anonymous cipher negotiated: "+suite)
+	case strings.Contains(suite, "EXPORT"):
+		limit(gradeF, "export cipher negotiated: "+suite)
+	case strings.Contains(suite, "_DES_CBC_") || strings.Contains(suite, "_DES40_"):
+		limit(gradeF, "single DES cipher negotiated: "+suite)
+	case strings.Contains(suite, "_RC4_"):
+		limit(gradeC, "RC4 cipher negotiated: "+suite)
+	case strings.Contains(suite, "_3DES_"):
+		limit(gradeB, "3DES cipher negotiated: "+suite)
+	}
+
+	if data.VersionSupport != nil {
+		for _, v := range data.VersionSupport.Supported {
+			switch v {
+			case ztls.VersionSSL30:
+				limit(gradeC, "SSL 3.0 supported")
+			case ztls.VersionTLS10, ztls.VersionTLS11:
+				limit(gradeB, v.String()+" supported")
+			}
+		}
+	}
+	if sh.CompressionMethod != 0 {
+		limit(gradeC, "TLS compression enabled")
+	}
+	if !sh.SecureRenegotiation {
+		limit(gradeC, "no secure renegotiation")
+	}
+
+	if sh.Version != ztls.VersionSSL30 && sh.Version < ztls.VersionTLS12 {
+		limit(gradeB, sh.Version.String()+" negotiated")
+	}
+	if !strings.Contains(suite, "_DHE_") && !strings.Contains(suite, "_ECDHE_") {
+		limit(gradeB, "no forward secrecy")
+	}
+
+	if data.CipherPreference != nil && !data.CipherPreference.ServerPreference {
+		limit(gradeAMinus, "server follows the client's cipher suite order")
+	}
+
+	result := gradeNames[grade]
+	if certs := hl.ServerCertificates; certs != nil && certs.Validation != nil && !certs.Validation.BrowserTrusted {
+		findings = append(findings, "certificate is not trusted")
+		if grade != gradeF {
+			result = "T"
+		}
+	}
+	return result, findings
+}
+
+// TLSGrade grades the results collected on this connection with GradeTLS.
+// Running more probes, such as SupportedVersions, ServerPrefersOwnCipherOrder and
+// CheckHeartbleed, before calling it gives a more complete grade.
+func (c *Conn) TLSGrade() (string, []string) {
+	return GradeTLS(&c.grabData)
+}
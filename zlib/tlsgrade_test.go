@@ -0,0 +1,93 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+func TestGradeTLS(t *testing.T) {
+	hello := func(version uint16, suite uint16) *ztls.ServerHandshake {
+		return &ztls.ServerHandshake{ServerHello: &ztls.ServerHello{
+			Version:             ztls.TLSVersion(version),
+			CipherSuite:         ztls.CipherSuite(suite),
+			SecureRenegotiation: true,
+		}}
+	}
+	tests := []struct {
+		name     string
+		data     GrabData
+		grade    string
+		findings []string
+	}{
+		{
+			name: "no handshake",
+		},
+		{
+			name:  "modern",
+			data:  GrabData{TLSHandshake: hello(ztls.VersionTLS12, 0xc02f)},
+			grade: "A",
+		},
+		{
+			name: "client order",
+			data: GrabData{
+				TLSHandshake:     hello(ztls.VersionTLS12, 0xc02f),
+				CipherPreference: &CipherPreferenceEvent{},
+			},
+			grade:    "A-",
+			findings: []string{"server follows the client's cipher suite order"},
+		},
+		{
+			name: "old versions",
+			data: GrabData{
+				TLSHandshake:   hello(ztls.VersionTLS10, 0x002f),
+				VersionSupport: &VersionSupportEvent{Supported: []ztls.TLSVersion{ztls.VersionTLS10, ztls.VersionTLS12}},
+			},
+			grade:    "B",
+			findings: []string{"TLSv1.0 supported", "TLSv1.0 negotiated", "no forward secrecy"},
+		},
+		{
+			name:     "rc4",
+			data:     GrabData{TLSHandshake: hello(ztls.VersionTLS12, 0xc011)},
+			grade:    "C",
+			findings: []string{"RC4 cipher negotiated: TLS_ECDHE_RSA_WITH_RC4_128_SHA"},
+		},
+		{
+			name: "heartbleed",
+			data: GrabData{
+				TLSHandshake: hello(ztls.VersionTLS12, 0xc02f),
+				Heartbleed:   &ztls.Heartbleed{HeartbeatEnabled: true, Vulnerable: true},
+			},
+			grade:    "F",
+			findings: []string{"vulnerable to Heartbleed"},
+		},
+	}
+	for _, test := range tests {
+		grade, findings := GradeTLS(&test.data)
+		if grade != test.grade || !reflect.DeepEqual(findings, test.findings) {
+			t.Errorf("%s: expected %q %q, got %q %q", test.name, test.grade, test.findings, grade, findings)
+		}
+	}
+
+	untrusted := GrabData{TLSHandshake: hello(ztls.VersionTLS12, 0xc02f)}
+	untrusted.TLSHandshake.ServerCertificates = &ztls.Certificates{Validation: &x509.Validation{}}
+	if grade, _ := GradeTLS(&untrusted); grade != "T" {
+		t.Errorf("expected T for an untrusted certificate, got %q", grade)
+	}
+}
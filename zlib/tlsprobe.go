@@ -0,0 +1,666 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+// ErrNoDialer is returned by probes that need a new connection to the target
+// when the Conn was not created by a Dialer and SetDial was not called.
+var ErrNoDialer = errors.New("no dial function to open probe connections")
+
+// ErrNoServerHello is returned by probes when a handshake failed before the
+// server sent its ServerHello.
+var ErrNoServerHello = errors.New("handshake failed before ServerHello")
+
+// A CipherPreferenceEvent represents offering the same cipher suites in
+// opposite orders to find out whose preference the server follows
+type CipherPreferenceEvent struct {
+	ClientOrderSuite   ztls.CipherSuite `json:"client_order_suite"`
+	ReversedOrderSuite ztls.CipherSuite `json:"reversed_order_suite"`
+	ServerPreference   bool             `json:"server_preference"`
+}
+
+// A SingleCipherProbeEvent represents a handshake offering only one cipher
+// suite
+type SingleCipherProbeEvent struct {
+	CipherSuite ztls.CipherSuite `json:"cipher_suite"`
+	Supported   bool             `json:"supported"`
+	Alert       *uint8           `json:"alert,omitempty"`
+}
+
+// A SignatureAlgorithmsEvent lists the signature and hash algorithms the
+// server used to sign its ServerKeyExchange, in the order it prefers them
+type SignatureAlgorithmsEvent struct {
+	Algorithms []ztls.SignatureAndHash `json:"algorithms"`
+}
+
+// A VersionSupportEvent lists which protocol versions the server completed a
+// ServerHello for when offered only that version
+type VersionSupportEvent struct {
+	Supported   []ztls.TLSVersion `json:"supported,omitempty"`
+	Unsupported []ztls.TLSVersion `json:"unsupported,omitempty"`
+}
+
+// An IntoleranceEvent records whether the server answered a minimal
+// ClientHello, one padded with cipher suites to between 256 and 511 bytes,
+// and a large one offering every named cipher suite and all the optional
+// extensions ztls supports
+type IntoleranceEvent struct {
+	MinimalHelloSize int    `json:"minimal_hello_size"`
+	MinimalSucceeded bool   `json:"minimal_succeeded"`
+	MediumHelloSize  int    `json:"medium_hello_size"`
+	MediumSucceeded  bool   `json:"medium_succeeded"`
+	LargeHelloSize   int    `json:"large_hello_size"`
+	LargeSucceeded   bool   `json:"large_succeeded"`
+	Intolerant       bool   `json:"intolerant"`
+	Error            string `json:"error,omitempty"`
+}
+
+// A FallbackSCSVEvent represents a handshake offering one version below the
+// server's highest along with TLS_FALLBACK_SCSV. A server that implements
+// RFC 7507 rejects it with an inappropriate_fallback alert; one that
+// completes the handshake does not. Any other failure is recorded in Error.
+type FallbackSCSVEvent struct {
+	MaxVersion      ztls.TLSVersion `json:"max_version"`
+	FallbackVersion ztls.TLSVersion `json:"fallback_version"`
+	Alert           *uint8          `json:"alert,omitempty"`
+	Rejected        bool            `json:"rejected"`
+	Completed       bool            `json:"completed"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// ErrNoFallbackVersion is returned by CheckFallbackSCSV when the server's
+// highest version is SSL 3.0, leaving nothing to fall back to
+var ErrNoFallbackVersion = errors.New("no version below the server's highest to fall back to")
+
+// ErrFallbackInconclusive is returned by CheckFallbackSCSV when the fallback
+// handshake neither completed nor failed with inappropriate_fallback
+var ErrFallbackInconclusive = errors.New("fallback handshake was neither rejected nor completed")
+
+const tlsAlertInappropriateFallback = 86
+
+// A ResumptionEvent records whether the server handed out a session ticket
+// and a session ID on a full handshake, and whether it resumed each one on a
+// second connection
+type ResumptionEvent struct {
+	TicketIssued     bool `json:"ticket_issued"`
+	TicketResumed    bool `json:"ticket_resumed"`
+	SessionIDIssued  bool `json:"session_id_issued"`
+	SessionIDResumed bool `json:"session_id_resumed"`
+}
+
+// A DefaultVHostEvent represents comparing the certificate the server
+// presents for the target's name with the one it presents without SNI. Only
+// the leaf is kept from the handshake with SNI, which is usually the
+// connection's own and already recorded in full.
+type DefaultVHostEvent struct {
+	ServerName      string                      `json:"server_name,omitempty"`
+	SNICertificate  []byte                      `json:"sni_certificate,omitempty"`
+	SNIFingerprint  x509.CertificateFingerprint `json:"sni_fingerprint_sha256,omitempty"`
+	WithoutSNI      *ztls.ServerHandshake       `json:"without_sni,omitempty"`
+	SameCertificate bool                        `json:"same_certificate"`
+}
+
+// ErrNoTLSHandshake is returned by checks of the handshake log when no TLS
+// handshake has been attempted.
+var ErrNoTLSHandshake = errors.New("no TLS handshake was attempted")
+
+// A HandshakeOrderingEvent lists the handshake messages and ChangeCipherSpec
+// records the server sent, in order, and anything out of place in them
+type HandshakeOrderingEvent struct {
+	Received  []string `json:"received"`
+	Anomalies []string `json:"anomalies,omitempty"`
+}
+
+// serverMessageRank is the position of each server message in a TLS 1.2 or
+// earlier handshake. A resumed handshake skips from server_hello to
+// new_session_ticket, which keeps the ranks ascending.
+var serverMessageRank = map[string]int{
+	"server_hello":               0,
+	"server_certificate":         1,
+	"server_certificate_status":  2,
+	"server_key_exchange":        3,
+	"server_certificate_request": 4,
+	"server_hello_done":          5,
+	"server_new_session_ticket":  6,
+	"server_change_cipher_spec":  7,
+	"server_finished":            8,
+}
+
+// handshakeOrderingAnomalies describes each message in received that is
+// unknown, repeated, or arrives after one that should follow it.
+func handshakeOrderingAnomalies(received []string) []string {
+	var anomalies []string
+	seen := make(map[string]bool, len(received))
+	last := ""
+	for _, name := range received {
+		if name == "server_hello_request" {
+			continue
+		}
+		rank, known := serverMessageRank[name]
+		switch {
+		case !known:
+			anomalies = append(anomalies, "unexpected "+name)
+		case seen[name]:
+			anomalies = append(anomalies, "duplicate "+name)
+		case last == "" && name != "server_hello":
+			anomalies = append(anomalies, name+" before server_hello")
+		case last != "" && rank < serverMessageRank[last]:
+			anomalies = append(anomalies, name+" after "+last)
+		case name == "server_change_cipher_spec" && seen["server_certificate"] && !seen["server_hello_done"]:
+			anomalies = append(anomalies, "early server_change_cipher_spec")
+		}
+		seen[name] = true
+		if known && (last == "" || rank > serverMessageRank[last]) {
+			last = name
+		}
+	}
+	return anomalies
+}
+
+// CheckHandshakeOrdering looks at the order of the messages the server sent
+// in the last TLS handshake and returns a description of each one that was
+// unknown, repeated or out of order. ztls aborts the handshake at the first
+// message it did not expect, so that message is the last one logged.
+func (c *Conn) CheckHandshakeOrdering() ([]string, error) {
+	hl := c.grabData.TLSHandshake
+	if hl == nil {
+		return nil, ErrNoTLSHandshake
+	}
+	event := &HandshakeOrderingEvent{
+		Received:  hl.ReceivedMessages,
+		Anomalies: handshakeOrderingAnomalies(hl.ReceivedMessages),
+	}
+	c.grabData.HandshakeOrdering = event
+	return event.Anomalies, nil
+}
+
+// probedVersions are the versions SupportedVersions checks. ztls cannot
+// offer TLS 1.3, so it is not included.
+var probedVersions = []uint16{
+	ztls.VersionSSL30,
+	ztls.VersionTLS10,
+	ztls.VersionTLS11,
+	ztls.VersionTLS12,
+}
+
+// A TLSShutdownEvent records how the server ended a TLS connection after
+// the client sent its close_notify. TimedOut is set when the server neither
+// answered nor closed the connection in time.
+type TLSShutdownEvent struct {
+	CloseNotify bool `json:"close_notify"`
+	TimedOut    bool `json:"timed_out,omitempty"`
+}
+
+// closeNotifyWait bounds how long Close waits for the server to shut down
+// the TLS connection
+const closeNotifyWait = time.Second
+
+// recordTLSShutdown sends a close_notify alert, reads until the server ends
+// the connection or until closeNotifyWait passes, and records whether it
+// answered with its own close_notify.
+func (c *Conn) recordTLSShutdown() {
+	event := new(TLSShutdownEvent)
+	c.grabData.TLSShutdown = event
+	deadline := time.Now().Add(closeNotifyWait)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	c.tlsConn.SetDeadline(deadline)
+	if err := c.tlsConn.CloseWrite(); err == nil {
+		buf := make([]byte, 1024)
+		for {
+			_, err := c.tlsConn.Read(buf)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				event.TimedOut = true
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	event.CloseNotify = c.tlsConn.ReceivedCloseNotify()
+}
+
+// CleanTLSShutdown returns true if the server sent a close_notify alert
+// before closing the connection. It is only known after Close, when
+// SetCheckCloseNotify was called.
+func (c *Conn) CleanTLSShutdown() bool {
+	return c.grabData.TLSShutdown != nil && c.grabData.TLSShutdown.CloseNotify
+}
+
+// probeTLSHandshake opens a new connection to the target and performs a TLS
+// handshake with the settings of c, as modified by configure. The probe
+// connection is closed before returning and nothing is recorded in grabData.
+// The handshake log is returned even if the handshake fails part way.
+func (c *Conn) probeTLSHandshake(configure func(*ztls.Config)) (*ztls.ServerHandshake, error) {
+	if c.dial == nil {
+		return nil, ErrNoDialer
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+
+	tlsConfig := c.clientTLSConfig()
+	if configure != nil {
+		configure(tlsConfig)
+	}
+	tlsConn := ztls.Client(conn, tlsConfig)
+	err = tlsConn.Handshake()
+	return tlsConn.GetHandshakeLog(), err
+}
+
+// probeSelectedSuite returns the cipher suite the server picked in a probe
+// handshake offering suites in the given order.
+func (c *Conn) probeSelectedSuite(suites []uint16) (ztls.CipherSuite, error) {
+	hl, err := c.probeTLSHandshake(func(config *ztls.Config) {
+		config.CipherSuites = suites
+	})
+	if hl != nil && hl.ServerHello != nil {
+		return hl.ServerHello.CipherSuite, nil
+	}
+	if err == nil {
+		err = ErrNoServerHello
+	}
+	return 0, err
+}
+
+// ServerPrefersOwnCipherOrder performs two handshakes, offering the cipher
+// suites of c first in order and then reversed. If the server selects the
+// same suite both times it is enforcing its own preference order.
+func (c *Conn) ServerPrefersOwnCipherOrder() (bool, error) {
+	suites := c.CipherSuites
+	if suites == nil {
+		suites = ztls.DefaultCipherSuites()
+	}
+	if len(suites) < 2 {
+		return false, errors.New("need at least two cipher suites to compare orders")
+	}
+	reversed := make([]uint16, len(suites))
+	for i, suite := range suites {
+		reversed[len(suites)-1-i] = suite
+	}
+
+	event := new(CipherPreferenceEvent)
+	var err error
+	if event.ClientOrderSuite, err = c.probeSelectedSuite(suites); err != nil {
+		return false, err
+	}
+	if event.ReversedOrderSuite, err = c.probeSelectedSuite(reversed); err != nil {
+		return false, err
+	}
+	event.ServerPreference = event.ClientOrderSuite == event.ReversedOrderSuite
+	c.grabData.CipherPreference = event
+	return event.ServerPreference, nil
+}
+
+// CheckCipherSupported performs a handshake on a new connection offering only
+// the cipher suite id, and returns whether the server selected it. The suite
+// does not have to be one ztls implements, since only the ServerHello is
+// needed. A server that answers with an alert does not support the suite.
+func (c *Conn) CheckCipherSupported(id uint16) (bool, error) {
+	hl, err := c.probeTLSHandshake(func(config *ztls.Config) {
+		config.CipherSuites = []uint16{id}
+		config.ForceSuites = true
+	})
+	event := SingleCipherProbeEvent{CipherSuite: ztls.CipherSuite(id)}
+	if hl != nil && hl.ServerHello != nil {
+		event.Supported = hl.ServerHello.CipherSuite == ztls.CipherSuite(id)
+		err = nil
+	} else if code, ok := ztls.RemoteAlert(err); ok {
+		event.Alert = &code
+		err = nil
+	} else if err == nil {
+		err = ErrNoServerHello
+	}
+	if err != nil {
+		return false, err
+	}
+	c.grabData.CipherProbes = append(c.grabData.CipherProbes, event)
+	return event.Supported, nil
+}
+
+// ServerSignatureAlgorithms finds which TLS 1.2 signature and hash algorithms
+// the server will sign its ServerKeyExchange with, as wire encoded codes in
+// the server's order of preference. Each handshake offers the algorithms not
+// seen yet, until the server stops choosing a new one. Only (EC)DHE cipher
+// suites are offered, since other key exchanges are not signed.
+func (c *Conn) ServerSignatureAlgorithms() ([]uint16, error) {
+	var offered []ztls.SignatureAndHash
+	for hash := uint8(1); hash <= 6; hash++ {
+		for sig := uint8(1); sig <= 3; sig++ {
+			offered = append(offered, ztls.SignatureAndHashFromCode(uint16(hash)<<8|uint16(sig)))
+		}
+	}
+	suites := append(append([]uint16(nil), ztls.ECDHECiphers...), ztls.DHECiphers...)
+
+	event := new(SignatureAlgorithmsEvent)
+	var codes []uint16
+	for len(offered) > 0 {
+		hl, err := c.probeTLSHandshake(func(config *ztls.Config) {
+			config.MinVersion = ztls.VersionTLS12
+			config.MaxVersion = ztls.VersionTLS12
+			config.CipherSuites = suites
+			config.SignatureAndHashes = offered
+		})
+		if hl == nil || hl.ServerKeyExchange == nil || hl.ServerKeyExchange.Signature == nil ||
+			hl.ServerKeyExchange.Signature.SigHashExtension == nil {
+			if len(codes) == 0 {
+				if _, ok := ztls.RemoteAlert(err); !ok && err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		chosen := *hl.ServerKeyExchange.Signature.SigHashExtension
+		remaining := offered[:0]
+		for _, sh := range offered {
+			if sh.Code() != chosen.Code() {
+				remaining = append(remaining, sh)
+			}
+		}
+		if len(remaining) == len(offered) {
+			// The server chose an algorithm that was not offered
+			break
+		}
+		offered = remaining
+		event.Algorithms = append(event.Algorithms, chosen)
+		codes = append(codes, chosen.Code())
+	}
+	c.grabData.SignatureAlgorithms = event
+	return codes, nil
+}
+
+// SupportedVersions offers each of SSL 3.0 through TLS 1.2 alone, on a new
+// connection per version, and reports whether the server agreed to it. A
+// server that answers with an alert, or intolerantly drops the connection,
+// does not support the version. An error is only returned if a probe
+// connection could not be opened.
+func (c *Conn) SupportedVersions() (map[uint16]bool, error) {
+	supported := make(map[uint16]bool, len(probedVersions))
+	event := new(VersionSupportEvent)
+	for _, version := range probedVersions {
+		hl, err := c.probeTLSHandshake(func(config *ztls.Config) {
+			config.MinVersion = version
+			config.MaxVersion = version
+		})
+		if hl == nil {
+			return nil, err
+		}
+		ok := hl.ServerHello != nil && uint16(hl.ServerHello.Version) == version
+		supported[version] = ok
+		if ok {
+			event.Supported = append(event.Supported, ztls.TLSVersion(version))
+		} else {
+			event.Unsupported = append(event.Unsupported, ztls.TLSVersion(version))
+		}
+	}
+	c.grabData.VersionSupport = event
+	return supported, nil
+}
+
+// Some F5 load balancers fail on a ClientHello of 256 to 511 bytes, which
+// is why RFC 7685 padding exists. The medium probe aims for the middle of
+// that range.
+const (
+	mediumHelloMin    = 256
+	mediumHelloMax    = 511
+	mediumHelloTarget = 384
+)
+
+// paddedCipherSuites returns the default cipher suites followed by enough
+// other named ones to grow a ClientHello of size bytes to target bytes
+func paddedCipherSuites(size, target int) []uint16 {
+	suites := ztls.DefaultCipherSuites()
+	offered := make(map[uint16]bool, len(suites))
+	for _, suite := range suites {
+		offered[suite] = true
+	}
+	for _, suite := range ztls.NamedCipherSuites() {
+		if size+2 > target {
+			break
+		}
+		if !offered[suite] {
+			suites = append(suites, suite)
+			size += 2
+		}
+	}
+	return suites
+}
+
+// CheckClientHelloIntolerance performs handshakes with a minimal
+// ClientHello, one padded to between 256 and 511 bytes, and a large one of
+// well over 512 bytes, each on a new connection. It returns true if the
+// server answered the minimal hello with a ServerHello but not one of the
+// others. The medium hello trips servers and middleboxes with the F5 bug;
+// its size is taken from the handshake log and it only counts if it landed
+// in that range. The large hello trips those that mishandle long hellos or
+// unknown cipher suites and extensions. If the minimal handshake fails too,
+// intolerance cannot be told apart from the server being down, and
+// ErrNoServerHello is returned.
+func (c *Conn) CheckClientHelloIntolerance() (bool, error) {
+	event := new(IntoleranceEvent)
+	c.grabData.Intolerance = event
+	minimal, err := c.probeTLSHandshake(func(config *ztls.Config) {
+		config.HeartbeatEnabled = false
+		config.ExtendedRandom = false
+		config.ForceSessionTicketExt = false
+		config.ExtendedMasterSecret = false
+		config.ForceSuites = false
+		config.CipherSuites = nil
+	})
+	if minimal == nil {
+		event.Error = err.Error()
+		return false, err
+	}
+	event.MinimalHelloSize = minimal.MessageSizes["client_hello"]
+	event.MinimalSucceeded = minimal.ServerHello != nil
+
+	suites := paddedCipherSuites(event.MinimalHelloSize, mediumHelloTarget)
+	medium, err := c.probeTLSHandshake(func(config *ztls.Config) {
+		config.HeartbeatEnabled = false
+		config.ExtendedRandom = false
+		config.ForceSessionTicketExt = false
+		config.ExtendedMasterSecret = false
+		config.ForceSuites = true
+		config.CipherSuites = suites
+	})
+	if medium == nil {
+		event.Error = err.Error()
+		return false, err
+	}
+	event.MediumHelloSize = medium.MessageSizes["client_hello"]
+	event.MediumSucceeded = medium.ServerHello != nil
+	mediumIntolerant := !event.MediumSucceeded &&
+		event.MediumHelloSize >= mediumHelloMin && event.MediumHelloSize <= mediumHelloMax
+
+	large, err := c.probeTLSHandshake(func(config *ztls.Config) {
+		config.HeartbeatEnabled = true
+		config.ExtendedRandom = true
+		config.ForceSessionTicketExt = true
+		config.ExtendedMasterSecret = true
+		config.ForceSuites = true
+		config.CipherSuites = ztls.NamedCipherSuites()
+	})
+	if large == nil {
+		// The large hello was never sent, so nothing is known about it
+		event.Error = err.Error()
+		return false, err
+	}
+	event.LargeHelloSize = large.MessageSizes["client_hello"]
+	event.LargeSucceeded = large.ServerHello != nil
+	event.Intolerant = event.MinimalSucceeded && (mediumIntolerant || !event.LargeSucceeded)
+	if !event.MinimalSucceeded {
+		return false, ErrNoServerHello
+	}
+	return event.Intolerant, nil
+}
+
+// CheckFallbackSCSV performs a handshake on a new connection at one version
+// below the server's highest, offering TLS_FALLBACK_SCSV, and returns true if
+// the server rejected it with inappropriate_fallback as RFC 7507 requires.
+// The highest version is taken from the connection's own handshake when
+// there was one, and otherwise from a probe. It returns false only when the
+// server completes the fallback handshake, which exposes it to downgrade
+// attacks such as POODLE. Any other outcome, such as a reset, a timeout or
+// a different alert, is returned as an error, ErrFallbackInconclusive if
+// the handshake failed without one.
+func (c *Conn) CheckFallbackSCSV() (bool, error) {
+	hl := c.grabData.TLSHandshake
+	if hl == nil || hl.ServerHello == nil {
+		var err error
+		if hl, err = c.probeTLSHandshake(nil); hl == nil || hl.ServerHello == nil {
+			if err == nil {
+				err = ErrNoServerHello
+			}
+			return false, err
+		}
+	}
+	event := &FallbackSCSVEvent{MaxVersion: hl.ServerHello.Version}
+	c.grabData.FallbackSCSV = event
+	if uint16(event.MaxVersion) <= ztls.VersionSSL30 {
+		event.Error = ErrNoFallbackVersion.Error()
+		return false, ErrNoFallbackVersion
+	}
+	event.FallbackVersion = event.MaxVersion - 1
+
+	fallback, err := c.probeTLSHandshake(func(config *ztls.Config) {
+		config.MaxVersion = uint16(event.FallbackVersion)
+		if config.MinVersion > config.MaxVersion {
+			config.MinVersion = config.MaxVersion
+		}
+		config.FallbackSCSV = true
+	})
+	if code, ok := ztls.RemoteAlert(err); ok {
+		event.Alert = &code
+		event.Rejected = code == tlsAlertInappropriateFallback
+	}
+	event.Completed = err == nil && fallback != nil && fallback.ServerFinished != nil
+	if event.Rejected || event.Completed {
+		return event.Rejected, nil
+	}
+	if err == nil {
+		err = ErrFallbackInconclusive
+	}
+	event.Error = err.Error()
+	return false, err
+}
+
+// probeResumption performs a full probe handshake and, if the server issued
+// something to resume, a second one offering it. Both share a session
+// cache, so the second resumes the first when the server allows.
+func (c *Conn) probeResumption(sessionIDs bool) (issued, resumed bool, err error) {
+	cache := ztls.NewLRUClientSessionCache(1)
+	configure := func(config *ztls.Config) {
+		config.ClientSessionCache = cache
+		config.SessionTicketsDisabled = false
+		config.SessionIDResumption = sessionIDs
+		config.ForceSessionTicketExt = false
+	}
+	first, err := c.probeTLSHandshake(configure)
+	if first == nil {
+		return false, false, err
+	}
+	if first.ServerFinished == nil {
+		if err == nil {
+			err = ErrNoServerHello
+		}
+		return false, false, err
+	}
+	if sessionIDs {
+		issued = len(first.ServerHello.SessionID) > 0
+	} else {
+		issued = first.SessionTicket != nil
+	}
+	if !issued {
+		return false, false, nil
+	}
+	second, err := c.probeTLSHandshake(configure)
+	if second == nil {
+		return true, false, err
+	}
+	return true, second.Resumed, nil
+}
+
+// ResumptionMechanism finds out which kinds of session resumption the
+// server supports, on four new connections: a full handshake and a
+// resumption attempt with session tickets, then the same with session IDs
+// and no ticket extension. Tickets are stateless for the server, while
+// session IDs need it to keep a session cache.
+func (c *Conn) ResumptionMechanism() (tickets bool, sessionIDs bool, err error) {
+	event := new(ResumptionEvent)
+	if event.TicketIssued, event.TicketResumed, err = c.probeResumption(false); err != nil {
+		return false, false, err
+	}
+	if event.SessionIDIssued, event.SessionIDResumed, err = c.probeResumption(true); err != nil {
+		return false, false, err
+	}
+	c.grabData.Resumption = event
+	return event.TicketResumed, event.SessionIDResumed, nil
+}
+
+// DefaultVirtualHostCert performs a probe handshake without SNI and returns
+// the leaf certificate the server presents to clients that do not name a
+// host. It is compared with the certificate for the target's domain, taken
+// from the connection's own handshake if that sent SNI and otherwise from a
+// second probe; a difference means the target is not the server's default
+// virtual host. The handshake without SNI and the leaf presented with it
+// are recorded.
+func (c *Conn) DefaultVirtualHostCert() (*x509.Certificate, error) {
+	event := new(DefaultVHostEvent)
+	c.grabData.DefaultVHost = event
+	var err error
+	event.WithoutSNI, err = c.probeTLSHandshake(func(config *ztls.Config) {
+		config.ServerName = ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	leaf := handshakeLeaf(event.WithoutSNI)
+	if leaf == nil {
+		return nil, ErrNoLeafCertificate
+	}
+	if c.domain == "" {
+		return leaf, nil
+	}
+
+	event.ServerName = c.domain
+	withSNI := c.grabData.TLSHandshake
+	if withSNI == nil || c.noSNI {
+		if withSNI, err = c.probeTLSHandshake(func(config *ztls.Config) {
+			config.ServerName = c.domain
+		}); err != nil {
+			return leaf, err
+		}
+	}
+	if named := handshakeLeaf(withSNI); named != nil {
+		event.SNICertificate = named.Raw
+		event.SNIFingerprint = x509.SHA256Fingerprint(named.Raw)
+		event.SameCertificate = bytes.Equal(named.Raw, leaf.Raw)
+	}
+	return leaf, nil
+}
@@ -0,0 +1,549 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+// sniServer dials a TLS server that presents named for www.example.com and
+// fallback to everyone else
+func sniServer(named, fallback tls.Certificate) func() (net.Conn, error) {
+	config := &tls.Config{
+		MaxVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "www.example.com" {
+				return &named, nil
+			}
+			return &fallback, nil
+		},
+	}
+	return func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tls.Server(server, config).Handshake()
+		}()
+		return client, nil
+	}
+}
+
+// tlsServer dials a crypto/tls server with config
+func tlsServer(config *tls.Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tls.Server(server, config).Handshake()
+		}()
+		return client, nil
+	}
+}
+
+// ztlsServer dials a ztls server with config, for behavior crypto/tls no
+// longer offers
+func ztlsServer(config *ztls.Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			ztls.Server(server, config).Handshake()
+		}()
+		return client, nil
+	}
+}
+
+func TestServerPrefersOwnCipherOrder(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	suites := []uint16{ztls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, ztls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA}
+	for _, prefer := range []bool{false, true} {
+		c := &Conn{CipherSuites: suites}
+		c.SetDial(ztlsServer(&ztls.Config{
+			Certificates:             []ztls.Certificate{{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey}},
+			CipherSuites:             []uint16{suites[1], suites[0]},
+			PreferServerCipherSuites: prefer,
+		}))
+		enforced, err := c.ServerPrefersOwnCipherOrder()
+		if err != nil {
+			t.Fatalf("prefer=%t: unexpected error: %s", prefer, err)
+		}
+		event := c.grabData.CipherPreference
+		if enforced != prefer || event.ServerPreference != prefer {
+			t.Errorf("prefer=%t: got %t, %+v", prefer, enforced, event)
+		}
+		if prefer && event.ClientOrderSuite != ztls.CipherSuite(suites[1]) {
+			t.Errorf("expected the server's first choice, got %+v", event)
+		}
+	}
+}
+
+func TestCheckCipherSupported(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	c := new(Conn)
+	c.SetDial(tlsServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}))
+	if supported, err := c.CheckCipherSupported(ztls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256); err != nil || !supported {
+		t.Errorf("expected the configured suite to be supported, got %t, %v", supported, err)
+	}
+	if supported, err := c.CheckCipherSupported(ztls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA); err != nil || supported {
+		t.Errorf("expected another suite to be refused, got %t, %v", supported, err)
+	}
+	probes := c.grabData.CipherProbes
+	if len(probes) != 2 || !probes[0].Supported || probes[0].Alert != nil || probes[1].Supported || probes[1].Alert == nil {
+		t.Errorf("unexpected probe events %+v", probes)
+	}
+
+	c = new(Conn)
+	c.SetDial(func() (net.Conn, error) { return nil, errors.New("connection refused") })
+	if _, err := c.CheckCipherSupported(ztls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256); err == nil {
+		t.Error("expected the dial error")
+	}
+}
+
+func TestServerSignatureAlgorithms(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	c := new(Conn)
+	c.SetDial(tlsServer(&tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}))
+	codes, err := c.ServerSignatureAlgorithms()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	seen := make(map[uint16]bool)
+	for _, code := range codes {
+		if code&0xff != 3 || seen[code] {
+			t.Errorf("expected distinct ECDSA algorithms, got %04x", codes)
+		}
+		seen[code] = true
+	}
+	if !seen[0x0403] {
+		t.Errorf("expected ECDSA with SHA-256 among %04x", codes)
+	}
+	if event := c.grabData.SignatureAlgorithms; event == nil || len(event.Algorithms) != len(codes) {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	c := new(Conn)
+	c.SetDial(tlsServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS11,
+		MaxVersion:   tls.VersionTLS12,
+	}))
+	supported, err := c.SupportedVersions()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[uint16]bool{
+		ztls.VersionSSL30: false,
+		ztls.VersionTLS10: false,
+		ztls.VersionTLS11: true,
+		ztls.VersionTLS12: true,
+	}
+	if !reflect.DeepEqual(supported, expected) {
+		t.Errorf("expected %v, got %v", expected, supported)
+	}
+	if event := c.grabData.VersionSupport; event == nil || len(event.Supported) != 2 || len(event.Unsupported) != 2 {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestDefaultVirtualHostCert(t *testing.T) {
+	named := selfSignedCert(t, "www.example.com")
+	fallback := selfSignedCert(t, "default.example.net")
+	c := &Conn{domain: "www.example.com"}
+	c.SetDial(sniServer(named, fallback))
+	leaf, err := c.DefaultVirtualHostCert()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if leaf.Subject.CommonName != "default.example.net" {
+		t.Errorf("expected the default certificate, got %s", leaf.Subject.CommonName)
+	}
+	event := c.grabData.DefaultVHost
+	if event.WithoutSNI == nil || event.SameCertificate || !bytes.Equal(event.SNICertificate, named.Certificate[0]) {
+		t.Errorf("expected different certificates with and without SNI, got %+v", event)
+	}
+	if !bytes.Equal(event.SNIFingerprint, x509.SHA256Fingerprint(named.Certificate[0])) {
+		t.Errorf("wrong fingerprint for the SNI leaf %x", event.SNIFingerprint)
+	}
+
+	c = &Conn{domain: "www.example.com"}
+	c.SetDial(sniServer(named, named))
+	if _, err := c.DefaultVirtualHostCert(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !c.grabData.DefaultVHost.SameCertificate {
+		t.Error("expected the same certificate with and without SNI")
+	}
+
+	// The leaf is taken from the connection's own handshake with SNI
+	conn, _ := sniServer(named, fallback)()
+	c = &Conn{conn: conn, domain: "www.example.com"}
+	c.SetDial(sniServer(named, fallback))
+	if err := c.TLSHandshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := c.DefaultVirtualHostCert(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if event := c.grabData.DefaultVHost; event.SameCertificate || !bytes.Equal(event.SNICertificate, named.Certificate[0]) {
+		t.Errorf("expected the SNI leaf from the connection's handshake, got %+v", event)
+	}
+	c.Close()
+}
+
+func TestSetVerifyCallback(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	dial := sniServer(cert, cert)
+	pinned := errors.New("certificate is not pinned")
+	for _, accept := range []bool{true, false} {
+		conn, _ := dial()
+		c := &Conn{conn: conn}
+		var seen [][]byte
+		c.SetVerifyCallback(func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			seen = rawCerts
+			if !accept {
+				return pinned
+			}
+			return nil
+		})
+		err := c.TLSHandshake()
+		if accept && err != nil || !accept && err != pinned {
+			t.Errorf("accept=%t: unexpected error %v", accept, err)
+		}
+		if len(seen) != 1 || !bytes.Equal(seen[0], cert.Certificate[0]) {
+			t.Errorf("accept=%t: callback did not see the server certificate", accept)
+		}
+		result := c.grabData.TLSHandshake.VerifyCallback
+		if result == nil || (result.Error == "") != accept {
+			t.Errorf("accept=%t: wrong recorded result %+v", accept, result)
+		}
+		c.Close()
+	}
+}
+
+func TestExtendedMasterSecret(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	conn, _ := sniServer(cert, cert)()
+	c := &Conn{conn: conn}
+	if c.ExtendedMasterSecret() {
+		t.Error("expected no extended master secret before a handshake")
+	}
+	if err := c.TLSHandshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !c.ExtendedMasterSecret() {
+		t.Error("expected the server to agree to the offered extension")
+	}
+	c.Close()
+
+	// A server that ignores the extension
+	cert = selfSignedCert(t, "www.example.com")
+	conn, _ = ztlsServer(&ztls.Config{
+		Certificates: []ztls.Certificate{{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey}},
+	})()
+	c = &Conn{conn: conn}
+	if err := c.TLSHandshake(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.ExtendedMasterSecret() {
+		t.Error("expected no extended master secret from a server without it")
+	}
+	c.Close()
+}
+
+func TestOfferCompression(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	dial := sniServer(cert, cert)
+	for _, offer := range []bool{false, true} {
+		conn, _ := dial()
+		c := &Conn{conn: conn}
+		c.SetOfferCompression(offer)
+		if err := c.TLSHandshake(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expected := []int{0}
+		if offer {
+			expected = []int{1, 0}
+		}
+		if got := c.grabData.TLSHandshake.OfferedCompression; !reflect.DeepEqual(got, expected) {
+			t.Errorf("offered=%t: expected compression methods %v, got %v", offer, expected, got)
+		}
+		c.Close()
+	}
+}
+
+// peekedConn replays bytes already read from a connection ahead of the rest
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestClientHelloIntolerance(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+	// intolerantTo dials a server that hangs up on a ClientHello record
+	// whose length is in [min, max]
+	intolerantTo := func(min, max int) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(server, header); err != nil {
+					return
+				}
+				if length := int(header[3])<<8 | int(header[4]); length >= min && length <= max {
+					return
+				}
+				tls.Server(&peekedConn{server, io.MultiReader(bytes.NewReader(header), server)}, config).Handshake()
+			}()
+			return client, nil
+		}
+	}
+	tests := []struct {
+		name       string
+		min, max   int
+		medium     bool
+		large      bool
+		intolerant bool
+	}{
+		{"tolerant", 1 << 16, 1 << 16, true, true, false},
+		{"F5", 256, 511, false, true, true},
+		{"long hellos", 513, 1 << 16, true, false, true},
+	}
+	var c *Conn
+	for _, test := range tests {
+		c = new(Conn)
+		c.SetDial(intolerantTo(test.min, test.max))
+		intolerant, err := c.CheckClientHelloIntolerance()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		event := c.grabData.Intolerance
+		if intolerant != test.intolerant || !event.MinimalSucceeded || event.MediumSucceeded != test.medium || event.LargeSucceeded != test.large {
+			t.Errorf("%s: unexpected result %t, %+v", test.name, intolerant, event)
+		}
+		if event.MinimalHelloSize >= 256 || event.MediumHelloSize < 256 || event.MediumHelloSize > 511 || event.LargeHelloSize <= 512 {
+			t.Errorf("%s: unexpected hello sizes %+v", test.name, event)
+		}
+	}
+
+	// A failure to dial for the large probe is recorded
+	dials := 0
+	dial := c.dial
+	c = new(Conn)
+	c.SetDial(func() (net.Conn, error) {
+		if dials++; dials > 2 {
+			return nil, errors.New("connection refused")
+		}
+		return dial()
+	})
+	if _, err := c.CheckClientHelloIntolerance(); err == nil {
+		t.Error("expected the dial error")
+	}
+	if event := c.grabData.Intolerance; event == nil || !event.MinimalSucceeded || event.Intolerant || event.Error == "" {
+		t.Errorf("expected an event recording the dial error, got %+v", event)
+	}
+}
+
+func TestCleanTLSShutdown(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+	tests := []struct {
+		name        string
+		serve       func(s *tls.Conn, raw net.Conn)
+		closeNotify bool
+		timedOut    bool
+	}{
+		{"answers", func(s *tls.Conn, raw net.Conn) {
+			// Only answers once the client's close_notify arrives
+			s.Read(make([]byte, 1))
+			s.Close()
+		}, true, false},
+		{"hangs up", func(s *tls.Conn, raw net.Conn) {
+			s.Read(make([]byte, 1))
+			raw.Close()
+		}, false, false},
+		{"ignores it", func(s *tls.Conn, raw net.Conn) {
+			time.Sleep(200 * time.Millisecond)
+			raw.Close()
+		}, false, true},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			s := tls.Server(server, config)
+			if s.Handshake() == nil {
+				test.serve(s, server)
+			}
+		}()
+		c := &Conn{conn: client}
+		c.SetCheckCloseNotify()
+		if err := c.TLSHandshake(); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		c.Close()
+		event := c.grabData.TLSShutdown
+		if event == nil || event.CloseNotify != test.closeNotify || event.TimedOut != test.timedOut {
+			t.Errorf("%s: expected close_notify %t and timeout %t, got %+v", test.name, test.closeNotify, test.timedOut, event)
+		}
+		if c.CleanTLSShutdown() != test.closeNotify {
+			t.Errorf("%s: wrong clean shutdown", test.name)
+		}
+	}
+}
+
+func TestCheckFallbackSCSV(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	c := &Conn{}
+	c.SetDial(tlsServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS12,
+	}))
+	rejected, err := c.CheckFallbackSCSV()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	event := c.grabData.FallbackSCSV
+	if !rejected || event.Alert == nil || *event.Alert != tlsAlertInappropriateFallback {
+		t.Errorf("expected an inappropriate_fallback alert, got %+v", event)
+	}
+	if event.MaxVersion != ztls.VersionTLS12 || event.FallbackVersion != ztls.VersionTLS11 {
+		t.Errorf("expected a fallback from TLS 1.2 to 1.1, got %+v", event)
+	}
+
+	// The ztls server ignores TLS_FALLBACK_SCSV and completes the handshake
+	zconfig := &ztls.Config{
+		Certificates: []ztls.Certificate{{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey}},
+		MaxVersion:   ztls.VersionTLS12,
+	}
+	c = &Conn{}
+	c.SetDial(ztlsServer(zconfig))
+	rejected, err = c.CheckFallbackSCSV()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if event := c.grabData.FallbackSCSV; rejected || !event.Completed {
+		t.Errorf("expected the fallback handshake to complete, got %+v", event)
+	}
+
+	// A TLS 1.2 only server refusing the fallback version is not a finding
+	c = &Conn{}
+	c.SetDial(tlsServer(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+	}))
+	if _, err := c.CheckFallbackSCSV(); err == nil {
+		t.Error("expected an error for a protocol_version alert")
+	}
+	if event := c.grabData.FallbackSCSV; event == nil || event.Rejected || event.Completed || event.Alert == nil || event.Error == "" {
+		t.Errorf("expected an inconclusive event with an alert, got %+v", event)
+	}
+
+	// Neither is a server hanging up on the fallback handshake
+	c = &Conn{}
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{ServerHello: &ztls.ServerHello{Version: ztls.VersionTLS12}}
+	c.SetDial(func() (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	if _, err := c.CheckFallbackSCSV(); err == nil {
+		t.Error("expected an error when the server hangs up")
+	}
+	if event := c.grabData.FallbackSCSV; event == nil || event.Rejected || event.Completed || event.Error == "" {
+		t.Errorf("expected an inconclusive event, got %+v", event)
+	}
+}
+
+func TestResumptionMechanism(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	for _, disabled := range []bool{false, true} {
+		config := &tls.Config{
+			Certificates:           []tls.Certificate{cert},
+			MaxVersion:             tls.VersionTLS12,
+			SessionTicketsDisabled: disabled,
+		}
+		c := &Conn{}
+		c.SetDial(func() (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				s := tls.Server(server, config)
+				if s.Handshake() == nil {
+					// Wait for the client to hang up
+					s.Read(make([]byte, 1))
+				}
+			}()
+			return client, nil
+		})
+		tickets, sessionIDs, err := c.ResumptionMechanism()
+		if err != nil {
+			t.Fatalf("disabled=%t: unexpected error: %s", disabled, err)
+		}
+		if tickets == disabled || sessionIDs {
+			t.Errorf("disabled=%t: expected tickets %t and no session IDs, got %t and %t", disabled, !disabled, tickets, sessionIDs)
+		}
+		if event := c.grabData.Resumption; event.TicketIssued == disabled || event.SessionIDIssued {
+			t.Errorf("disabled=%t: unexpected event %+v", disabled, event)
+		}
+	}
+}
+
+func TestResumptionMechanismSessionIDs(t *testing.T) {
+	cert := selfSignedCert(t, "www.example.com")
+	c := new(Conn)
+	c.SetDial(ztlsServer(&ztls.Config{
+		Certificates:           []ztls.Certificate{{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey}},
+		MaxVersion:             ztls.VersionTLS12,
+		SessionTicketsDisabled: true,
+		ServerSessionIDCache:   true,
+	}))
+	tickets, sessionIDs, err := c.ResumptionMechanism()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tickets || !sessionIDs {
+		t.Errorf("expected only session ID resumption, got tickets %t and session IDs %t", tickets, sessionIDs)
+	}
+	event := c.grabData.Resumption
+	if event.TicketIssued || !event.SessionIDIssued || !event.SessionIDResumed {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
@@ -14,7 +14,12 @@
 
 package zlib
 
-import "errors"
+import (
+	"encoding/pem"
+	"errors"
+
+	"github.com/zmap/zgrab/ztools/x509"
+)
 
 func errorToStringPointer(err error) *string {
 	if err == nil {
@@ -30,3 +35,26 @@ func stringPointerToError(s *string) error {
 	}
 	return errors.New(*s)
 }
+
+// ExtractPEMCertificates finds every PEM encoded certificate in data, such as
+// a text banner, and parses it. Blocks that are not certificates or do not
+// parse are skipped.
+func ExtractPEMCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
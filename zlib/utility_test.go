@@ -0,0 +1,339 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zmap/zgrab/ztools/x509"
+	"github.com/zmap/zgrab/ztools/x509/pkix"
+	"github.com/zmap/zgrab/ztools/ztls"
+)
+
+func TestExtractPEMCertificates(t *testing.T) {
+	cert, err := ioutil.ReadFile("../ztools/x509/testdata/ian.test.cert")
+	if err != nil {
+		t.Fatalf("could not read test certificate: %s", err)
+	}
+	banner := "220 service ready\r\n" + string(cert) +
+		"-----BEGIN CERTIFICATE-----\r\nbm90IGEgY2VydGlmaWNhdGU=\r\n-----END CERTIFICATE-----\r\n" +
+		"-----BEGIN CERTIFICATE-----\r\n!!!\r\n" +
+		string(cert)
+	certs := ExtractPEMCertificates([]byte(banner))
+	if len(certs) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(certs))
+	}
+	if certs[0].Subject.CommonName != certs[1].Subject.CommonName {
+		t.Errorf("expected the same certificate twice, got %q and %q", certs[0].Subject.CommonName, certs[1].Subject.CommonName)
+	}
+}
+
+func TestServerPublicKey(t *testing.T) {
+	c := new(Conn)
+	if _, err := c.ServerPublicKey(); err != ErrNoLeafCertificate {
+		t.Errorf("expected ErrNoLeafCertificate, got %v", err)
+	}
+	pem, err := ioutil.ReadFile("../ztools/x509/testdata/ian.test.cert")
+	if err != nil {
+		t.Fatalf("could not read test certificate: %s", err)
+	}
+	certs := ExtractPEMCertificates(pem)
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 certificate, got %d", len(certs))
+	}
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{
+		ServerCertificates: &ztls.Certificates{
+			Certificate: ztls.SimpleCertificate{Raw: certs[0].Raw},
+		},
+	}
+	key, err := c.ServerPublicKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := json.Marshal(key); err != nil {
+		t.Errorf("could not marshal %T: %s", key, err)
+	}
+}
+
+func TestCertificateKeyStrength(t *testing.T) {
+	c := new(Conn)
+	if bits, algo, weak := c.CertificateKeyStrength(); bits != 0 || algo != "" || weak {
+		t.Errorf("expected nothing without a handshake, got %d, %s and %t", bits, algo, weak)
+	}
+	pem, err := ioutil.ReadFile("../ztools/x509/testdata/san.test.cert")
+	if err != nil {
+		t.Fatalf("could not read test certificate: %s", err)
+	}
+	certs := ExtractPEMCertificates(pem)
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{
+		ServerCertificates: &ztls.Certificates{
+			Certificate: ztls.SimpleCertificate{Raw: certs[0].Raw},
+		},
+	}
+	if bits, algo, weak := c.CertificateKeyStrength(); bits != 3072 || algo != "rsa" || weak {
+		t.Errorf("expected a strong 3072 bit RSA key, got %d, %s and %t", bits, algo, weak)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.grabData.TLSHandshake.ServerCertificates.Certificate.Parsed = &x509.Certificate{PublicKey: &priv.PublicKey}
+	if bits, algo, weak := c.CertificateKeyStrength(); bits != 224 || algo != "ecdsa" || !weak {
+		t.Errorf("expected a weak 224 bit ECDSA key, got %d, %s and %t", bits, algo, weak)
+	}
+
+	c.grabData.TLSHandshake.ServerCertificates.Certificate.Parsed = &x509.Certificate{PublicKey: "not a key"}
+	if bits, algo, weak := c.CertificateKeyStrength(); bits != 0 || algo != "unknown" || weak {
+		t.Errorf("expected an unknown key, got %d, %s and %t", bits, algo, weak)
+	}
+}
+
+func TestLeafRevocationURLs(t *testing.T) {
+	c := new(Conn)
+	if c.LeafRevocationURLs() != nil {
+		t.Error("expected nil without a handshake")
+	}
+	pem, err := ioutil.ReadFile("../ztools/x509/testdata/davidadrian.org.cert")
+	if err != nil {
+		t.Fatalf("could not read test certificate: %s", err)
+	}
+	certs := ExtractPEMCertificates(pem)
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 certificate, got %d", len(certs))
+	}
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{
+		ServerCertificates: &ztls.Certificates{
+			Certificate: ztls.SimpleCertificate{Raw: certs[0].Raw},
+		},
+	}
+	urls := c.LeafRevocationURLs()
+	if urls == nil {
+		t.Fatal("expected revocation URLs")
+	}
+	if len(urls.CRLDistributionPoints) != 1 || urls.CRLDistributionPoints[0] != "http://crl.startssl.com/crt1-crl.crl" {
+		t.Errorf("wrong CRL distribution points %q", urls.CRLDistributionPoints)
+	}
+	if len(urls.OCSPServers) != 1 || urls.OCSPServers[0] != "http://ocsp.startssl.com/sub/class1/server/ca" {
+		t.Errorf("wrong OCSP servers %q", urls.OCSPServers)
+	}
+}
+
+func TestRequestedClientCAs(t *testing.T) {
+	c := new(Conn)
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{}
+	if cas := c.RequestedClientCAs(); cas != nil {
+		t.Errorf("expected nil without a CertificateRequest, got %q", cas)
+	}
+	name := pkix.Name{Country: []string{"US"}, Organization: []string{"Example"}, CommonName: "Example Client CA"}
+	der, err := asn1.Marshal(name.ToRDNSequence())
+	if err != nil {
+		t.Fatalf("could not marshal name: %s", err)
+	}
+	c.grabData.TLSHandshake.CertificateRequest = &ztls.CertificateRequest{
+		CertificateAuthorities: [][]byte{der, []byte("garbage")},
+	}
+	cas := c.RequestedClientCAs()
+	if len(cas) != 1 || cas[0] != "C=US, O=Example, CN=Example Client CA" {
+		t.Errorf("wrong certificate authorities %q", cas)
+	}
+	if c.grabData.ClientCertRequest == nil {
+		t.Error("expected a ClientCertRequestEvent")
+	}
+}
+
+func TestSMTPTLSReport(t *testing.T) {
+	c := &Conn{domain: "davidadrian.org"}
+	c.grabData.EHLO = "250-mx.davidadrian.org\r\n250-SIZE 1000\r\n250 STARTTLS\r\n"
+	c.grabData.StartTLS = "220 2.0.0 Ready to start TLS\r\n"
+	if report := c.SMTPTLSReport(); !report.STARTTLSOffered || !report.STARTTLSAccepted || report.HandshakeSucceeded {
+		t.Errorf("unexpected report before the handshake: %+v", report)
+	}
+
+	pem, err := ioutil.ReadFile("../ztools/x509/testdata/davidadrian.org.cert")
+	if err != nil {
+		t.Fatalf("could not read test certificate: %s", err)
+	}
+	certs := ExtractPEMCertificates(pem)
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{
+		ServerHello: &ztls.ServerHello{
+			Version:     ztls.VersionTLS12,
+			CipherSuite: ztls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		ServerCertificates: &ztls.Certificates{
+			Certificate: ztls.SimpleCertificate{Raw: certs[0].Raw},
+		},
+		ServerFinished: new(ztls.Finished),
+	}
+	report := c.SMTPTLSReport()
+	if !report.HandshakeSucceeded || report.Version != ztls.VersionTLS12 || report.CipherSuite != ztls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("wrong handshake summary: %+v", report)
+	}
+	if !report.HostnameMatches || report.Validated {
+		t.Errorf("wrong certificate summary: %+v", report)
+	}
+
+	c.domain = "example.com"
+	if c.SMTPTLSReport().HostnameMatches {
+		t.Error("expected the certificate not to match example.com")
+	}
+}
+
+func TestChainIssues(t *testing.T) {
+	issue := func(name string, parent *testCert, isCA bool, notAfter time.Time) *testCert {
+		return issueTestCert(t, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-48 * time.Hour),
+			NotAfter:              notAfter,
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		}, parent)
+	}
+	later := time.Now().Add(24 * time.Hour)
+	root := issue("Test Root", nil, true, later)
+	inter := issue("Test Intermediate", root, true, later)
+	expired := issue("Old Intermediate", root, true, time.Now().Add(-time.Hour))
+	leaf := issue("www.example.com", inter, false, later)
+	oldLeaf := issue("old.example.com", expired, false, later)
+	stray := issue("Stray", nil, true, later)
+	pool := x509.NewCertPool()
+	pool.AddCert(root.cert)
+
+	present := func(certs ...*testCert) *Conn {
+		sc := &ztls.Certificates{Certificate: ztls.SimpleCertificate{Raw: certs[0].cert.Raw}}
+		for _, cert := range certs[1:] {
+			sc.Chain = append(sc.Chain, ztls.SimpleCertificate{Raw: cert.cert.Raw})
+		}
+		c := &Conn{caPool: pool}
+		c.grabData.TLSHandshake = &ztls.ServerHandshake{ServerCertificates: sc}
+		return c
+	}
+	tests := []struct {
+		certs    []*testCert
+		expected []string
+	}{
+		{[]*testCert{leaf, inter}, nil},
+		{[]*testCert{leaf, inter, root}, nil},
+		{[]*testCert{leaf}, []string{"missing intermediate: no trusted issuer for www.example.com"}},
+		{[]*testCert{leaf, root, inter}, []string{"certificates are out of order"}},
+		{[]*testCert{leaf, inter, stray, inter}, []string{"unrelated certificate: Stray", "duplicate certificate: Test Intermediate"}},
+		{[]*testCert{oldLeaf, expired}, []string{"expired intermediate: Old Intermediate"}},
+		{[]*testCert{stray}, []string{"untrusted root: Stray"}},
+	}
+	for i, test := range tests {
+		if issues := present(test.certs...).ChainIssues(); !reflect.DeepEqual(issues, test.expected) {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, issues)
+		}
+	}
+	if (&Conn{}).ChainIssues() != nil {
+		t.Error("expected no issues without a handshake")
+	}
+}
+
+func TestCertificateUsages(t *testing.T) {
+	root := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	leaf := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "www.example.com"},
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+	}, root)
+	misissued := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "client.example.com"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, root)
+
+	c := &Conn{}
+	c.grabData.TLSHandshake = &ztls.ServerHandshake{ServerCertificates: &ztls.Certificates{
+		Certificate: ztls.SimpleCertificate{Raw: misissued.cert.Raw},
+		Chain:       []ztls.SimpleCertificate{{Raw: leaf.cert.Raw}, {Raw: root.cert.Raw}},
+	}}
+	usages := c.CertificateUsages()
+	if len(usages) != 3 {
+		t.Fatalf("expected three certificates, got %d", len(usages))
+	}
+	if u := usages[0]; !u.IsCA || u.ServerAuth || u.MaxPathLen == nil || *u.MaxPathLen != 0 ||
+		!reflect.DeepEqual(u.ExtKeyUsage, []string{"client_auth"}) {
+		t.Errorf("unexpected usage for the CA client certificate: %+v", u)
+	}
+	if u := usages[1]; u.IsCA || !u.ServerAuth || u.MaxPathLen != nil || u.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		t.Errorf("unexpected usage for the leaf: %+v", u)
+	}
+	if u := usages[2]; !u.IsCA || u.Subject != "Test Root" {
+		t.Errorf("unexpected usage for the root: %+v", u)
+	}
+	if (&Conn{}).CertificateUsages() != nil {
+		t.Error("expected no usages without a handshake")
+	}
+}
+
+func TestDowngradeIndicators(t *testing.T) {
+	random := func(tail string) []byte {
+		return append(make([]byte, 24), tail...)
+	}
+	upTo := func(max ztls.TLSVersion) []ztls.TLSVersion {
+		var versions []ztls.TLSVersion
+		for v := ztls.TLSVersion(ztls.VersionSSL30); v <= max; v++ {
+			versions = append(versions, v)
+		}
+		return versions
+	}
+	tests := []struct {
+		version  ztls.TLSVersion
+		offered  ztls.TLSVersion
+		random   []byte
+		expected []string
+	}{
+		{ztls.VersionTLS12, ztls.VersionTLS12, random("\x00\x00\x00\x00\x00\x00\x00\x00"), nil},
+		{ztls.VersionTLS12, ztls.VersionTLS12, random("DOWNGRD\x01"), nil},
+		{ztls.VersionTLS11, ztls.VersionTLS12, random("DOWNGRD\x00"), []string{"downgraded to TLSv1.1 although TLSv1.2 was offered and is supported"}},
+		{ztls.VersionTLS10, ztls.VersionTLS10, random("DOWNGRD\x00"), nil},
+		{ztls.VersionTLS11, ztls.VersionTLS12, random("DOWNGRD\x01"), []string{"TLSv1.3 sentinel in a ServerHello for TLSv1.1"}},
+		{ztls.VersionTLS12, ztls.VersionTLS12, random("DOWNGRD\x00"), []string{"TLSv1.2 sentinel in a ServerHello for TLSv1.2"}},
+	}
+	for i, test := range tests {
+		c := &Conn{}
+		c.grabData.TLSHandshake = &ztls.ServerHandshake{
+			ServerHello:     &ztls.ServerHello{Version: test.version, Random: test.random},
+			OfferedVersions: upTo(test.offered),
+		}
+		if indicators := c.DowngradeIndicators(); !reflect.DeepEqual(indicators, test.expected) {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, indicators)
+		}
+		if sentinel := bytes.HasPrefix(test.random[24:], []byte("DOWNGRD")); (c.grabData.Downgrade != nil) != sentinel {
+			t.Errorf("%d: event recorded only with a sentinel, got %+v", i, c.grabData.Downgrade)
+		}
+	}
+	if (&Conn{}).DowngradeIndicators() != nil {
+		t.Error("expected no indicators without a handshake")
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package zlib
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// whoisMaxSize caps how much of a WHOIS response is read
+const whoisMaxSize = 64 * 1024
+
+var ErrInvalidWHOISQuery = errors.New("WHOIS query must not contain CR or LF")
+
+// A WHOISEvent represents sending a WHOIS query and reading the response
+type WHOISEvent struct {
+	Query     string `json:"query"`
+	Response  string `json:"response,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// WHOISQuery sends query and reads the response until the server closes the
+// connection, up to whoisMaxSize bytes.
+func (c *Conn) WHOISQuery(query string) (string, error) {
+	if strings.ContainsAny(query, "\r\n") {
+		return "", ErrInvalidWHOISQuery
+	}
+	event := &WHOISEvent{Query: query}
+	c.grabData.WHOIS = event
+	if _, err := c.getUnderlyingConn().Write([]byte(query + c.newline())); err != nil {
+		return "", err
+	}
+	// Read one byte past the cap to tell a full response from a cut off one
+	res, err := ioutil.ReadAll(io.LimitReader(c.getUnderlyingConn(), whoisMaxSize+1))
+	if len(res) > whoisMaxSize {
+		res = res[0:whoisMaxSize]
+		event.Truncated = true
+	}
+	event.Response = string(res)
+	return event.Response, err
+}
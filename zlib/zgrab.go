@@ -23,10 +23,11 @@ import (
 	"github.com/zmap/zgrab/ztools/scada/bacnet"
 	"github.com/zmap/zgrab/ztools/scada/dnp3"
 	"github.com/zmap/zgrab/ztools/scada/fox"
+	"github.com/zmap/zgrab/ztools/scada/siemens"
 	"github.com/zmap/zgrab/ztools/ssh"
 	"github.com/zmap/zgrab/ztools/telnet"
+	"github.com/zmap/zgrab/ztools/x509"
 	"github.com/zmap/zgrab/ztools/ztls"
-	"github.com/zmap/zgrab/ztools/scada/siemens"
 )
 
 type Grab struct {
@@ -48,23 +49,68 @@ type encodedGrab struct {
 }
 
 type GrabData struct {
-	Banner       string                `json:"banner,omitempty"`
-	Read         string                `json:"read,omitempty"`
-	Write        string                `json:"write,omitempty"`
-	EHLO         string                `json:"ehlo,omitempty"`
-	SMTPHelp     *SMTPHelpEvent        `json:"smtp_help,omitempty"`
-	StartTLS     string                `json:"starttls,omitempty"`
-	TLSHandshake *ztls.ServerHandshake `json:"tls,omitempty"`
-	HTTP         *HTTP                 `json:"http,omitempty"`
-	Heartbleed   *ztls.Heartbleed      `json:"heartbleed,omitempty"`
-	Modbus       *ModbusEvent          `json:"modbus,omitempty"`
-	SSH          *ssh.HandshakeLog     `json:"ssh,omitempty"`
-	FTP          *ftp.FTPLog           `json:"ftp,omitempty"`
-	BACNet       *bacnet.Log           `json:"bacnet,omitempty"`
-	Fox          *fox.FoxLog           `json:"fox,omitempty"`
-	DNP3         *dnp3.DNP3Log         `json:"dnp3,omitempty"`
-	S7           *siemens.S7Log         `json:"s7,omitempty"`
-	Telnet       *telnet.TelnetLog     `json:"telnet,omitempty"`
+	LocalAddr            string                    `json:"local_addr,omitempty"`
+	DialAddress          string                    `json:"dial_address,omitempty"`
+	ProxyHeader          *ProxyHeaderEvent         `json:"proxy_header,omitempty"`
+	Banner               string                    `json:"banner,omitempty"`
+	BannerUnterminated   bool                      `json:"banner_unterminated,omitempty"`
+	PEMCertificates      []*x509.Certificate       `json:"pem_certificates,omitempty"`
+	Read                 string                    `json:"read,omitempty"`
+	ReadLength           int                       `json:"read_length,omitempty"`
+	Write                string                    `json:"write,omitempty"`
+	WriteLength          int                       `json:"write_length,omitempty"`
+	RawWrites            []WriteEvent              `json:"raw_writes,omitempty"`
+	EHLO                 string                    `json:"ehlo,omitempty"`
+	EHLOMaxMessageSize   *int64                    `json:"ehlo_max_message_size,omitempty"`
+	SMTPHelp             *SMTPHelpEvent            `json:"smtp_help,omitempty"`
+	SMTPRCPT             []SMTPRecipientEvent      `json:"smtp_rcpt,omitempty"`
+	SMTPCommands         []SMTPCommandProbe        `json:"smtp_commands,omitempty"`
+	SMTPAuthRequired     *SMTPAuthRequiredEvent    `json:"smtp_auth_required,omitempty"`
+	SMTPExtensions       *SMTPExtensionsEvent      `json:"smtp_extensions,omitempty"`
+	MailOverflow         *SMTPOverflowEvent        `json:"mail_overflow,omitempty"`
+	IMAPCapabilities     []string                  `json:"imap_capabilities,omitempty"`
+	IMAPNamespace        *IMAPNamespaceEvent       `json:"imap_namespace,omitempty"`
+	IMAPList             *IMAPListEvent            `json:"imap_list,omitempty"`
+	IMAPIdle             *IMAPIdleEvent            `json:"imap_idle,omitempty"`
+	POP3Login            *POP3LoginEvent           `json:"pop3_login,omitempty"`
+	POP3Top              *POP3TopEvent             `json:"pop3_top,omitempty"`
+	POP3Capabilities     []string                  `json:"pop3_capabilities,omitempty"`
+	POP3TLSCapabilities  []string                  `json:"pop3_tls_capabilities,omitempty"`
+	POP3Capa             *POP3CapabilitiesEvent    `json:"pop3_capa,omitempty"`
+	POP3TLSCapa          *POP3CapabilitiesEvent    `json:"pop3_tls_capa,omitempty"`
+	WHOIS                *WHOISEvent               `json:"whois,omitempty"`
+	DNSChaos             *DNSChaosEvent            `json:"dns_chaos,omitempty"`
+	StartTLS             string                    `json:"starttls,omitempty"`
+	StartTLSServerClosed bool                      `json:"starttls_server_closed,omitempty"`
+	TLSHandshake         *ztls.ServerHandshake     `json:"tls,omitempty"`
+	TLSShutdown          *TLSShutdownEvent         `json:"tls_shutdown,omitempty"`
+	CipherProbes         []SingleCipherProbeEvent  `json:"cipher_probes,omitempty"`
+	SignatureAlgorithms  *SignatureAlgorithmsEvent `json:"signature_algorithms,omitempty"`
+	VersionSupport       *VersionSupportEvent      `json:"version_support,omitempty"`
+	CipherPreference     *CipherPreferenceEvent    `json:"cipher_preference,omitempty"`
+	JARM                 *JARMEvent                `json:"jarm,omitempty"`
+	Intolerance          *IntoleranceEvent         `json:"intolerance,omitempty"`
+	FallbackSCSV         *FallbackSCSVEvent        `json:"fallback_scsv,omitempty"`
+	Resumption           *ResumptionEvent          `json:"resumption,omitempty"`
+	Downgrade            *DowngradeEvent           `json:"downgrade,omitempty"`
+	SSLv2                *SSLv2Event               `json:"sslv2,omitempty"`
+	HandshakeOrdering    *HandshakeOrderingEvent   `json:"handshake_ordering,omitempty"`
+	ClientCertRequest    *ClientCertRequestEvent   `json:"client_cert_request,omitempty"`
+	DefaultVHost         *DefaultVHostEvent        `json:"default_vhost,omitempty"`
+	HTTP                 *HTTP                     `json:"http,omitempty"`
+	Heartbleed           *ztls.Heartbleed          `json:"heartbleed,omitempty"`
+	Modbus               *ModbusEvent              `json:"modbus,omitempty"`
+	ModbusGateway        *ModbusGatewayEvent       `json:"modbus_gateway,omitempty"`
+	MQTT                 *MQTTConnectEvent         `json:"mqtt,omitempty"`
+	MySQL                *MySQLHandshakeEvent      `json:"mysql,omitempty"`
+	RDP                  *RDPNegotiateEvent        `json:"rdp,omitempty"`
+	SSH                  *ssh.HandshakeLog         `json:"ssh,omitempty"`
+	FTP                  *ftp.FTPLog               `json:"ftp,omitempty"`
+	BACNet               *bacnet.Log               `json:"bacnet,omitempty"`
+	Fox                  *fox.FoxLog               `json:"fox,omitempty"`
+	DNP3                 *dnp3.DNP3Log             `json:"dnp3,omitempty"`
+	S7                   *siemens.S7Log            `json:"s7,omitempty"`
+	Telnet               *telnet.TelnetLog         `json:"telnet,omitempty"`
 }
 
 func (g *Grab) MarshalJSON() ([]byte, error) {
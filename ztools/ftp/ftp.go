@@ -38,6 +38,35 @@ func GetFTPBanner(logStruct *FTPLog, connection net.Conn) (bool, error) {
 	return strings.HasPrefix(retCode, "2"), nil
 }
 
+// GetFTPFeatures sends FEAT (RFC 2389) and returns the features listed in a
+// 211 reply, one per line between the first and last lines. A server that
+// does not support FEAT lists none.
+func GetFTPFeatures(logStruct *FTPLog, connection net.Conn) ([]string, error) {
+	buffer := make([]byte, 2048)
+	if _, err := connection.Write([]byte("FEAT\r\n")); err != nil {
+		return nil, err
+	}
+	respLen, err := util.ReadUntilRegex(connection, buffer, ftpEndRegex)
+	logStruct.FeatResp = string(buffer[0:respLen])
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(logStruct.FeatResp, "211") {
+		return nil, nil
+	}
+	lines := strings.Split(strings.TrimRight(logStruct.FeatResp, "\r\n"), "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		if feature := strings.TrimSpace(line); feature != "" {
+			logStruct.Features = append(logStruct.Features, feature)
+		}
+	}
+	return logStruct.Features, nil
+}
+
 func SetupFTPS(logStruct *FTPLog, connection net.Conn) (bool, error) {
 	buffer := make([]byte, 1024)
 
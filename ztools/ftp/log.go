@@ -15,7 +15,9 @@
 package ftp
 
 type FTPLog struct {
-	Banner      string `json:"banner,omitempty"`
-	AuthTLSResp string `json:"auth_tls_resp,omitempty"`
-	AuthSSLResp string `json:"auth_ssl_resp,omitempty"`
+	Banner      string   `json:"banner,omitempty"`
+	AuthTLSResp string   `json:"auth_tls_resp,omitempty"`
+	AuthSSLResp string   `json:"auth_ssl_resp,omitempty"`
+	FeatResp    string   `json:"feat_resp,omitempty"`
+	Features    []string `json:"features,omitempty"`
 }
@@ -100,6 +100,10 @@ type Response struct {
 	BodyText   string        `json:"body,omitempty"`
 	BodySHA256 []byte        `json:"body_sha256,omitempty"`
 
+	// Encoded is true if the body was sent with a Content-Encoding, and
+	// BodyText holds the decoded body.
+	Encoded bool `json:"body_encoded,omitempty"`
+
 	// ContentLength records the length of the associated content.  The
 	// value -1 indicates that the length is unknown.  Unless RequestMethod
 	// is "HEAD", values >= 0 indicate that the given number of bytes may
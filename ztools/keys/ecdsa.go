@@ -0,0 +1,109 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// ECDSAPublicKey wraps an *ecdsa.PublicKey so it serializes nicely to JSON
+type ECDSAPublicKey struct {
+	*ecdsa.PublicKey
+}
+
+type auxECDSAPublicKey struct {
+	Curve  string `json:"curve"`
+	X      []byte `json:"x"`
+	Y      []byte `json:"y"`
+	Length int    `json:"length"`
+}
+
+var ecdsaCurves = map[string]elliptic.Curve{
+	"P-224": elliptic.P224(),
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// Verify returns true if sig is a valid ASN.1 DER encoded ECDSA signature of
+// hash by the key. It returns false for malformed signatures.
+func (ep *ECDSAPublicKey) Verify(hash, sig []byte) bool {
+	if ep.PublicKey == nil {
+		return false
+	}
+	var esig ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &esig)
+	if err != nil || len(rest) != 0 || esig.R == nil || esig.S == nil {
+		return false
+	}
+	if esig.R.Sign() <= 0 || esig.S.Sign() <= 0 {
+		return false
+	}
+	return ecdsa.Verify(ep.PublicKey, hash, esig.R, esig.S)
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (ep *ECDSAPublicKey) MarshalJSON() ([]byte, error) {
+	var aux auxECDSAPublicKey
+	if ep.PublicKey != nil {
+		params := ep.Curve.Params()
+		aux.Curve = params.Name
+		aux.X = ep.X.Bytes()
+		aux.Y = ep.Y.Bytes()
+		aux.Length = params.BitSize
+	}
+	return json.Marshal(&aux)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (ep *ECDSAPublicKey) UnmarshalJSON(b []byte) error {
+	var aux auxECDSAPublicKey
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	curve, ok := ecdsaCurves[aux.Curve]
+	if !ok {
+		return fmt.Errorf("unknown curve %s", aux.Curve)
+	}
+	ep.PublicKey = &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(aux.X),
+		Y:     new(big.Int).SetBytes(aux.Y),
+	}
+	return nil
+}
+
+// MarshalDER returns the key as a DER encoded SubjectPublicKeyInfo
+func (ep *ECDSAPublicKey) MarshalDER() ([]byte, error) {
+	if ep.PublicKey == nil {
+		return nil, ErrNoPublicKey
+	}
+	return publicKeyDER(ep.PublicKey)
+}
+
+// MarshalPEM returns the key as a PEM encoded SubjectPublicKeyInfo, which
+// x509.ParsePKIXPublicKey reads back
+func (ep *ECDSAPublicKey) MarshalPEM() ([]byte, error) {
+	return publicKeyPEM(ep.MarshalDER())
+}
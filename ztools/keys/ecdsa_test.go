@@ -0,0 +1,93 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestECDSA(t *testing.T) { TestingT(t) }
+
+type ECDSASuite struct {
+	priv *ecdsa.PrivateKey
+	pk   *ECDSAPublicKey
+}
+
+var _ = Suite(&ECDSASuite{})
+
+func (s *ECDSASuite) SetUpTest(c *C) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	s.priv = priv
+	s.pk = &ECDSAPublicKey{&priv.PublicKey}
+}
+
+func (s *ECDSASuite) TestEncodeDecode(c *C) {
+	b, err := json.Marshal(s.pk)
+	c.Assert(err, IsNil)
+	var dec ECDSAPublicKey
+	err = json.Unmarshal(b, &dec)
+	c.Assert(err, IsNil)
+	c.Check(dec.Curve, Equals, s.pk.Curve)
+	c.Check(dec.X, DeepEquals, s.pk.X)
+	c.Check(dec.Y, DeepEquals, s.pk.Y)
+}
+
+func (s *ECDSASuite) TestUnknownCurve(c *C) {
+	var dec ECDSAPublicKey
+	err := json.Unmarshal([]byte(`{"curve":"P-192","x":"","y":"","length":192}`), &dec)
+	c.Check(err, NotNil)
+}
+
+func (s *ECDSASuite) TestVerify(c *C) {
+	hash := sha256.Sum256([]byte("signed data"))
+	r, ss, err := ecdsa.Sign(rand.Reader, s.priv, hash[:])
+	c.Assert(err, IsNil)
+	sig, err := asn1.Marshal(ecdsaSignature{r, ss})
+	c.Assert(err, IsNil)
+	c.Check(s.pk.Verify(hash[:], sig), Equals, true)
+
+	tamperedHash := hash
+	tamperedHash[0] ^= 0xff
+	c.Check(s.pk.Verify(tamperedHash[:], sig), Equals, false)
+
+	tamperedSig, err := asn1.Marshal(ecdsaSignature{r, new(big.Int).Add(ss, big.NewInt(1))})
+	c.Assert(err, IsNil)
+	c.Check(s.pk.Verify(hash[:], tamperedSig), Equals, false)
+
+	c.Check(s.pk.Verify(hash[:], sig[:len(sig)-1]), Equals, false)
+	c.Check(s.pk.Verify(hash[:], append(sig, 0)), Equals, false)
+}
+
+func (s *ECDSASuite) TestMarshalPEM(c *C) {
+	b, err := s.pk.MarshalPEM()
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode(b)
+	c.Assert(block, NotNil)
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	c.Assert(err, IsNil)
+	c.Check(s.pk.PublicKey.Equal(pub), Equals, true)
+}
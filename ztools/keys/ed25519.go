@@ -0,0 +1,65 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+)
+
+// Ed25519PublicKey wraps an ed25519.PublicKey so it serializes nicely to JSON
+type Ed25519PublicKey struct {
+	ed25519.PublicKey
+}
+
+type auxEd25519PublicKey struct {
+	Public []byte `json:"public_bytes"`
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (ep *Ed25519PublicKey) MarshalJSON() ([]byte, error) {
+	aux := auxEd25519PublicKey{
+		Public: []byte(ep.PublicKey),
+	}
+	return json.Marshal(&aux)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (ep *Ed25519PublicKey) UnmarshalJSON(b []byte) error {
+	var aux auxEd25519PublicKey
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if len(aux.Public) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid ed25519 public key length %d", len(aux.Public))
+	}
+	ep.PublicKey = ed25519.PublicKey(aux.Public)
+	return nil
+}
+
+// MarshalDER returns the key as a DER encoded SubjectPublicKeyInfo
+func (ep *Ed25519PublicKey) MarshalDER() ([]byte, error) {
+	if len(ep.PublicKey) == 0 {
+		return nil, ErrNoPublicKey
+	}
+	return publicKeyDER(ep.PublicKey)
+}
+
+// MarshalPEM returns the key as a PEM encoded SubjectPublicKeyInfo, which
+// x509.ParsePKIXPublicKey reads back
+func (ep *Ed25519PublicKey) MarshalPEM() ([]byte, error) {
+	return publicKeyPEM(ep.MarshalDER())
+}
@@ -0,0 +1,53 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestEd25519(t *testing.T) { TestingT(t) }
+
+type Ed25519Suite struct {
+	pk *Ed25519PublicKey
+}
+
+var _ = Suite(&Ed25519Suite{})
+
+func (s *Ed25519Suite) SetUpTest(c *C) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	s.pk = &Ed25519PublicKey{pub}
+}
+
+func (s *Ed25519Suite) TestMarshalPEM(c *C) {
+	b, err := s.pk.MarshalPEM()
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode(b)
+	c.Assert(block, NotNil)
+	c.Check(block.Type, Equals, "PUBLIC KEY")
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	c.Assert(err, IsNil)
+	c.Check(pub, DeepEquals, s.pk.PublicKey)
+
+	_, err = new(Ed25519PublicKey).MarshalPEM()
+	c.Check(err, Equals, ErrNoPublicKey)
+}
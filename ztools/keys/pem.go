@@ -0,0 +1,37 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package keys
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+// ErrNoPublicKey is returned when marshaling a wrapper without a key
+var ErrNoPublicKey = errors.New("keys: no public key to marshal")
+
+// publicKeyPEM encodes a DER SubjectPublicKeyInfo as a PEM PUBLIC KEY block
+func publicKeyPEM(der []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// publicKeyDER encodes pub as a DER SubjectPublicKeyInfo
+func publicKeyDER(pub interface{}) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(pub)
+}
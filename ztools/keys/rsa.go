@@ -63,3 +63,17 @@ func (rp *RSAPublicKey) UnmarshalJSON(b []byte) error {
 	}
 	return nil
 }
+
+// MarshalDER returns the key as a DER encoded SubjectPublicKeyInfo
+func (rp *RSAPublicKey) MarshalDER() ([]byte, error) {
+	if rp.PublicKey == nil {
+		return nil, ErrNoPublicKey
+	}
+	return publicKeyDER(rp.PublicKey)
+}
+
+// MarshalPEM returns the key as a PEM encoded SubjectPublicKeyInfo, which
+// x509.ParsePKIXPublicKey reads back
+func (rp *RSAPublicKey) MarshalPEM() ([]byte, error) {
+	return publicKeyPEM(rp.MarshalDER())
+}
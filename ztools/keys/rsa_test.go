@@ -16,7 +16,9 @@ package keys
 
 import (
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"math/big"
 	"testing"
 
@@ -49,3 +51,17 @@ func (s *RSASuite) TestEncodeDecode(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(&dec, DeepEquals, s.pk4096)
 }
+
+func (s *RSASuite) TestMarshalPEM(c *C) {
+	b, err := s.pk4096.MarshalPEM()
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode(b)
+	c.Assert(block, NotNil)
+	c.Check(block.Type, Equals, "PUBLIC KEY")
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	c.Assert(err, IsNil)
+	c.Check(pub, DeepEquals, s.pk4096.PublicKey)
+
+	_, err = new(RSAPublicKey).MarshalPEM()
+	c.Check(err, Equals, ErrNoPublicKey)
+}
@@ -345,6 +345,7 @@ func (c *Conn) dhGroupExchange() error {
 		return err
 	}
 	c.handshakeLog.KexDHGroupReply = gexReply
+	c.recordServerHostKey(gexReply.K_S)
 	return nil
 }
 
@@ -371,9 +372,18 @@ func (c *Conn) dhExchange(params *DHParams) error {
 	}
 
 	c.handshakeLog.DHReply = dhReply
+	c.recordServerHostKey(dhReply.K_S)
 	return nil
 }
 
+func (c *Conn) recordServerHostKey(raw []byte) {
+	hostKey, err := ParseServerHostKey(raw)
+	if err != nil {
+		hostKey.ParseError = err.Error()
+	}
+	c.handshakeLog.ServerHostKey = hostKey
+}
+
 func (c *Conn) dhGroup1Kex() error {
 	return c.dhExchange(&dhOakleyGroup2)
 }
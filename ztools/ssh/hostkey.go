@@ -0,0 +1,130 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/zmap/zgrab/ztools/keys"
+)
+
+// ServerHostKey holds the host key blob (K_S) sent by the server in its key
+// exchange reply, and the parsed public key when the algorithm is known.
+type ServerHostKey struct {
+	Algorithm        string                 `json:"algorithm,omitempty"`
+	Raw              []byte                 `json:"raw,omitempty"`
+	RSAPublicKey     *keys.RSAPublicKey     `json:"rsa_public_key,omitempty"`
+	ECDSAPublicKey   *keys.ECDSAPublicKey   `json:"ecdsa_public_key,omitempty"`
+	Ed25519PublicKey *keys.Ed25519PublicKey `json:"ed25519_public_key,omitempty"`
+	ParseError       string                 `json:"parse_error,omitempty"`
+}
+
+var errShortHostKey = errors.New("host key blob is too short")
+
+// readString reads an SSH string (uint32 length followed by data) from b,
+// returning the data and the remainder of b.
+func readString(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errShortHostKey
+	}
+	length := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if length > uint32(len(b)) {
+		return nil, nil, errShortHostKey
+	}
+	return b[0:length], b[length:], nil
+}
+
+var sshECDSACurves = map[string]elliptic.Curve{
+	"nistp256": elliptic.P256(),
+	"nistp384": elliptic.P384(),
+	"nistp521": elliptic.P521(),
+}
+
+// ParseServerHostKey decodes a host key blob in the format of RFC 4253
+// Section 6.6. Keys of an unrecognized type are returned with only the
+// algorithm and raw bytes set.
+func ParseServerHostKey(raw []byte) (*ServerHostKey, error) {
+	hk := &ServerHostKey{
+		Raw: raw,
+	}
+	name, rest, err := readString(raw)
+	if err != nil {
+		return hk, err
+	}
+	hk.Algorithm = string(name)
+	switch hk.Algorithm {
+	case HOST_KEY_RSA:
+		var e, n []byte
+		if e, rest, err = readString(rest); err != nil {
+			return hk, err
+		}
+		if n, rest, err = readString(rest); err != nil {
+			return hk, err
+		}
+		E := new(big.Int).SetBytes(e)
+		if !E.IsInt64() || E.Int64() > int64(^uint32(0)) {
+			return hk, errors.New("rsa exponent is too large")
+		}
+		hk.RSAPublicKey = &keys.RSAPublicKey{
+			PublicKey: &rsa.PublicKey{
+				E: int(E.Int64()),
+				N: new(big.Int).SetBytes(n),
+			},
+		}
+	case HOST_KEY_ECDSA_SHA2_NISTP256, HOST_KEY_ECDSA_SHA2_NISTP384, HOST_KEY_ECDSA_SHA2_NISTP521:
+		var curveName, q []byte
+		if curveName, rest, err = readString(rest); err != nil {
+			return hk, err
+		}
+		if q, rest, err = readString(rest); err != nil {
+			return hk, err
+		}
+		curve, ok := sshECDSACurves[string(curveName)]
+		if !ok {
+			return hk, fmt.Errorf("unknown ecdsa curve %s", curveName)
+		}
+		x, y := elliptic.Unmarshal(curve, q)
+		if x == nil {
+			return hk, errors.New("invalid ecdsa public point")
+		}
+		hk.ECDSAPublicKey = &keys.ECDSAPublicKey{
+			PublicKey: &ecdsa.PublicKey{
+				Curve: curve,
+				X:     x,
+				Y:     y,
+			},
+		}
+	case HOST_KEY_ED_25519:
+		var pub []byte
+		if pub, rest, err = readString(rest); err != nil {
+			return hk, err
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return hk, fmt.Errorf("invalid ed25519 public key length %d", len(pub))
+		}
+		hk.Ed25519PublicKey = &keys.Ed25519PublicKey{
+			PublicKey: ed25519.PublicKey(pub),
+		}
+	}
+	return hk, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+// sshBlob joins fields as SSH strings, each prefixed with its length
+func sshBlob(fields ...[]byte) []byte {
+	var b []byte
+	for _, field := range fields {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+	return b
+}
+
+func TestParseServerHostKey(t *testing.T) {
+	modulus := new(big.Int).Lsh(big.NewInt(1), 1023)
+	modulus.Add(modulus, big.NewInt(1))
+	rsaBlob := sshBlob([]byte(HOST_KEY_RSA), []byte{0x01, 0x00, 0x01}, append([]byte{0x00}, modulus.Bytes()...))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := elliptic.Marshal(elliptic.P256(), ecKey.X, ecKey.Y)
+	ecdsaBlob := sshBlob([]byte(HOST_KEY_ECDSA_SHA2_NISTP256), []byte("nistp256"), point)
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Blob := sshBlob([]byte(HOST_KEY_ED_25519), edKey)
+
+	tests := []struct {
+		name      string
+		raw       []byte
+		algorithm string
+		err       bool
+		check     func(hk *ServerHostKey) bool
+	}{
+		{"rsa", rsaBlob, HOST_KEY_RSA, false, func(hk *ServerHostKey) bool {
+			return hk.RSAPublicKey != nil && hk.RSAPublicKey.E == 65537 && hk.RSAPublicKey.N.Cmp(modulus) == 0
+		}},
+		{"ecdsa", ecdsaBlob, HOST_KEY_ECDSA_SHA2_NISTP256, false, func(hk *ServerHostKey) bool {
+			return hk.ECDSAPublicKey != nil && hk.ECDSAPublicKey.X.Cmp(ecKey.X) == 0 && hk.ECDSAPublicKey.Y.Cmp(ecKey.Y) == 0
+		}},
+		{"ed25519", ed25519Blob, HOST_KEY_ED_25519, false, func(hk *ServerHostKey) bool {
+			return hk.Ed25519PublicKey != nil && bytes.Equal(hk.Ed25519PublicKey.PublicKey, edKey)
+		}},
+		{"unknown algorithm", sshBlob([]byte("ssh-dss"), []byte{1, 2, 3}), "ssh-dss", false, func(hk *ServerHostKey) bool {
+			return hk.RSAPublicKey == nil && hk.ECDSAPublicKey == nil && hk.Ed25519PublicKey == nil
+		}},
+		{"empty", nil, "", true, nil},
+		{"short length", []byte{0x00, 0x00, 0x07}, "", true, nil},
+		{"garbage", []byte{0xff, 0xff, 0xff, 0xff, 's', 's', 'h'}, "", true, nil},
+		{"truncated rsa", rsaBlob[0 : len(rsaBlob)-1], HOST_KEY_RSA, true, nil},
+		{"rsa without modulus", sshBlob([]byte(HOST_KEY_RSA), []byte{0x03}), HOST_KEY_RSA, true, nil},
+		{"huge rsa exponent", sshBlob([]byte(HOST_KEY_RSA), bytes.Repeat([]byte{0xff}, 9), modulus.Bytes()), HOST_KEY_RSA, true, nil},
+		{"truncated ecdsa", ecdsaBlob[0 : len(ecdsaBlob)-1], HOST_KEY_ECDSA_SHA2_NISTP256, true, nil},
+		{"unknown curve", sshBlob([]byte(HOST_KEY_ECDSA_SHA2_NISTP256), []byte("brainpool"), point), HOST_KEY_ECDSA_SHA2_NISTP256, true, nil},
+		{"point off the curve", sshBlob([]byte(HOST_KEY_ECDSA_SHA2_NISTP256), []byte("nistp256"), append([]byte{0x04}, bytes.Repeat([]byte{0x01}, 64)...)), HOST_KEY_ECDSA_SHA2_NISTP256, true, nil},
+		{"truncated ed25519", ed25519Blob[0 : len(ed25519Blob)-1], HOST_KEY_ED_25519, true, nil},
+		{"short ed25519 key", sshBlob([]byte(HOST_KEY_ED_25519), edKey[0:31]), HOST_KEY_ED_25519, true, nil},
+	}
+	for _, test := range tests {
+		hk, err := ParseServerHostKey(test.raw)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.err, err)
+			continue
+		}
+		if hk == nil || !bytes.Equal(hk.Raw, test.raw) || hk.Algorithm != test.algorithm {
+			t.Errorf("%s: expected the raw blob and algorithm %q, got %+v", test.name, test.algorithm, hk)
+			continue
+		}
+		if test.check != nil && !test.check(hk) {
+			t.Errorf("%s: wrong key %+v", test.name, hk)
+		}
+	}
+}
@@ -28,6 +28,7 @@ type HandshakeLog struct {
 	KexDHGroupReply       *KeyExchangeDHGroupReply      `json:"key_exchange_dh_group_reply,omitempty"`
 	DHInit                *KeyExchangeDHInit            `json:"key_exchange_dh_init,omitempty"`
 	DHReply               *KeyExchangeDHInitReply       `json:"key_exchange_dh_reply,omitempty"`
+	ServerHostKey         *ServerHostKey                `json:"server_host_key,omitempty"`
 }
 
 type AlgorithmSelection struct {
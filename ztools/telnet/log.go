@@ -20,4 +20,14 @@ type TelnetLog struct {
 	Do     []TelnetOption `json:"do,omitempty"`
 	Wont   []TelnetOption `json:"wont,omitempty"`
 	Dont   []TelnetOption `json:"dont,omitempty"`
+
+	// Negotiation lists every option command the server sent, in order
+	Negotiation []TelnetNegotiation `json:"negotiation,omitempty"`
+}
+
+// A TelnetNegotiation is a single WILL, WONT, DO or DONT command for an
+// option
+type TelnetNegotiation struct {
+	Command string       `json:"command"`
+	Option  TelnetOption `json:"option"`
 }
@@ -36,6 +36,13 @@ const (
 	READ_BUFFER_LENGTH = 8192
 )
 
+var commandNames = map[byte]string{
+	WILL: "WILL",
+	WONT: "WONT",
+	DO:   "DO",
+	DONT: "DONT",
+}
+
 type TelnetOption uint16
 
 func (opt *TelnetOption) Name() string {
@@ -162,6 +169,9 @@ func NegotiateOptions(logStruct *TelnetLog, conn net.Conn) error {
 			} else if optionType == DONT {
 				logStruct.Dont = append(logStruct.Dont, opt)
 			}
+			if name, ok := commandNames[optionType]; ok {
+				logStruct.Negotiation = append(logStruct.Negotiation, TelnetNegotiation{Command: name, Option: opt})
+			}
 
 			// reject all offered options
 			if optionType == WILL || optionType == WONT {
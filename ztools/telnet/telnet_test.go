@@ -0,0 +1,57 @@
+/*
+ * ZGrab Copyright 2015 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package telnet
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateOptionsRecordsOrder(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		server.Write([]byte{IAC, DO, 24, IAC, WILL, 1, IAC, DO, 31, IAC, WILL, 3})
+		server.Read(make([]byte, 64))
+		server.Write([]byte("login: "))
+		// the client writes its (empty) reply to the last read
+		server.Read(make([]byte, 64))
+	}()
+	log := new(TelnetLog)
+	if err := NegotiateOptions(log, client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []TelnetNegotiation{
+		{Command: "DO", Option: 24},
+		{Command: "WILL", Option: 1},
+		{Command: "DO", Option: 31},
+		{Command: "WILL", Option: 3},
+	}
+	if !reflect.DeepEqual(log.Negotiation, expected) {
+		t.Errorf("wrong negotiation %+v", log.Negotiation)
+	}
+	if log.Banner != "login: " {
+		t.Errorf("wrong banner %q", log.Banner)
+	}
+	b, err := json.Marshal(log.Negotiation[0:1])
+	if err != nil {
+		t.Fatalf("could not marshal: %s", err)
+	}
+	if string(b) != `[{"command":"DO","option":{"name":"Terminal Type","value":24}}]` {
+		t.Errorf("wrong JSON %s", b)
+	}
+}
@@ -19,21 +19,45 @@ import (
 	"strings"
 )
 
+// ErrBufferFull is returned by ReadUntilRegex when the buffer filled up
+// before the expression matched.
+var ErrBufferFull = errors.New("Not enough buffer space")
+
+// ErrTooManyReads is returned by ReadUntilRegexLimit when the expression
+// still has not matched after the maximum number of reads.
+var ErrTooManyReads = errors.New("Too many reads without a complete response")
+
 func ReadUntilRegex(connection net.Conn, res []byte, expr *regexp.Regexp) (int, error) {
+	return ReadUntilRegexLimit(connection, res, expr, 0)
+}
+
+// ReadUntilRegexLimit is ReadUntilRegex, but gives up with ErrTooManyReads
+// after maxReads reads from connection. A maxReads of zero means no limit.
+func ReadUntilRegexLimit(connection net.Conn, res []byte, expr *regexp.Regexp, maxReads int) (int, error) {
+	return ReadUntilFuncLimit(connection, res, expr.Match, maxReads)
+}
+
+// ReadUntilFuncLimit reads from connection into res until done returns true
+// for everything read so far. It gives up with ErrTooManyReads after
+// maxReads reads, or no limit if maxReads is zero, and with ErrBufferFull
+// if res fills up before done returns true.
+func ReadUntilFuncLimit(connection net.Conn, res []byte, done func([]byte) bool, maxReads int) (int, error) {
 
 	buf := res[0:]
 	length := 0
-	for finished := false; !finished; {
+	for reads, finished := 0, false; !finished; reads++ {
+		if maxReads > 0 && reads >= maxReads {
+			return length, ErrTooManyReads
+		}
 		n, err := connection.Read(buf)
 		length += n
 		if err != nil {
 			return length, err
 		}
-		if expr.Match(res[0:length]) {
+		if done(res[0:length]) {
 			finished = true
-		}
-		if length == len(res) {
-			return length, errors.New("Not enough buffer space")
+		} else if length == len(res) {
+			return length, ErrBufferFull
 		}
 		buf = res[length:]
 	}
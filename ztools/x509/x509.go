@@ -313,6 +313,12 @@ func getSignatureAlgorithmFromOID(oid asn1.ObjectIdentifier) SignatureAlgorithm
 	return UnknownSignatureAlgorithm
 }
 
+// SignatureAlgorithmFromOID returns the SignatureAlgorithm identified by oid,
+// for checking signatures on structures other than certificates and CRLs.
+func SignatureAlgorithmFromOID(oid asn1.ObjectIdentifier) SignatureAlgorithm {
+	return getSignatureAlgorithmFromOID(oid)
+}
+
 // RFC 3279, 2.3 Public Key Algorithms
 //
 // pkcs-1 OBJECT IDENTIFIER ::== { iso(1) member-body(2) us(840)
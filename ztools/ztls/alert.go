@@ -4,7 +4,10 @@
 
 package ztls
 
-import "strconv"
+import (
+	"net"
+	"strconv"
+)
 
 type alert uint8
 
@@ -35,6 +38,7 @@ const (
 	alertProtocolVersion        alert = 70
 	alertInsufficientSecurity   alert = 71
 	alertInternalError          alert = 80
+	alertInappropriateFallback  alert = 86
 	alertUserCanceled           alert = 90
 	alertNoRenegotiation        alert = 100
 )
@@ -60,6 +64,7 @@ var alertText = map[alert]string{
 	alertProtocolVersion:        "protocol version not supported",
 	alertInsufficientSecurity:   "insufficient security level",
 	alertInternalError:          "internal error",
+	alertInappropriateFallback:  "inappropriate fallback",
 	alertUserCanceled:           "user canceled",
 	alertNoRenegotiation:        "no renegotiation",
 }
@@ -75,3 +80,14 @@ func (e alert) String() string {
 func (e alert) Error() string {
 	return e.String()
 }
+
+// RemoteAlert returns the alert code sent by the peer if err resulted from
+// receiving a fatal alert.
+func RemoteAlert(err error) (uint8, bool) {
+	opErr, ok := err.(*net.OpError)
+	if !ok || opErr.Op != "remote error" {
+		return 0, false
+	}
+	a, ok := opErr.Err.(alert)
+	return uint8(a), ok
+}
@@ -68,12 +68,14 @@ const (
 
 // TLS compression types.
 const (
-	compressionNone uint8 = 0
+	compressionNone    uint8 = 0
+	compressionDeflate uint8 = 1
 )
 
 // TLS extension numbers
 const (
 	extensionServerName           uint16 = 0
+	extensionMaxFragmentLength    uint16 = 1
 	extensionStatusRequest        uint16 = 5
 	extensionSupportedCurves      uint16 = 10
 	extensionSupportedPoints      uint16 = 11
@@ -203,6 +205,7 @@ const (
 // sessions.
 type ClientSessionState struct {
 	sessionTicket        []uint8             // Encrypted ticket used for session resumption with server
+	sessionID            []uint8             // Session ID used for stateful resumption, when there is no ticket
 	lifetimeHint         uint32              // Hint from server about how long the session ticket should be stored
 	vers                 uint16              // SSL/TLS version negotiated for the session
 	cipherSuite          uint16              // Ciphersuite negotiated for the session
@@ -324,8 +327,17 @@ type Config struct {
 	// be used.
 	CurvePreferences []CurveID
 
+	// ServerSessionIDCache makes a server issue a session ID in each full
+	// handshake, and resume a session when a client offers its ID again.
+	// Sessions are kept in memory, up to serverSessionIDCacheSize of them.
+	// Session tickets are still used when the client offers one.
+	ServerSessionIDCache bool
+
 	serverInitOnce sync.Once // guards calling (*Config).serverInit
 
+	serverSessionsMutex sync.Mutex
+	serverSessions      map[string]*sessionState
+
 	ForceSuites bool
 
 	// Export RSA Key
@@ -344,8 +356,74 @@ type Config struct {
 	// Force Client Hello to send TLS Session Ticket extension
 	ForceSessionTicketExt bool
 
+	// Cache sessions by the session ID in the ServerHello, and resume them
+	// by offering that ID, instead of using session tickets. The session
+	// ticket extension is only sent if ForceSessionTicketExt is set. Has no
+	// effect without a ClientSessionCache.
+	SessionIDResumption bool
+
 	// Enable use of the Extended Master Secret extension
 	ExtendedMasterSecret bool
+
+	// Send the max_fragment_length extension with this code, asking for
+	// records of at most 2^(8+code) bytes. Codes 1 to 4 are defined; zero
+	// leaves the extension out.
+	MaxFragmentLength uint8
+
+	// Offer DEFLATE compression in addition to null compression. Compression
+	// is not implemented, so the handshake fails if the server selects it,
+	// but the selection is still recorded in the ServerHello log.
+	OfferCompression bool
+
+	// Append TLS_FALLBACK_SCSV to the offered cipher suites, as a client
+	// retrying with a lower version does (RFC 7507)
+	FallbackSCSV bool
+
+	// KeyLogWriter optionally specifies a destination for TLS master secrets
+	// in NSS key log format that can be used to allow external programs
+	// such as Wireshark to decrypt TLS connections.
+	// See https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format.
+	// Use of KeyLogWriter compromises security and should only be
+	// used for debugging.
+	KeyLogWriter io.Writer
+
+	// SignatureAndHashes, if not nil, replaces the signature and hash
+	// algorithms offered in a TLS 1.2 ClientHello.
+	SignatureAndHashes []SignatureAndHash
+
+	// VerifyPeerCertificate, if not nil, is called by a client after the
+	// server's certificates have been parsed and validated, with the raw
+	// certificates and any chains that verified. It is called even if
+	// InsecureSkipVerify is set, and a non-nil error aborts the handshake.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+// serverSessionIDCacheSize bounds the sessions kept for ServerSessionIDCache
+const serverSessionIDCacheSize = 64
+
+// putServerSession caches state under sessionID, evicting an arbitrary
+// session when the cache is full
+func (c *Config) putServerSession(sessionID []byte, state *sessionState) {
+	c.serverSessionsMutex.Lock()
+	defer c.serverSessionsMutex.Unlock()
+	if c.serverSessions == nil {
+		c.serverSessions = make(map[string]*sessionState)
+	}
+	if len(c.serverSessions) >= serverSessionIDCacheSize {
+		for id := range c.serverSessions {
+			delete(c.serverSessions, id)
+			break
+		}
+	}
+	c.serverSessions[string(sessionID)] = state
+}
+
+// getServerSession returns the session cached under sessionID
+func (c *Config) getServerSession(sessionID []byte) (*sessionState, bool) {
+	c.serverSessionsMutex.Lock()
+	defer c.serverSessionsMutex.Unlock()
+	state, ok := c.serverSessions[string(sessionID)]
+	return state, ok
 }
 
 func (c *Config) serverInit() {
@@ -373,6 +451,24 @@ func (c *Config) rand() io.Reader {
 	return r
 }
 
+// writerMutex protects all KeyLogWriters globally. It is rarely enabled,
+// and is only for debugging, so a global mutex saves space.
+var writerMutex sync.Mutex
+
+func (c *Config) writeKeyLog(clientRandom, masterSecret []byte) error {
+	if c.KeyLogWriter == nil {
+		return nil
+	}
+
+	logLine := []byte(fmt.Sprintf("CLIENT_RANDOM %x %x\n", clientRandom, masterSecret))
+
+	writerMutex.Lock()
+	_, err := c.KeyLogWriter.Write(logLine)
+	writerMutex.Unlock()
+
+	return err
+}
+
 func (c *Config) time() time.Time {
 	t := c.Time
 	if t == nil {
@@ -470,11 +566,13 @@ func (c *Config) signatureAndHashesForServer() []signatureAndHash {
 }
 
 func (c *Config) signatureAndHashesForClient() []signatureAndHash {
-	/*
-		if c != nil && c.SignatureAndHashes != nil {
-			return c.SignatureAndHashes
+	if c != nil && c.SignatureAndHashes != nil {
+		out := make([]signatureAndHash, len(c.SignatureAndHashes))
+		for i, sh := range c.SignatureAndHashes {
+			out[i] = signatureAndHash(sh)
 		}
-	*/
+		return out
+	}
 	if c.ClientDSAEnabled {
 		return supportedSKXSignatureAlgorithms
 	}
@@ -621,6 +719,12 @@ func defaultCipherSuites() []uint16 {
 	return varDefaultCipherSuites
 }
 
+// DefaultCipherSuites returns a copy of the cipher suites offered when
+// Config.CipherSuites is nil.
+func DefaultCipherSuites() []uint16 {
+	return append([]uint16(nil), defaultCipherSuites()...)
+}
+
 func initDefaultCipherSuites() {
 	varDefaultCipherSuites = make([]uint16, len(stdlibCipherSuites))
 	for i, suite := range stdlibCipherSuites {
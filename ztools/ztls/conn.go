@@ -36,6 +36,7 @@ type Conn struct {
 	handshakeComplete    bool
 	didResume            bool // whether this connection was a session resumption
 	extendedMasterSecret bool // whether this session used an extended master secret
+	maxFragment          int  // negotiated max_fragment_length in bytes, 0 if none
 	cipherSuite          uint16
 	ocspResponse         []byte // stapled OCSP response
 	peerCertificates     []*x509.Certificate
@@ -69,6 +70,11 @@ type Conn struct {
 
 	// Raw client hello
 	clientHelloRaw []byte
+
+	// Whether the peer sent a close_notify alert
+	receivedCloseNotify bool
+	// Whether CloseWrite already sent our close_notify alert
+	sentCloseNotify bool
 }
 
 func (c *Conn) ClientHelloRaw() []byte {
@@ -669,6 +675,7 @@ Again:
 			break
 		}
 		if alert(data[1]) == alertCloseNotify {
+			c.receivedCloseNotify = true
 			c.in.setErrorLocked(io.EOF)
 			break
 		}
@@ -684,6 +691,7 @@ Again:
 		}
 
 	case recordTypeChangeCipherSpec:
+		c.logReceivedChangeCipherSpec()
 		if typ != want || len(data) != 1 || data[0] != 1 {
 			c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 			break
@@ -752,6 +760,9 @@ func (c *Conn) sendAlert(err alert) error {
 // to the connection and updates the record layer state.
 // c.out.Mutex <= L.
 func (c *Conn) writeRecord(typ recordType, data []byte) (n int, err error) {
+	if typ == recordTypeHandshake {
+		c.logHandshakeMessage(data, true)
+	}
 
 	recordHeaderLen := tlsRecordHeaderLen
 	b := c.out.newBlock()
@@ -762,6 +773,9 @@ func (c *Conn) writeRecord(typ recordType, data []byte) (n int, err error) {
 		if m > maxPlaintext {
 			m = maxPlaintext
 		}
+		if c.maxFragment > 0 && m > c.maxFragment {
+			m = c.maxFragment
+		}
 		explicitIVLen := 0
 		explicitIVIsSeq := false
 		first = false
@@ -859,6 +873,7 @@ func (c *Conn) readHandshake() (interface{}, error) {
 		}
 	}
 	data = c.hand.Next(4 + n)
+	c.logHandshakeMessage(data, false)
 	var m handshakeMessage
 	switch data[0] {
 	case typeHelloRequest:
@@ -1015,7 +1030,7 @@ func (c *Conn) Close() error {
 
 	c.handshakeMutex.Lock()
 	defer c.handshakeMutex.Unlock()
-	if c.handshakeComplete {
+	if c.handshakeComplete && !c.sentCloseNotify {
 		alertErr = c.sendAlert(alertCloseNotify)
 	}
 
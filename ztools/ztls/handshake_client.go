@@ -17,6 +17,7 @@ import (
 	"math/big"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/zmap/zgrab/ztools/x509"
 )
@@ -61,6 +62,12 @@ func (c *Conn) clientHandshake() error {
 		hello.ticketSupported = true
 	}
 
+	hello.maxFragmentLength = c.config.MaxFragmentLength
+
+	if c.config.OfferCompression {
+		hello.compressionMethods = []uint8{compressionDeflate, compressionNone}
+	}
+
 	if c.config.HeartbeatEnabled && !c.config.ExtendedRandom {
 		hello.heartbeatEnabled = true
 		hello.heartbeatMode = heartbeatModePeerAllowed
@@ -90,6 +97,11 @@ func (c *Conn) clientHandshake() error {
 		}
 	}
 
+	if c.config.FallbackSCSV {
+		// Copy first, since with ForceSuites the list belongs to the config
+		hello.cipherSuites = append(append([]uint16(nil), hello.cipherSuites...), TLS_FALLBACK_SCSV)
+	}
+
 	_, err := io.ReadFull(c.config.rand(), hello.random)
 	if err != nil {
 		c.sendAlert(alertInternalError)
@@ -116,7 +128,7 @@ func (c *Conn) clientHandshake() error {
 	}
 
 	if sessionCache != nil {
-		hello.ticketSupported = true
+		hello.ticketSupported = hello.ticketSupported || !c.config.SessionIDResumption
 
 		// Try to resume a previously negotiated TLS session, if
 		// available.
@@ -141,7 +153,10 @@ func (c *Conn) clientHandshake() error {
 		}
 	}
 
-	if session != nil {
+	if session != nil && session.sessionTicket == nil {
+		// Stateful resumption offers the ID the server assigned
+		hello.sessionId = session.sessionID
+	} else if session != nil {
 		hello.sessionTicket = session.sessionTicket
 		// A random session ID is used to detect when the
 		// server accepted the ticket and is resuming a session
@@ -153,8 +168,23 @@ func (c *Conn) clientHandshake() error {
 		}
 	}
 
-	c.writeRecord(recordTypeHandshake, hello.marshal())
+	// Time from the ClientHello until the handshake completes or fails
+	start := time.Now()
+	defer func() {
+		c.handshakeLog.Duration = time.Since(start)
+	}()
+
+	_, err = c.writeRecord(recordTypeHandshake, hello.marshal())
 	c.handshakeLog.ClientHello = hello.MakeLog()
+	for v := c.config.minVersion(); v <= hello.vers; v++ {
+		c.handshakeLog.OfferedVersions = append(c.handshakeLog.OfferedVersions, TLSVersion(v))
+	}
+	for _, method := range hello.compressionMethods {
+		c.handshakeLog.OfferedCompression = append(c.handshakeLog.OfferedCompression, int(method))
+	}
+	if err != nil {
+		return err
+	}
 
 	msg, err := c.readHandshake()
 	if err != nil {
@@ -167,6 +197,14 @@ func (c *Conn) clientHandshake() error {
 	}
 	c.handshakeLog.ServerHello = serverHello.MakeLog()
 
+	if serverHello.maxFragmentLength != 0 {
+		if serverHello.maxFragmentLength != hello.maxFragmentLength {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server sent a different max_fragment_length")
+		}
+		c.maxFragment = 1 << (8 + uint(serverHello.maxFragmentLength))
+	}
+
 	if serverHello.heartbeatEnabled {
 		c.heartbeat = true
 		c.heartbleedLog.HeartbeatEnabled = true
@@ -242,9 +280,19 @@ func (c *Conn) clientHandshake() error {
 		if err := hs.readFinished(); err != nil {
 			return err
 		}
+		if hs.session == nil && c.config.SessionIDResumption && len(serverHello.sessionId) > 0 {
+			hs.session = &ClientSessionState{
+				sessionID:            append([]byte(nil), serverHello.sessionId...),
+				vers:                 c.vers,
+				cipherSuite:          hs.suite.id,
+				masterSecret:         hs.masterSecret,
+				serverCertificates:   c.peerCertificates,
+				extendedMasterSecret: c.extendedMasterSecret,
+			}
+		}
 	}
 
-	if hs.session == nil {
+	if hs.session == nil || hs.session.sessionID != nil {
 		c.handshakeLog.SessionTicket = nil
 	} else {
 		c.handshakeLog.SessionTicket = hs.session.MakeLog()
@@ -257,6 +305,7 @@ func (c *Conn) clientHandshake() error {
 	}
 
 	c.didResume = isResume
+	c.handshakeLog.Resumed = isResume
 	c.handshakeComplete = true
 	c.cipherSuite = suite.id
 	return nil
@@ -274,7 +323,12 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 	isAnon := hs.suite != nil && (hs.suite.flags&suiteAnon > 0)
 
-	if !isAnon {
+	// A server that picked an unimplemented suite without certificates,
+	// such as plain PSK, goes straight to its ServerKeyExchange
+	_, skipCert := msg.(*serverKeyExchangeMsg)
+	skipCert = skipCert && c.cipherError != nil
+
+	if !isAnon && !skipCert {
 
 		certMsg, ok := msg.(*certificateMsg)
 		if !ok || len(certMsg.certificates) == 0 {
@@ -333,6 +387,16 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			return errors.New("tls: failed to parse certificate from server: " + invalidCertErr.Error())
 		}
 
+		if c.config.VerifyPeerCertificate != nil {
+			result := new(VerifyCallbackResult)
+			c.handshakeLog.VerifyCallback = result
+			if err := c.config.VerifyPeerCertificate(certMsg.certificates, c.verifiedChains); err != nil {
+				result.Error = err.Error()
+				c.sendAlert(alertBadCertificate)
+				return err
+			}
+		}
+
 		c.peerCertificates = certs
 
 		if hs.serverHello.ocspStapling {
@@ -349,6 +413,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 			if cs.statusType == statusTypeOCSP {
 				c.ocspResponse = cs.response
+				c.handshakeLog.OCSPResponse = cs.response
 			}
 		}
 
@@ -381,6 +446,10 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 	// If we don't support the cipher, quit before we need to read the hs.suite
 	// variable
 	if c.cipherError != nil {
+		if skx, ok := msg.(*serverKeyExchangeMsg); ok {
+			c.handshakeLog.ServerKeyExchange = skx.MakeLog(nil)
+			c.handshakeLog.ServerKeyExchange.PSKIdentityHint = pskIdentityHint(hs.serverHello.cipherSuite, skx.key)
+		}
 		return c.cipherError
 	}
 
@@ -393,6 +462,9 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 		err = keyAgreement.processServerKeyExchange(c.config, hs.hello, hs.serverHello, serverCert, skx)
 		c.handshakeLog.ServerKeyExchange = skx.MakeLog(keyAgreement)
+		if ecdhe, ok := keyAgreement.(*ecdheKeyAgreement); ok {
+			c.handshakeLog.NegotiatedGroup = CurveID(ecdhe.curveID)
+		}
 		if err != nil {
 			c.sendAlert(alertUnexpectedMessage)
 			return err
@@ -422,6 +494,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		// arrangement to the contrary.
 
 		hs.finishedHash.Write(certReq.marshal())
+		c.handshakeLog.CertificateRequest = certReq.MakeLog()
 
 		var rsaAvail, ecdsaAvail bool
 		for _, certType := range certReq.certificateTypes {
@@ -603,6 +676,11 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 func (hs *clientHandshakeState) establishKeys() error {
 	c := hs.c
 
+	if err := c.config.writeKeyLog(hs.hello.random, hs.masterSecret); err != nil {
+		c.sendAlert(alertInternalError)
+		return err
+	}
+
 	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV := keysFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.hello.random, hs.serverHello.random, hs.suite.macLen, hs.suite.keyLen, hs.suite.ivLen)
 	var clientCipher, serverCipher interface{}
 	var clientHash, serverHash macFunction
@@ -439,3 +439,51 @@ func TestLRUClientSessionCache(t *testing.T) {
 		t.Fatalf("failed to add nil entry to cache")
 	}
 }
+
+func TestClientRecordsPSKIdentityHint(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+		// Discard the ClientHello record
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(serverConn, header); err != nil {
+			return
+		}
+		body := make([]byte, int(header[3])<<8|int(header[4]))
+		if _, err := io.ReadFull(serverConn, body); err != nil {
+			return
+		}
+
+		hello := &serverHelloMsg{
+			vers:        VersionTLS12,
+			random:      make([]byte, 32),
+			cipherSuite: TLS_PSK_WITH_AES_128_CBC_SHA,
+		}
+		hint := "device-1234"
+		skx := &serverKeyExchangeMsg{key: append([]byte{0, byte(len(hint))}, hint...)}
+		var out []byte
+		for _, msg := range [][]byte{hello.marshal(), skx.marshal()} {
+			out = append(out, byte(recordTypeHandshake), 3, 3, byte(len(msg)>>8), byte(len(msg)))
+			out = append(out, msg...)
+		}
+		serverConn.Write(out)
+	}()
+
+	client := Client(clientConn, &Config{
+		InsecureSkipVerify: true,
+		CipherSuites:       []uint16{TLS_PSK_WITH_AES_128_CBC_SHA},
+		ForceSuites:        true,
+	})
+	if err := client.Handshake(); err != ErrUnimplementedCipher {
+		t.Fatalf("expected %v, got %v", ErrUnimplementedCipher, err)
+	}
+	skx := client.GetHandshakeLog().ServerKeyExchange
+	if skx == nil {
+		t.Fatal("expected the ServerKeyExchange to be logged")
+	}
+	if skx.PSKIdentityHint != "device-1234" {
+		t.Errorf("expected hint device-1234, got %q", skx.PSKIdentityHint)
+	}
+}
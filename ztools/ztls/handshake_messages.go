@@ -27,6 +27,7 @@ type clientHelloMsg struct {
 	extendedRandomEnabled bool
 	extendedRandom        []byte
 	extendedMasterSecret  bool
+	maxFragmentLength     uint8
 }
 
 func (m *clientHelloMsg) equal(i interface{}) bool {
@@ -54,7 +55,8 @@ func (m *clientHelloMsg) equal(i interface{}) bool {
 		m.heartbeatMode == m1.heartbeatMode &&
 		m.extendedRandomEnabled == m1.extendedRandomEnabled &&
 		bytes.Equal(m.extendedRandom, m1.extendedRandom) &&
-		m.extendedMasterSecret == m1.extendedMasterSecret
+		m.extendedMasterSecret == m1.extendedMasterSecret &&
+		m.maxFragmentLength == m1.maxFragmentLength
 }
 
 func (m *clientHelloMsg) marshal() []byte {
@@ -107,6 +109,10 @@ func (m *clientHelloMsg) marshal() []byte {
 	if m.extendedMasterSecret {
 		numExtensions++
 	}
+	if m.maxFragmentLength != 0 {
+		extensionsLength += 1
+		numExtensions++
+	}
 	if numExtensions > 0 {
 		extensionsLength += 4 * numExtensions
 		length += 2 + extensionsLength
@@ -286,6 +292,13 @@ func (m *clientHelloMsg) marshal() []byte {
 		z[1] = byte(extensionExtendedMasterSecret & 0xff)
 		z = z[4:]
 	}
+	if m.maxFragmentLength != 0 {
+		z[0] = byte(extensionMaxFragmentLength >> 8)
+		z[1] = byte(extensionMaxFragmentLength)
+		z[3] = 1
+		z[4] = m.maxFragmentLength
+		z = z[5:]
+	}
 	m.raw = x
 
 	return x
@@ -341,6 +354,7 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 	m.signatureAndHashes = nil
 	m.heartbeatEnabled = false
 	m.extendedMasterSecret = false
+	m.maxFragmentLength = 0
 
 	if len(data) == 0 {
 		// ClientHello is optionally followed by extension data
@@ -481,6 +495,11 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.extendedMasterSecret = true
+		case extensionMaxFragmentLength:
+			if length != 1 {
+				return false
+			}
+			m.maxFragmentLength = data[0]
 		}
 		data = data[length:]
 	}
@@ -505,6 +524,10 @@ type serverHelloMsg struct {
 	extendedRandomEnabled bool
 	extendedRandom        []byte
 	extendedMasterSecret  bool
+	maxFragmentLength     uint8
+
+	// extensionIDs lists the extensions in a received ServerHello, in order
+	extensionIDs []uint16
 }
 
 func (m *serverHelloMsg) equal(i interface{}) bool {
@@ -524,7 +547,8 @@ func (m *serverHelloMsg) equal(i interface{}) bool {
 		m.ocspStapling == m1.ocspStapling &&
 		m.ticketSupported == m1.ticketSupported &&
 		m.secureRenegotiation == m1.secureRenegotiation &&
-		m.extendedMasterSecret == m1.extendedMasterSecret
+		m.extendedMasterSecret == m1.extendedMasterSecret &&
+		m.maxFragmentLength == m1.maxFragmentLength
 }
 
 func (m *serverHelloMsg) marshal() []byte {
@@ -566,6 +590,10 @@ func (m *serverHelloMsg) marshal() []byte {
 	if m.extendedMasterSecret {
 		numExtensions++
 	}
+	if m.maxFragmentLength != 0 {
+		extensionsLength += 1
+		numExtensions++
+	}
 	if numExtensions > 0 {
 		extensionsLength += 4 * numExtensions
 		length += 2 + extensionsLength
@@ -652,6 +680,13 @@ func (m *serverHelloMsg) marshal() []byte {
 		z[1] = byte(extensionExtendedMasterSecret & 0xff)
 		z = z[4:]
 	}
+	if m.maxFragmentLength != 0 {
+		z[0] = byte(extensionMaxFragmentLength >> 8)
+		z[1] = byte(extensionMaxFragmentLength)
+		z[3] = 1
+		z[4] = m.maxFragmentLength
+		z = z[5:]
+	}
 
 	m.raw = x
 
@@ -685,6 +720,8 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 	m.heartbeatEnabled = false
 	m.extendedRandomEnabled = false
 	m.extendedMasterSecret = false
+	m.maxFragmentLength = 0
+	m.extensionIDs = nil
 
 	if len(data) == 0 {
 		// ServerHello is optionally followed by extension data
@@ -710,6 +747,7 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 		if len(data) < length {
 			return false
 		}
+		m.extensionIDs = append(m.extensionIDs, extension)
 
 		switch extension {
 		case extensionNextProtoNeg:
@@ -762,6 +800,11 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.extendedMasterSecret = true
+		case extensionMaxFragmentLength:
+			if length != 1 {
+				return false
+			}
+			m.maxFragmentLength = data[0]
 		}
 		data = data[length:]
 	}
@@ -138,6 +138,9 @@ func (*clientHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	if rand.Intn(10) > 5 {
 		m.signatureAndHashes = supportedSKXSignatureAlgorithms
 	}
+	if rand.Intn(10) > 5 {
+		m.maxFragmentLength = uint8(rand.Intn(4) + 1)
+	}
 
 	return reflect.ValueOf(m)
 }
@@ -166,6 +169,9 @@ func (*serverHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	if rand.Intn(10) > 5 {
 		m.ticketSupported = true
 	}
+	if rand.Intn(10) > 5 {
+		m.maxFragmentLength = uint8(rand.Intn(4) + 1)
+	}
 
 	return reflect.ValueOf(m)
 }
@@ -77,6 +77,7 @@ func (c *Conn) serverHandshake() error {
 		if err := hs.readFinished(); err != nil {
 			return err
 		}
+		hs.cacheSession()
 		if err := hs.sendSessionTicket(); err != nil {
 			return err
 		}
@@ -218,12 +219,14 @@ Curves:
 func (hs *serverHandshakeState) checkForResumption() bool {
 	c := hs.c
 
-	if c.config.SessionTicketsDisabled {
-		return false
-	}
-
 	var ok bool
-	if hs.sessionState, ok = c.decryptTicket(hs.clientHello.sessionTicket); !ok {
+	if !c.config.SessionTicketsDisabled {
+		hs.sessionState, ok = c.decryptTicket(hs.clientHello.sessionTicket)
+	}
+	if !ok && c.config.ServerSessionIDCache && len(hs.clientHello.sessionId) > 0 {
+		hs.sessionState, ok = c.config.getServerSession(hs.clientHello.sessionId)
+	}
+	if !ok {
 		return false
 	}
 
@@ -295,6 +298,13 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 	}
 
 	hs.hello.ticketSupported = hs.clientHello.ticketSupported && !config.SessionTicketsDisabled
+	if config.ServerSessionIDCache {
+		hs.hello.sessionId = make([]byte, 32)
+		if _, err := io.ReadFull(config.rand(), hs.hello.sessionId); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+	}
 	hs.hello.cipherSuite = hs.suite.id
 	c.extendedMasterSecret = hs.hello.extendedMasterSecret
 	hs.finishedHash.Write(hs.hello.marshal())
@@ -582,6 +592,22 @@ func (hs *serverHandshakeState) readFinished() error {
 	return nil
 }
 
+// cacheSession keeps the session under the ID sent in the ServerHello, if
+// the server issued one
+func (hs *serverHandshakeState) cacheSession() {
+	if len(hs.hello.sessionId) == 0 {
+		return
+	}
+	c := hs.c
+	c.config.putServerSession(hs.hello.sessionId, &sessionState{
+		vers:                 c.vers,
+		cipherSuite:          hs.suite.id,
+		masterSecret:         hs.masterSecret,
+		certificates:         hs.certsFromClient,
+		extendedMasterSecret: c.extendedMasterSecret,
+	})
+}
+
 func (hs *serverHandshakeState) sendSessionTicket() error {
 	if !hs.hello.ticketSupported {
 		return nil
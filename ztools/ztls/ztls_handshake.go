@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/zmap/zgrab/ztools/keys"
 	"github.com/zmap/zgrab/ztools/x509"
@@ -40,6 +41,8 @@ type ServerHello struct {
 	HeartbeatSupported   bool        `json:"heartbeat"`
 	ExtendedRandom       []byte      `json:"extended_random,omitempty"`
 	ExtendedMasterSecret bool        `json:"extended_master_secret"`
+	MaxFragmentLength    uint8       `json:"max_fragment_length,omitempty"`
+	ExtensionIDs         []uint16    `json:"extension_ids,omitempty"`
 }
 
 // SimpleCertificate holds a *x509.Certificate and a []byte for the certificate
@@ -58,12 +61,13 @@ type Certificates struct {
 
 // ServerKeyExchange represents the raw key data sent by the server in TLS key exchange message
 type ServerKeyExchange struct {
-	Raw            []byte             `json:"-"`
-	RSAParams      *keys.RSAPublicKey `json:"rsa_params,omitempty"`
-	DHParams       *keys.DHParams     `json:"dh_params,omitempty"`
-	ECDHParams     *keys.ECDHParams   `json:"ecdh_params,omitempty"`
-	Signature      *DigitalSignature  `json:"signature,omitempty"`
-	SignatureError string             `json:"signature_error,omitempty"`
+	Raw             []byte             `json:"-"`
+	RSAParams       *keys.RSAPublicKey `json:"rsa_params,omitempty"`
+	DHParams        *keys.DHParams     `json:"dh_params,omitempty"`
+	ECDHParams      *keys.ECDHParams   `json:"ecdh_params,omitempty"`
+	Signature       *DigitalSignature  `json:"signature,omitempty"`
+	SignatureError  string             `json:"signature_error,omitempty"`
+	PSKIdentityHint string             `json:"psk_identity_hint,omitempty"`
 }
 
 // ClientKeyExchange represents the raw key data sent by the client in TLS key exchange message
@@ -79,6 +83,14 @@ type Finished struct {
 	VerifyData []byte `json:"verify_data"`
 }
 
+// CertificateRequest represents a TLS CertificateRequest message. The
+// certificate authorities are DER encoded distinguished names.
+type CertificateRequest struct {
+	CertificateTypes       []uint8            `json:"certificate_types,omitempty"`
+	SignatureAndHashes     []SignatureAndHash `json:"signature_and_hashes,omitempty"`
+	CertificateAuthorities [][]byte           `json:"certificate_authorities,omitempty"`
+}
+
 // SessionTicket represents the new session ticket sent by the server to the
 // client
 type SessionTicket struct {
@@ -107,15 +119,68 @@ type KeyMaterial struct {
 // ServerHandshake stores all of the messages sent by the server during a standard TLS Handshake.
 // It implements zgrab.EventData interface
 type ServerHandshake struct {
-	ClientHello        *ClientHello       `json:"client_hello,omitempty"`
-	ServerHello        *ServerHello       `json:"server_hello,omitempty"`
-	ServerCertificates *Certificates      `json:"server_certificates,omitempty"`
-	ServerKeyExchange  *ServerKeyExchange `json:"server_key_exchange,omitempty"`
-	ClientKeyExchange  *ClientKeyExchange `json:"client_key_exchange,omitempty"`
-	ClientFinished     *Finished          `json:"client_finished,omitempty"`
-	SessionTicket      *SessionTicket     `json:"session_ticket,omitempty"`
-	ServerFinished     *Finished          `json:"server_finished,omitempty"`
-	KeyMaterial        *KeyMaterial       `json:"key_material,omitempty"`
+	ClientHello        *ClientHello        `json:"client_hello,omitempty"`
+	ServerHello        *ServerHello        `json:"server_hello,omitempty"`
+	ServerCertificates *Certificates       `json:"server_certificates,omitempty"`
+	ServerKeyExchange  *ServerKeyExchange  `json:"server_key_exchange,omitempty"`
+	CertificateRequest *CertificateRequest `json:"certificate_request,omitempty"`
+	ClientKeyExchange  *ClientKeyExchange  `json:"client_key_exchange,omitempty"`
+	ClientFinished     *Finished           `json:"client_finished,omitempty"`
+	SessionTicket      *SessionTicket      `json:"session_ticket,omitempty"`
+	ServerFinished     *Finished           `json:"server_finished,omitempty"`
+	KeyMaterial        *KeyMaterial        `json:"key_material,omitempty"`
+
+	// Resumed is true if the server resumed a cached session, by ticket or
+	// session ID
+	Resumed bool `json:"resumed,omitempty"`
+
+	// OfferedVersions lists every protocol version the client was willing to
+	// negotiate, from the configured minimum up to the version in the hello
+	OfferedVersions []TLSVersion `json:"offered_versions,omitempty"`
+
+	// OfferedCompression lists the compression methods in the ClientHello,
+	// in order of preference (0 is null, 1 is DEFLATE)
+	OfferedCompression []int `json:"offered_compression,omitempty"`
+
+	// Duration is the time from sending the ClientHello until the handshake
+	// finished or failed
+	Duration time.Duration `json:"duration_ns,omitempty"`
+
+	// MessageSizes holds the total length in bytes of each type of handshake
+	// message, including the four byte handshake header, keyed by sender and
+	// type (e.g. "server_certificate")
+	MessageSizes map[string]int `json:"message_sizes,omitempty"`
+
+	// ReceivedMessages lists the handshake messages and ChangeCipherSpec
+	// records received from the server, named as in MessageSizes, in the
+	// order they arrived
+	ReceivedMessages []string `json:"received_messages,omitempty"`
+
+	// NegotiatedGroup is the named curve the server chose for an ECDHE key
+	// exchange, and zero for other key exchanges
+	NegotiatedGroup CurveID `json:"negotiated_group,omitempty"`
+
+	// RawClientBytes and RawServerBytes are everything written and read on
+	// the connection during the handshake, when the caller records them
+	RawClientBytes []byte `json:"raw_client_bytes,omitempty"`
+	RawServerBytes []byte `json:"raw_server_bytes,omitempty"`
+
+	// OCSPResponse is the DER OCSP response the server stapled in a
+	// CertificateStatus message
+	OCSPResponse []byte `json:"ocsp_response,omitempty"`
+
+	// JA3S is the JA3S fingerprint of the ServerHello, when the caller
+	// computes it
+	JA3S string `json:"ja3s,omitempty"`
+
+	// VerifyCallback is set when Config.VerifyPeerCertificate was called
+	VerifyCallback *VerifyCallbackResult `json:"verify_callback,omitempty"`
+}
+
+// VerifyCallbackResult records what Config.VerifyPeerCertificate returned.
+// An empty Error means the callback accepted the certificates.
+type VerifyCallbackResult struct {
+	Error string `json:"error,omitempty"`
 }
 
 // MarshalJSON implements the json.Marshler interface
@@ -185,6 +250,61 @@ func (c *Conn) GetHandshakeLog() *ServerHandshake {
 	return c.handshakeLog
 }
 
+// ReceivedCloseNotify returns true if the peer has sent a close_notify
+// alert. A peer that closes the connection without one leaves the reader
+// unable to tell a complete response from a truncated one.
+func (c *Conn) ReceivedCloseNotify() bool {
+	return c.receivedCloseNotify
+}
+
+// CloseWrite sends a close_notify alert without closing the connection, so
+// that the peer's own close_notify can still be read. Close will not send a
+// second one.
+func (c *Conn) CloseWrite() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if !c.handshakeComplete {
+		return errEarlyCloseWrite
+	}
+	if c.sentCloseNotify {
+		return nil
+	}
+	c.sentCloseNotify = true
+	return c.sendAlert(alertCloseNotify)
+}
+
+var errEarlyCloseWrite = errors.New("tls: CloseWrite called before handshake complete")
+
+// logHandshakeMessage records a handshake message that was sent or received
+// as a client in the handshake log.
+func (c *Conn) logHandshakeMessage(data []byte, sent bool) {
+	if !c.isClient || c.handshakeLog == nil || len(data) < 4 {
+		return
+	}
+	name := nameForHandshakeType(data[0])
+	if sent && !strings.HasPrefix(name, "client_") {
+		name = "client_" + name
+	} else if !sent && !strings.HasPrefix(name, "server_") {
+		name = "server_" + name
+	}
+	if c.handshakeLog.MessageSizes == nil {
+		c.handshakeLog.MessageSizes = make(map[string]int)
+	}
+	c.handshakeLog.MessageSizes[name] += len(data)
+	if !sent {
+		c.handshakeLog.ReceivedMessages = append(c.handshakeLog.ReceivedMessages, name)
+	}
+}
+
+// logReceivedChangeCipherSpec records a ChangeCipherSpec record from the
+// server in the order of received messages.
+func (c *Conn) logReceivedChangeCipherSpec() {
+	if !c.isClient || c.handshakeLog == nil {
+		return
+	}
+	c.handshakeLog.ReceivedMessages = append(c.handshakeLog.ReceivedMessages, "server_change_cipher_spec")
+}
+
 func (c *Conn) InCipher() (cipher interface{}) {
 	return c.in.cipher
 }
@@ -232,6 +352,11 @@ func (m *serverHelloMsg) MakeLog() *ServerHello {
 		copy(sh.ExtendedRandom, m.extendedRandom)
 	}
 	sh.ExtendedMasterSecret = m.extendedMasterSecret
+	sh.MaxFragmentLength = m.maxFragmentLength
+	if len(m.extensionIDs) > 0 {
+		sh.ExtensionIDs = make([]uint16, len(m.extensionIDs))
+		copy(sh.ExtensionIDs, m.extensionIDs)
+	}
 	return sh
 }
 
@@ -309,6 +434,20 @@ func (m *serverKeyExchangeMsg) MakeLog(ka keyAgreement) *ServerKeyExchange {
 	return skx
 }
 
+// pskIdentityHint returns the psk_identity_hint that begins the
+// ServerKeyExchange of the PSK suites (RFC 4279, RFC 5489), or "" for other
+// suites
+func pskIdentityHint(suite uint16, key []byte) string {
+	if !strings.Contains(CipherSuite(suite).String(), "_PSK_") || len(key) < 2 {
+		return ""
+	}
+	n := int(key[0])<<8 | int(key[1])
+	if len(key) < 2+n {
+		return ""
+	}
+	return string(key[2 : 2+n])
+}
+
 func (m *finishedMsg) MakeLog() *Finished {
 	sf := new(Finished)
 	sf.VerifyData = make([]byte, len(m.verifyData))
@@ -316,6 +455,18 @@ func (m *finishedMsg) MakeLog() *Finished {
 	return sf
 }
 
+func (m *certificateRequestMsg) MakeLog() *CertificateRequest {
+	cr := new(CertificateRequest)
+	cr.CertificateTypes = append([]uint8(nil), m.certificateTypes...)
+	for _, sh := range m.signatureAndHashes {
+		cr.SignatureAndHashes = append(cr.SignatureAndHashes, SignatureAndHash(sh))
+	}
+	for _, ca := range m.certificateAuthorities {
+		cr.CertificateAuthorities = append(cr.CertificateAuthorities, append([]byte(nil), ca...))
+	}
+	return cr
+}
+
 func (m *ClientSessionState) MakeLog() *SessionTicket {
 	st := new(SessionTicket)
 	st.Length = len(m.sessionTicket)
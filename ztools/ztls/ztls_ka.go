@@ -17,6 +17,17 @@ import (
 // json.Unmarshaler
 type SignatureAndHash signatureAndHash
 
+// SignatureAndHashFromCode returns the algorithm pair with the given TLS 1.2
+// wire encoding, hash in the high byte and signature in the low byte.
+func SignatureAndHashFromCode(code uint16) SignatureAndHash {
+	return SignatureAndHash{signature: uint8(code), hash: uint8(code >> 8)}
+}
+
+// Code returns the TLS 1.2 wire encoding of the algorithm pair
+func (sh SignatureAndHash) Code() uint16 {
+	return uint16(sh.hash)<<8 | uint16(sh.signature)
+}
+
 type auxSignatureAndHash struct {
 	SignatureAlgorithm string `json:"signature_algorithm"`
 	HashAlgorithm      string `json:"hash_algorithm"`
@@ -4,11 +4,15 @@
 
 package ztls
 
-import "strconv"
+import (
+	"sort"
+	"strconv"
+)
 
 var signatureNames map[uint8]string
 var hashNames map[uint8]string
 var cipherSuiteNames map[int]string
+var handshakeTypeNames map[uint8]string
 
 func init() {
 	signatureNames = make(map[uint8]string, 8)
@@ -24,6 +28,23 @@ func init() {
 	hashNames[hashSHA384] = "sha384"
 	hashNames[hashSHA512] = "sha512"
 
+	handshakeTypeNames = make(map[uint8]string, 16)
+	handshakeTypeNames[typeHelloRequest] = "hello_request"
+	handshakeTypeNames[typeClientHello] = "client_hello"
+	handshakeTypeNames[typeServerHello] = "server_hello"
+	handshakeTypeNames[typeHelloVerifyRequest] = "hello_verify_request"
+	handshakeTypeNames[typeNewSessionTicket] = "new_session_ticket"
+	handshakeTypeNames[typeCertificate] = "certificate"
+	handshakeTypeNames[typeServerKeyExchange] = "server_key_exchange"
+	handshakeTypeNames[typeCertificateRequest] = "certificate_request"
+	handshakeTypeNames[typeServerHelloDone] = "server_hello_done"
+	handshakeTypeNames[typeCertificateVerify] = "certificate_verify"
+	handshakeTypeNames[typeClientKeyExchange] = "client_key_exchange"
+	handshakeTypeNames[typeFinished] = "finished"
+	handshakeTypeNames[typeCertificateStatus] = "certificate_status"
+	handshakeTypeNames[typeNextProtocol] = "next_protocol"
+	handshakeTypeNames[typeEncryptedExtensions] = "encrypted_extensions"
+
 	cipherSuiteNames = make(map[int]string, 512)
 	cipherSuiteNames[0x0000] = "TLS_NULL_WITH_NULL_NULL"
 	cipherSuiteNames[0x0001] = "TLS_RSA_WITH_NULL_MD5"
@@ -386,6 +407,13 @@ func nameForSignature(s uint8) string {
 	return "unknown." + strconv.Itoa(int(s))
 }
 
+func nameForHandshakeType(t uint8) string {
+	if name, ok := handshakeTypeNames[t]; ok {
+		return name
+	}
+	return "unknown." + strconv.Itoa(int(t))
+}
+
 func nameForHash(h uint8) string {
 	if name, ok := hashNames[h]; ok {
 		return name
@@ -394,6 +422,28 @@ func nameForHash(h uint8) string {
 	return "unknown." + num
 }
 
+// NamedCipherSuites returns every cipher suite ztls has a name for, in
+// ascending order, leaving out the null suite and the signaling values
+// TLS_RENEGO_PROTECTION_REQUEST and TLS_FALLBACK_SCSV. Most of them are not
+// implemented and can only be offered with Config.ForceSuites.
+func NamedCipherSuites() []uint16 {
+	suites := make([]uint16, 0, len(cipherSuiteNames))
+	for id := range cipherSuiteNames {
+		if id == 0x0000 || id == 0x00FF || id == 0x5600 {
+			continue
+		}
+		suites = append(suites, uint16(id))
+	}
+	sort.Sort(uint16Slice(suites))
+	return suites
+}
+
+type uint16Slice []uint16
+
+func (s uint16Slice) Len() int           { return len(s) }
+func (s uint16Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint16Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func nameForSuite(cs uint16) string {
 	cipher := CipherSuite(cs)
 	return cipher.String()